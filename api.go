@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+func apiFlags() []cli.Flag {
+	return append(commonFlags(), []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "field, f",
+			Usage: "Parameter in key=value format, added to the query for GET and to the JSON body otherwise. Can be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "typed_field, F",
+			Usage: "Same as --field, but numbers, true, false and null are sent as JSON values, and @path is replaced by the content of the file",
+		},
+		cli.StringSliceFlag{
+			Name:  "path_param, P",
+			Usage: "Value of a placeholder in the path in name=value format, e.g. batch_run_number=12 for {batch_run_number}. {organization} and {project} are filled by the options",
+		},
+		cli.StringFlag{
+			Name:  "input",
+			Usage: "File of the JSON body to send. '-' reads it from stdin",
+		},
+		cli.StringSliceFlag{
+			Name:  "file",
+			Usage: "File to upload in name=path format. The fields are sent as multipart form data with it. Can be specified multiple times",
+		},
+		cli.BoolFlag{
+			Name:  "paginate",
+			Usage: "Follow the 'next' URL of paginated responses, and output the pages one per line",
+		},
+		cli.StringFlag{
+			Name:  "jq, q",
+			Usage: "Extract values from the JSON response by a path like .batch_runs[].url (a subset of the jq syntax: .key, [index] and [])",
+		},
+	}...)
+}
+
+// apiAction calls an arbitrary endpoint of the Web API, e.g. "api GET /{organization}/{project}/batch-runs/ -f count=5"
+func apiAction(c *cli.Context) error {
+	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
+	if err != nil {
+		return err
+	}
+	var method, path string
+	switch c.NArg() {
+	case 1:
+		method, path = "GET", c.Args().Get(0)
+	case 2:
+		method, path = strings.ToUpper(c.Args().Get(0)), c.Args().Get(1)
+	default:
+		return cli.NewExitError("usage: api [METHOD] PATH", 1)
+	}
+	apiRequest, err := parseAPIRequest(c, method, path)
+	if err != nil {
+		return err
+	}
+	var query []jqStep
+	if expression := c.String("jq"); expression != "" {
+		if query, err = parseJq(expression); err != nil {
+			return cli.NewExitError(fmt.Sprintf("invalid --jq expression: %s", err), 1)
+		}
+	}
+
+	output := func(body []byte) error {
+		if query == nil {
+			fmt.Println(strings.TrimRight(string(body), "\n"))
+			return nil
+		}
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			return fmt.Errorf("response is not JSON: %s", err)
+		}
+		for _, extracted := range evalJq(query, value) {
+			if s, ok := extracted.(string); ok {
+				fmt.Println(s) // strings are output raw like jq -r
+				continue
+			}
+			b, err := json.Marshal(extracted)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		}
+		return nil
+	}
+	if !c.Bool("paginate") {
+		body, exitErr := common.CallAPI(urlBase, apiToken, organization, project, httpHeadersMap, apiRequest)
+		if exitErr != nil {
+			return exitErr
+		}
+		if err := output(body); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	}
+	var outputErr error
+	exitErr := common.CallAPIPages(urlBase, apiToken, organization, project, httpHeadersMap, apiRequest, func(page []byte) bool {
+		// one page per line
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, page); err == nil {
+			page = compact.Bytes()
+		}
+		outputErr = output(page)
+		return outputErr == nil
+	})
+	if exitErr != nil {
+		return exitErr
+	}
+	if outputErr != nil {
+		return cli.NewExitError(outputErr.Error(), 1)
+	}
+	return nil
+}
+
+func parseAPIRequest(c *cli.Context, method string, path string) (common.APIRequest, error) {
+	apiRequest := common.APIRequest{Method: method, Path: path, PathParams: map[string]string{}, Query: url.Values{}}
+	for _, param := range c.StringSlice("path_param") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return apiRequest, cli.NewExitError(fmt.Sprintf("--path_param must be in name=value format: %s", param), 1)
+		}
+		apiRequest.PathParams[kv[0]] = kv[1]
+	}
+
+	fields := map[string]interface{}{}
+	var fieldNames []string
+	for _, typed := range []bool{false, true} {
+		name := "field"
+		if typed {
+			name = "typed_field"
+		}
+		for _, field := range c.StringSlice(name) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return apiRequest, cli.NewExitError(fmt.Sprintf("--%s must be in key=value format: %s", name, field), 1)
+			}
+			var value interface{} = kv[1]
+			if typed {
+				var err error
+				if value, err = typedFieldValue(kv[1]); err != nil {
+					return apiRequest, cli.NewExitError(err.Error(), 1)
+				}
+			}
+			if _, exists := fields[kv[0]]; !exists {
+				fieldNames = append(fieldNames, kv[0])
+			}
+			fields[kv[0]] = value
+		}
+	}
+	input := c.String("input")
+	files := c.StringSlice("file")
+
+	if method == "GET" || method == "HEAD" {
+		if input != "" || len(files) > 0 {
+			return apiRequest, cli.NewExitError(fmt.Sprintf("--input and --file cannot be used with %s", method), 1)
+		}
+		for _, name := range fieldNames {
+			value := fields[name]
+			if s, ok := value.(string); ok {
+				apiRequest.Query.Add(name, s)
+			} else {
+				b, _ := json.Marshal(value)
+				apiRequest.Query.Add(name, string(b))
+			}
+		}
+		return apiRequest, nil
+	}
+	if len(files) > 0 {
+		if input != "" {
+			return apiRequest, cli.NewExitError("--input and --file cannot be specified at the same time", 1)
+		}
+		apiRequest.Files = map[string]string{}
+		for _, file := range files {
+			kv := strings.SplitN(file, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return apiRequest, cli.NewExitError(fmt.Sprintf("--file must be in name=path format: %s", file), 1)
+			}
+			if _, err := os.Stat(kv[1]); err != nil {
+				return apiRequest, cli.NewExitError(fmt.Sprintf("%s does not exist", kv[1]), 1)
+			}
+			apiRequest.Files[kv[0]] = kv[1]
+		}
+		apiRequest.Form = map[string]string{}
+		for name, value := range fields {
+			apiRequest.Form[name] = fmt.Sprint(value)
+		}
+		return apiRequest, nil
+	}
+	if input != "" {
+		if len(fields) > 0 {
+			return apiRequest, cli.NewExitError("--input and --field cannot be specified at the same time", 1)
+		}
+		var body []byte
+		var err error
+		if input == "-" {
+			body, err = io.ReadAll(os.Stdin)
+		} else {
+			body, err = os.ReadFile(input)
+		}
+		if err != nil {
+			return apiRequest, cli.NewExitError(fmt.Sprintf("failed to read %s: %s", input, err), 1)
+		}
+		apiRequest.Body = body
+		return apiRequest, nil
+	}
+	if len(fields) > 0 {
+		body, err := json.Marshal(fields)
+		if err != nil {
+			return apiRequest, cli.NewExitError(err.Error(), 1)
+		}
+		apiRequest.Body = body
+	}
+	return apiRequest, nil
+}
+
+// typedFieldValue converts the value of --typed_field into a JSON value
+func typedFieldValue(value string) (interface{}, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if strings.HasPrefix(value, "@") {
+		content, err := os.ReadFile(value[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", value[1:], err)
+		}
+		return string(content), nil
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, nil
+	}
+	return value, nil
+}
+
+// jqStep is a step of a --jq path: a key, an index, or all the elements when both are unset
+type jqStep struct {
+	key   string
+	index *int
+	all   bool
+}
+
+func parseJq(expression string) ([]jqStep, error) {
+	if !strings.HasPrefix(expression, ".") {
+		return nil, fmt.Errorf("must start with '.'")
+	}
+	steps := []jqStep{}
+	rest := expression[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed '['")
+			}
+			inside := rest[1:end]
+			if inside == "" {
+				steps = append(steps, jqStep{all: true})
+			} else if n, err := strconv.Atoi(inside); err == nil {
+				steps = append(steps, jqStep{index: &n})
+			} else if unquoted, err := strconv.Unquote(inside); err == nil {
+				steps = append(steps, jqStep{key: unquoted})
+			} else {
+				return nil, fmt.Errorf("unsupported index: %s", inside)
+			}
+			rest = rest[end+1:]
+		case rest[0] == '.':
+			rest = rest[1:]
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			steps = append(steps, jqStep{key: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	return steps, nil
+}
+
+// evalJq returns the values the path points to. Missing keys result in null like jq
+func evalJq(steps []jqStep, value interface{}) []interface{} {
+	values := []interface{}{value}
+	for _, step := range steps {
+		next := []interface{}{}
+		for _, v := range values {
+			switch {
+			case step.all:
+				switch collection := v.(type) {
+				case []interface{}:
+					next = append(next, collection...)
+				case map[string]interface{}:
+					for _, key := range sortedMapKeys(collection) {
+						next = append(next, collection[key])
+					}
+				}
+			case step.index != nil:
+				list, ok := v.([]interface{})
+				i := *step.index
+				if i < 0 {
+					i += len(list)
+				}
+				if ok && i >= 0 && i < len(list) {
+					next = append(next, list[i])
+				} else {
+					next = append(next, nil)
+				}
+			default:
+				object, _ := v.(map[string]interface{})
+				next = append(next, object[step.key])
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJq(t *testing.T) {
+	var document interface{}
+	if err := json.Unmarshal([]byte(`{
+		"batch_runs": [
+			{"batch_run_number": 1, "status": "succeeded", "test_cases": {"total": 3}},
+			{"batch_run_number": 2, "status": "failed", "test_cases": {"total": 4}}
+		],
+		"counts": {"b": 2, "a": 1},
+		"name with space": "x"
+	}`), &document); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expression string
+		want       []interface{}
+	}{
+		{".", []interface{}{document}},
+		{".counts.a", []interface{}{1.0}},
+		{".missing.key", []interface{}{nil}},
+		{`.["name with space"]`, []interface{}{"x"}},
+		{".batch_runs[].status", []interface{}{"succeeded", "failed"}},
+		{".batch_runs[].test_cases.total", []interface{}{3.0, 4.0}},
+		{".batch_runs[0].batch_run_number", []interface{}{1.0}},
+		{".batch_runs[-1].batch_run_number", []interface{}{2.0}},
+		{".batch_runs[5]", []interface{}{nil}},
+		{".counts[]", []interface{}{1.0, 2.0}},
+		{".counts[0]", []interface{}{nil}},
+	}
+	for _, tt := range tests {
+		steps, err := parseJq(tt.expression)
+		if err != nil {
+			t.Errorf("parseJq(%q) error = %v", tt.expression, err)
+			continue
+		}
+		if got := evalJq(steps, document); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.expression, got, tt.want)
+		}
+	}
+}
+
+func TestParseJqInvalid(t *testing.T) {
+	for _, expression := range []string{"", "batch_runs", ".batch_runs[", ".batch_runs[a]", ".batch_runs[1:2]"} {
+		if _, err := parseJq(expression); err == nil {
+			t.Errorf("parseJq(%q) succeeded", expression)
+		}
+	}
+}
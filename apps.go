@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+func pruneAppsFlags() []cli.Flag {
+	return append(commonFlags(), []cli.Flag{
+		cli.IntFlag{
+			Name:  "keep, k",
+			Usage: "The number of the newest app files to keep",
+		},
+		cli.StringFlag{
+			Name:  "older_than",
+			Usage: "Delete only the app files uploaded before this period (e.g. 7d, 12h)",
+		},
+		cli.BoolFlag{
+			Name:  "dry_run",
+			Usage: "Print the app files to be deleted without deleting them",
+		},
+	}...)
+}
+
+func listAppsAction(c *cli.Context) error {
+	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
+	if err != nil {
+		return err
+	}
+	appFiles, exitErr := common.ListApps(urlBase, apiToken, organization, project, httpHeadersMap)
+	if exitErr != nil {
+		return exitErr
+	}
+	b, err := json.Marshal(appFiles)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func pruneAppsAction(c *cli.Context) error {
+	// handle command line arguments
+	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
+	if err != nil {
+		return err
+	}
+	keep := c.Int("keep")
+	if keep < 0 {
+		return cli.NewExitError("--keep option must not be negative", 1)
+	}
+	var olderThan time.Duration
+	if value := c.String("older_than"); value != "" {
+		if olderThan, err = parsePeriod(value); err != nil {
+			return cli.NewExitError(fmt.Sprintf("--older_than must be a period like 7d or 12h: %s", value), 1)
+		}
+	}
+	if !c.IsSet("keep") && olderThan == 0 {
+		// deleting every file by a typo is too dangerous
+		return cli.NewExitError("Either of --keep or --older_than option is required", 1)
+	}
+	dryRun := c.Bool("dry_run")
+
+	appFiles, exitErr := common.ListApps(urlBase, apiToken, organization, project, httpHeadersMap)
+	if exitErr != nil {
+		return exitErr
+	}
+	runningReferences, exitErr := common.RunningAppFileReferences(urlBase, apiToken, organization, project, httpHeadersMap)
+	if exitErr != nil {
+		return exitErr
+	}
+	failed := 0
+	for _, decision := range common.DecideAppsToPrune(appFiles.Files, keep, olderThan, runningReferences, time.Now()) {
+		if !decision.Delete {
+			fmt.Printf("keep %d %s (%s)\n", decision.FileNo, decision.Name, decision.Reason)
+			continue
+		}
+		if dryRun {
+			fmt.Printf("would delete %d %s (%s)\n", decision.FileNo, decision.Name, decision.Reason)
+			continue
+		}
+		if exitErr := common.DeleteApp(urlBase, apiToken, organization, project, httpHeadersMap, decision.FileNo); exitErr != nil {
+			fmt.Fprintf(os.Stderr, "failed to delete %d %s: %s\n", decision.FileNo, decision.Name, exitErr)
+			failed++
+			continue
+		}
+		forgetDeletedApp(organization, project, decision.FileNo)
+		fmt.Printf("deleted %d %s (%s)\n", decision.FileNo, decision.Name, decision.Reason)
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("failed to delete %d app files", failed), 1)
+	}
+	return nil
+}
+
+// parsePeriod accepts days (e.g. 7d) in addition to the units of time.ParseDuration
+func parsePeriod(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid period: %s", value)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// recordAppFileReferences lets prune-apps keep the app files of the started batch run. Only prune-apps depends on it
+func recordAppFileReferences(organization string, project string, batchRun *common.BatchRun, setting string) {
+	if err := common.RecordAppFileReferences(organization, project, batchRun.BatchRunNumber, setting); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to record the app files used by the batch run: %s\n", err)
+	}
+}
+
+// forgetDeletedApp keeps --reuse_if_identical of upload-app from returning the deleted app file
+func forgetDeletedApp(organization string, project string, fileNo int) {
+	if err := common.ForgetUploadedApp(organization, project, fileNo); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to forget the deleted app in the local state: %s\n", err)
+	}
+}
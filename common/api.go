@@ -0,0 +1,108 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// APIRequest stands for a request to an arbitrary endpoint of the Web API
+type APIRequest struct {
+	Method     string
+	Path       string            // path under /api/v1.0, e.g. /{organization}/{project}/batch-runs/
+	PathParams map[string]string // values of the placeholders in Path other than {organization} and {project}
+	Query      url.Values
+	Body       []byte            // sent as JSON if not nil
+	Form       map[string]string // sent as multipart form data with Files
+	Files      map[string]string // form field name to file path
+}
+
+// CallAPI sends the request with the API token and the additional headers, and returns the response body
+func CallAPI(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, apiRequest APIRequest) ([]byte, *cli.ExitError) {
+	body, err := callAPI(urlBase, apiToken, organization, project, httpHeadersMap, apiRequest)
+	return body, toExitError(err)
+}
+
+// callAPI returns *APIError with the response body for an error response.
+// An absolute URL is accepted only on the same host as urlBase, so that the API token is not sent elsewhere
+func callAPI(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, apiRequest APIRequest) ([]byte, error) {
+	path := apiRequest.Path
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		if err := checkSameHost(urlBase, path); err != nil {
+			return nil, err
+		}
+	} else {
+		path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, "/api/v1.0"), "/")
+	}
+	req := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
+		SetPathParams(apiRequest.PathParams).
+		SetMultiValueQueryParams(apiRequest.Query)
+	if len(apiRequest.Files) > 0 {
+		req.SetFiles(apiRequest.Files).SetFormData(apiRequest.Form)
+	} else if len(apiRequest.Form) > 0 {
+		req.SetFormData(apiRequest.Form)
+	} else if apiRequest.Body != nil {
+		req.SetHeader("Content-Type", "application/json").SetBody(apiRequest.Body)
+	}
+	res, err := req.Execute(strings.ToUpper(apiRequest.Method), path)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode() < 200 || res.StatusCode() >= 300 {
+		return res.Body(), newAPIError(res)
+	}
+	return res.Body(), nil
+}
+
+// CallAPIPages sends the request and follows the "next" URL of the paginated responses, calling fn with each page.
+// Only the URLs on the same host as urlBase are followed, so that the API token is not sent elsewhere
+func CallAPIPages(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	apiRequest APIRequest, fn func(page []byte) bool) *cli.ExitError {
+	base, err := url.Parse(urlBase)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for {
+		page, exitErr := CallAPI(urlBase, apiToken, organization, project, httpHeadersMap, apiRequest)
+		if exitErr != nil {
+			return exitErr
+		}
+		if !fn(page) {
+			return nil
+		}
+		var paginated struct {
+			Next *string `json:"next"`
+		}
+		if err := json.Unmarshal(page, &paginated); err != nil || paginated.Next == nil || *paginated.Next == "" {
+			return nil
+		}
+		next, err := url.Parse(*paginated.Next)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("invalid next URL: %s", *paginated.Next), 1)
+		}
+		if err := checkSameHost(urlBase, *paginated.Next); err != nil {
+			return toExitError(err)
+		}
+		// the next URL already has the query and the body is not sent again
+		apiRequest = APIRequest{Method: apiRequest.Method, Path: base.ResolveReference(next).String()}
+	}
+}
+
+// checkSameHost returns an error if rawURL is an absolute URL on another host than urlBase
+func checkSameHost(urlBase string, rawURL string) error {
+	base, err := url.Parse(urlBase)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %s", rawURL)
+	}
+	if target.IsAbs() && target.Host != base.Host {
+		return fmt.Errorf("URL is not on %s: %s", base.Host, rawURL)
+	}
+	return nil
+}
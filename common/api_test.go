@@ -0,0 +1,36 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCallAPISendsTokenOnlyToTheSameHost(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"relative path", "/{organization}/{project}/batch-runs/", false},
+		{"absolute URL on the same host", server.URL + "/api/v1.0/org/project/batch-runs/?page=2", false},
+		{"absolute URL on another host", "https://example.com/api/v1.0/org/project/batch-runs/", true},
+		{"absolute URL on another port", "http://127.0.0.1:1/api/v1.0/org/project/batch-runs/", true},
+	}
+	for _, tt := range tests {
+		authorization = ""
+		_, err := callAPI(server.URL, "token", "org", "project", map[string]string{}, APIRequest{Method: "GET", Path: tt.path})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: callAPI() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if want := "Token token"; !tt.wantErr && authorization != want {
+			t.Errorf("%s: Authorization = %q, want %q", tt.name, authorization, want)
+		}
+	}
+}
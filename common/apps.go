@@ -0,0 +1,284 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// AppFile stands for an app/ipa/apk file uploaded to the project
+type AppFile struct {
+	FileNo     int                    `json:"file_no"`
+	Name       string                 `json:"file_name"`
+	Size       int64                  `json:"file_size"`
+	UploadedAt string                 `json:"uploaded_at"`
+	Metadata   map[string]interface{} `json:"app_metadata,omitempty"` // e.g. bundle id and version
+}
+
+type AppFiles struct {
+	OrganizationName string    `json:"organization_name"`
+	ProjectName      string    `json:"project_name"`
+	Files            []AppFile `json:"files"`
+}
+
+// ListApps retrieves the app files uploaded to the project
+func ListApps(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string) (*AppFiles, *cli.ExitError) {
+	appFiles, err := listApps(urlBase, apiToken, organization, project, httpHeadersMap)
+	return appFiles, toExitError(err)
+}
+
+func listApps(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string) (*AppFiles, error) {
+	res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
+		SetResult(AppFiles{}).
+		Get("/{organization}/{project}/files/")
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(res); err != nil {
+		return nil, err
+	}
+	appFiles := res.Result().(*AppFiles)
+	// an entry decoded without these means the response is not in the expected format, and must not be acted on
+	for _, file := range appFiles.Files {
+		if _, ok := parseServerTime(file.UploadedAt); file.FileNo == 0 || !ok {
+			return nil, fmt.Errorf("unexpected app file entry in the response: %s", res.String())
+		}
+	}
+	return appFiles, nil
+}
+
+// RecordAppFileReferences remembers the app files used by the batch run, so that prune-apps does not delete them while it runs.
+// The command calls it for the batch runs it starts
+func RecordAppFileReferences(organization string, project string, batchRunNumber int, setting string) error {
+	numbers := appFileNumbersInSetting(setting)
+	if len(numbers) == 0 {
+		return nil
+	}
+	return updateLocalState(func(state *localState) {
+		state.AppFileReferences = append(state.AppFileReferences, appFileReference{
+			Organization:   organization,
+			Project:        project,
+			BatchRunNumber: batchRunNumber,
+			AppFileNumbers: numbers,
+			RecordedAt:     time.Now(),
+		})
+	})
+}
+
+// RunningAppFileReferences returns the app files used by the running batch runs recorded by RecordAppFileReferences,
+// as a map from app file number to batch run number.
+// Batch runs started in other ways are not known, so their app files are not protected
+func RunningAppFileReferences(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string) (map[int]int, *cli.ExitError) {
+	references, err := runningAppFileReferences(urlBase, apiToken, organization, project, httpHeadersMap)
+	return references, toExitError(err)
+}
+
+func runningAppFileReferences(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string) (map[int]int, error) {
+	state, err := loadLocalState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the local state: %s", err)
+	}
+	references := map[int]int{}
+	finished := map[int]bool{}
+	for _, reference := range state.AppFileReferences {
+		if reference.Organization != organization || reference.Project != project {
+			continue
+		}
+		isFinished, checked := finished[reference.BatchRunNumber]
+		if !checked {
+			res, err := getBatchRun(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, reference.BatchRunNumber)
+			if err != nil {
+				return nil, err
+			}
+			if err := responseError(res); err != nil {
+				return nil, err
+			}
+			// an unknown status may still be running, so only the terminal ones release the app files
+			isFinished = res.Result().(*BatchRun).Status.IsTerminal()
+			finished[reference.BatchRunNumber] = isFinished
+		}
+		if !isFinished {
+			for _, fileNo := range reference.AppFileNumbers {
+				references[fileNo] = reference.BatchRunNumber
+			}
+		}
+	}
+	return references, nil
+}
+
+// AppPruneDecision tells whether an app file is deleted by prune-apps and why
+type AppPruneDecision struct {
+	AppFile
+	Delete bool   `json:"delete"`
+	Reason string `json:"reason"`
+}
+
+// DecideAppsToPrune keeps the newest keep files, the files uploaded within olderThan (0 means no age condition),
+// and the files used by running batch runs. The others are to be deleted
+func DecideAppsToPrune(files []AppFile, keep int, olderThan time.Duration, runningReferences map[int]int, now time.Time) []AppPruneDecision {
+	sorted := append([]AppFile{}, files...)
+	// newest first. File numbers are assigned in the upload order
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].FileNo > sorted[j].FileNo })
+	decisions := []AppPruneDecision{}
+	for i, file := range sorted {
+		decision := AppPruneDecision{AppFile: file}
+		uploadedAt, hasUploadedAt := parseServerTime(file.UploadedAt)
+		if batchRunNumber, ok := runningReferences[file.FileNo]; ok {
+			decision.Reason = fmt.Sprintf("used by running batch run #%d", batchRunNumber)
+		} else if i < keep {
+			decision.Reason = fmt.Sprintf("one of the newest %d files", keep)
+		} else if olderThan > 0 && !hasUploadedAt {
+			decision.Reason = "upload time is unknown"
+		} else if olderThan > 0 && now.Sub(uploadedAt) < olderThan {
+			decision.Reason = fmt.Sprintf("uploaded within %s", olderThan)
+		} else {
+			decision.Delete = true
+			decision.Reason = "old upload"
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions
+}
+
+// hashApp returns the SHA-256 of the app file, or of the paths, modes and contents of the files in a .app directory in path order,
+// which does not change when the directory is zipped again
+func hashApp(appPath string, isAppDir bool) (string, error) {
+	hash := sha256.New()
+	if !isAppDir {
+		f, err := os.Open(appPath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(hash, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+	// filepath.Walk visits the files in lexical order
+	err := filepath.Walk(appPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(appPath, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%o\x00", filepath.ToSlash(relPath), info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(hash, "%d\x00", info.Size())
+			if _, err := io.Copy(hash, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// UploadAppIfChanged returns the file number of the identical app uploaded before from this machine if the server still has it,
+// and uploads the app otherwise. The second return value is true if the app is reused.
+// If the app files cannot be listed, the app is uploaded again rather than risking a batch run with a missing app
+func UploadAppIfChanged(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, appPath string) (int, bool, *cli.ExitError) {
+	isAppDir, exitErr := validateAppPath(appPath)
+	if exitErr != nil {
+		return 0, false, exitErr
+	}
+	digest, err := hashApp(appPath, isAppDir)
+	if err != nil {
+		return 0, false, cli.NewExitError(fmt.Sprintf("failed to hash %s: %s", appPath, err), 1)
+	}
+	state, err := loadLocalState()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load the local state, so the app is uploaded: %s\n", err)
+		state = &localState{}
+	}
+	for i := len(state.UploadedApps) - 1; i >= 0; i-- {
+		uploaded := state.UploadedApps[i]
+		if uploaded.Organization != organization || uploaded.Project != project || uploaded.SHA256 != digest {
+			continue
+		}
+		exists, err := appFileExists(urlBase, apiToken, organization, project, httpHeadersMap, uploaded.FileNo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to check app file %d on the server, so the app is uploaded: %s\n", uploaded.FileNo, err)
+		} else if exists {
+			return uploaded.FileNo, true, nil
+		}
+		break
+	}
+
+	fileNo, exitErr := UploadApp(urlBase, apiToken, organization, project, httpHeadersMap, appPath)
+	if exitErr != nil {
+		return 0, false, exitErr
+	}
+	err = updateLocalState(func(state *localState) {
+		uploadedApps := []uploadedApp{}
+		for _, uploaded := range state.UploadedApps {
+			if uploaded.Organization != organization || uploaded.Project != project || uploaded.SHA256 != digest {
+				uploadedApps = append(uploadedApps, uploaded)
+			}
+		}
+		state.UploadedApps = append(uploadedApps, uploadedApp{
+			Organization: organization,
+			Project:      project,
+			SHA256:       digest,
+			FileNo:       fileNo,
+			UploadedAt:   time.Now(),
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to record the uploaded app: %s\n", err)
+	}
+	return fileNo, false, nil
+}
+
+// appFileExists tells whether the app file is still on the server, e.g. it has not been deleted on the web page
+func appFileExists(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, fileNo int) (bool, error) {
+	appFiles, err := listApps(urlBase, apiToken, organization, project, httpHeadersMap)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range appFiles.Files {
+		if file.FileNo == fileNo {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ForgetUploadedApp drops the records of the deleted app file so that UploadAppIfChanged does not return it.
+// The command calls it after deleting an app file
+func ForgetUploadedApp(organization string, project string, fileNo int) error {
+	return updateLocalState(func(state *localState) {
+		uploadedApps := []uploadedApp{}
+		for _, uploaded := range state.UploadedApps {
+			if uploaded.Organization != organization || uploaded.Project != project || uploaded.FileNo != fileNo {
+				uploadedApps = append(uploadedApps, uploaded)
+			}
+		}
+		state.UploadedApps = uploadedApps
+	})
+}
@@ -0,0 +1,252 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecideAppsToPrune(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) string { return now.AddDate(0, 0, -days).Format(time.RFC3339) }
+	files := []AppFile{
+		{FileNo: 1, UploadedAt: daysAgo(30)},
+		{FileNo: 4, UploadedAt: daysAgo(1)},
+		{FileNo: 2, UploadedAt: daysAgo(20)},
+		{FileNo: 3, UploadedAt: daysAgo(10)},
+	}
+	tests := []struct {
+		name       string
+		keep       int
+		olderThan  time.Duration
+		running    map[int]int
+		wantDelete []int
+	}{
+		{"keep newest", 2, 0, nil, []int{2, 1}},
+		{"keep none", 0, 0, nil, []int{4, 3, 2, 1}},
+		{"older than", 0, 7 * 24 * time.Hour, nil, []int{3, 2, 1}},
+		{"keep and older than", 2, 15 * 24 * time.Hour, nil, []int{2, 1}},
+		{"used by running batch run", 1, 0, map[int]int{2: 9}, []int{3, 1}},
+	}
+	for _, tt := range tests {
+		decisions := DecideAppsToPrune(files, tt.keep, tt.olderThan, tt.running, now)
+		gotDelete := []int{}
+		for _, decision := range decisions {
+			if decision.Delete {
+				gotDelete = append(gotDelete, decision.FileNo)
+			}
+		}
+		if !reflect.DeepEqual(gotDelete, tt.wantDelete) {
+			t.Errorf("%s: deleted %v, want %v", tt.name, gotDelete, tt.wantDelete)
+		}
+	}
+
+	decisions := DecideAppsToPrune([]AppFile{{FileNo: 1}}, 0, time.Hour, nil, now)
+	if decisions[0].Delete {
+		t.Errorf("a file of unknown upload time is deleted by the age condition")
+	}
+}
+
+func TestAppFileNumbersInSetting(t *testing.T) {
+	tests := []struct {
+		setting string
+		want    []int
+	}{
+		{`{"app_file_number": 3}`, []int{3}},
+		{`{"app_file_number": "3"}`, []int{3}},
+		{`{"test_settings": [{"app_file_number": 4}, {"app_url": "https://example.com/app.zip"}, {"app_file_number": 5}]}`, []int{4, 5}},
+		{`{"app_type": "app_url"}`, []int{}},
+		{`not json`, nil},
+	}
+	for _, tt := range tests {
+		if got := appFileNumbersInSetting(tt.setting); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("appFileNumbersInSetting(%s) = %v, want %v", tt.setting, got, tt.want)
+		}
+	}
+}
+
+func TestListAppsRejectsUnexpectedEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"valid", `{"files": [{"file_no": 1, "file_name": "app.ipa", "uploaded_at": "2026-10-19T12:00:00Z"}]}`, false},
+		{"no file number", `{"files": [{"id": 1, "file_name": "app.ipa", "uploaded_at": "2026-10-19T12:00:00Z"}]}`, true},
+		{"no upload time", `{"files": [{"file_no": 1, "file_name": "app.ipa"}]}`, true},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/org/project/files/") {
+				t.Errorf("%s: unexpected path %s", tt.name, r.URL.Path)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(tt.body))
+		}))
+		_, err := listApps(server.URL, "token", "org", "project", map[string]string{})
+		server.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: listApps() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRunningAppFileReferences(t *testing.T) {
+	t.Setenv("MAGICPOD_STATE_DIR", t.TempDir())
+	statuses := map[string]string{"/org/project/batch-run/1/": "running", "/org/project/batch-run/2/": "succeeded", "/org/project/batch-run/3/": "queued"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for suffix, status := range statuses {
+			if strings.HasSuffix(r.URL.Path, suffix) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"status": "%s"}`, status)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	for batchRunNumber, setting := range map[int]string{1: `{"app_file_number": 11}`, 2: `{"app_file_number": 12}`, 3: `{"test_settings": [{"app_file_number": 13}]}`} {
+		if err := RecordAppFileReferences("org", "project", batchRunNumber, setting); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RecordAppFileReferences("other", "project", 2, `{"app_file_number": 14}`); err != nil {
+		t.Fatal(err)
+	}
+
+	references, err := runningAppFileReferences(server.URL, "token", "org", "project", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]int{11: 1, 13: 3}; !reflect.DeepEqual(references, want) {
+		t.Errorf("references = %v, want %v", references, want)
+	}
+}
+
+func TestHashApp(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(path string, content string, mode os.FileMode) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(path string, isAppDir bool) string {
+		t.Helper()
+		digest, err := hashApp(path, isAppDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+
+	writeFile(filepath.Join(dir, "app.apk"), "apk", 0644)
+	sum := sha256.Sum256([]byte("apk"))
+	if got, want := hash(filepath.Join(dir, "app.apk"), false), hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("hashApp() of a file = %s, want %s", got, want)
+	}
+
+	app := func(name string, binaryMode os.FileMode, plist string) string {
+		path := filepath.Join(dir, name, "My.app")
+		writeFile(filepath.Join(path, "Info.plist"), plist, 0644)
+		writeFile(filepath.Join(path, "My"), "binary", binaryMode)
+		return path
+	}
+	original := hash(app("original", 0755, "plist"), true)
+	if got := hash(app("copy", 0755, "plist"), true); got != original {
+		t.Errorf("the same .app in another place has a different hash")
+	}
+	if got := hash(app("content", 0755, "changed"), true); got == original {
+		t.Errorf("a changed file does not change the hash")
+	}
+	if got := hash(app("mode", 0644, "plist"), true); got == original {
+		t.Errorf("a changed mode does not change the hash")
+	}
+	moved := app("moved", 0755, "plist")
+	if err := os.Rename(filepath.Join(moved, "My"), filepath.Join(moved, "Other")); err != nil {
+		t.Fatal(err)
+	}
+	if got := hash(moved, true); got == original {
+		t.Errorf("a renamed file does not change the hash")
+	}
+}
+
+func TestUploadAppIfChanged(t *testing.T) {
+	tests := []struct {
+		name       string
+		listStatus int
+		listed     bool
+		wantReused bool
+	}{
+		{"still on the server", http.StatusOK, true, true},
+		{"deleted on the server", http.StatusOK, false, false},
+		{"cannot be listed", http.StatusInternalServerError, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAGICPOD_STATE_DIR", t.TempDir())
+			uploads := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/org/project/upload-file/"):
+					uploads++
+					fmt.Fprintf(w, `{"file_no": %d}`, 10+uploads)
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/org/project/files/"):
+					w.WriteHeader(tt.listStatus)
+					if tt.listed {
+						w.Write([]byte(`{"files": [{"file_no": 11, "file_name": "app.apk", "uploaded_at": "2026-10-19T12:00:00Z"}]}`))
+					} else {
+						w.Write([]byte(`{"files": []}`))
+					}
+				default:
+					t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+			appPath := filepath.Join(t.TempDir(), "app.apk")
+			if err := os.WriteFile(appPath, []byte("apk"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fileNo, reused, exitErr := UploadAppIfChanged(server.URL, "token", "org", "project", map[string]string{}, appPath)
+			if exitErr != nil || reused || fileNo != 11 {
+				t.Fatalf("first upload = %d, %v, %v, want 11, false, nil", fileNo, reused, exitErr)
+			}
+			fileNo, reused, exitErr = UploadAppIfChanged(server.URL, "token", "org", "project", map[string]string{}, appPath)
+			if exitErr != nil {
+				t.Fatal(exitErr)
+			}
+			if reused != tt.wantReused {
+				t.Errorf("reused = %v, want %v", reused, tt.wantReused)
+			}
+			if wantFileNo := map[bool]int{true: 11, false: 12}[tt.wantReused]; fileNo != wantFileNo {
+				t.Errorf("file number = %d, want %d", fileNo, wantFileNo)
+			}
+
+			// the app deleted by the command is uploaded again without asking the server
+			if err := ForgetUploadedApp("org", "project", fileNo); err != nil {
+				t.Fatal(err)
+			}
+			uploadsBefore := uploads
+			if _, reused, _ := UploadAppIfChanged(server.URL, "token", "org", "project", map[string]string{}, appPath); reused || uploads != uploadsBefore+1 {
+				t.Errorf("the forgotten app is reused")
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// BatchRunFilter narrows down batch runs on the client side. Zero values match everything
+type BatchRunFilter struct {
+	Statuses        []string
+	TestSettingName string
+	BranchName      string
+	Since           time.Time // started at or after
+	Until           time.Time // started before
+}
+
+// IsEmpty returns true if the filter matches every batch run
+func (f *BatchRunFilter) IsEmpty() bool {
+	return len(f.Statuses) == 0 && f.TestSettingName == "" && f.BranchName == "" && f.Since.IsZero() && f.Until.IsZero()
+}
+
+// Match returns true if the batch run satisfies all the conditions of the filter
+func (f *BatchRunFilter) Match(batchRun *BatchRunSummary) bool {
+	if len(f.Statuses) > 0 {
+		matched := false
+		for _, status := range f.Statuses {
+			matched = matched || string(batchRun.Status) == status
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.TestSettingName != "" && batchRun.TestSettingName != f.TestSettingName {
+		return false
+	}
+	if f.BranchName != "" && batchRun.BranchName != f.BranchName {
+		return false
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		startedAt := batchRun.StartedAt.Time
+		if startedAt.IsZero() {
+			return false
+		}
+		if !f.Since.IsZero() && startedAt.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && !startedAt.Before(f.Until) {
+			return false
+		}
+	}
+	return true
+}
+
+// BatchRunsPageSize is the count of each request to page through the batch runs when no other size is given
+const BatchRunsPageSize = 100
+
+// BatchRunsOptions narrows down the batch runs iterated by BatchRunsSeq and BatchRunDetailsSeq
+type BatchRunsOptions struct {
+	Filter            BatchRunFilter
+	PageSize          int // BatchRunsPageSize if 0
+	MaxBatchRunNumber int // the latest batch run if 0
+	MinBatchRunNumber int // the first batch run if 0
+}
+
+// BatchRunsSeq iterates over the batch runs matching the options in the most recent first order.
+// The pages are requested lazily as the iteration goes on. An error, including the cancellation of ctx, is yielded at most once and ends the iteration
+func BatchRunsSeq(ctx context.Context, urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, options BatchRunsOptions) iter.Seq2[BatchRunSummary, error] {
+	return func(yield func(BatchRunSummary, error) bool) {
+		pageSize := options.PageSize
+		if pageSize <= 0 {
+			pageSize = BatchRunsPageSize
+		}
+		maxBatchRunNumber := options.MaxBatchRunNumber
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(BatchRunSummary{}, err)
+				return
+			}
+			res, err := getBatchRuns(ctx, urlBase, apiToken, organization, project, httpHeadersMap, pageSize, maxBatchRunNumber, options.MinBatchRunNumber)
+			if err != nil {
+				yield(BatchRunSummary{}, err)
+				return
+			}
+			if err := responseError(res); err != nil {
+				yield(BatchRunSummary{}, err)
+				return
+			}
+			batchRuns := res.Result().(*BatchRuns).BatchRuns
+			// the server may return less than pageSize, so only an empty page means the end
+			if len(batchRuns) == 0 {
+				return
+			}
+			for _, batchRun := range batchRuns {
+				if !options.Filter.Since.IsZero() {
+					if startedAt := batchRun.StartedAt; !startedAt.IsZero() && startedAt.Before(options.Filter.Since) {
+						return // batch runs are numbered in the order they start, so the older ones do not match either
+					}
+				}
+				if options.Filter.Match(&batchRun) && !yield(batchRun, nil) {
+					return
+				}
+			}
+			last := batchRuns[len(batchRuns)-1].BatchRunNumber
+			if last <= 1 || last <= options.MinBatchRunNumber {
+				return
+			}
+			maxBatchRunNumber = last - 1
+		}
+	}
+}
+
+// BatchRunDetailsSeq iterates over the details of the batch runs matching the options in the most recent first order,
+// retrieving up to workers batch runs concurrently
+func BatchRunDetailsSeq(ctx context.Context, urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, options BatchRunsOptions, workers int) iter.Seq2[*BatchRun, error] {
+	return func(yield func(*BatchRun, error) bool) {
+		if workers <= 0 {
+			workers = 1
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel() // stops the producer when the iteration ends early
+		type result struct {
+			batchRun *BatchRun
+			err      error
+		}
+		// the results are queued in the order of the batch runs, and the workers fill them in any order
+		queue := make(chan chan result, workers)
+		semaphore := make(chan struct{}, workers)
+		go func() {
+			defer close(queue)
+			for summary, err := range BatchRunsSeq(ctx, urlBase, apiToken, organization, project, httpHeadersMap, options) {
+				ch := make(chan result, 1)
+				if err != nil {
+					ch <- result{nil, err}
+				} else {
+					select {
+					case semaphore <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+					go func(batchRunNumber int) {
+						defer func() { <-semaphore }()
+						res, err := getBatchRun(ctx, urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
+						if err != nil {
+							ch <- result{nil, err}
+						} else if err := responseError(res); err != nil {
+							ch <- result{nil, err}
+						} else {
+							ch <- result{res.Result().(*BatchRun), nil}
+						}
+					}(summary.BatchRunNumber)
+				}
+				select {
+				case queue <- ch:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		for ch := range queue {
+			r := <-ch
+			if !yield(r.batchRun, r.err) || r.err != nil {
+				return
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			yield(nil, err) // cancelled by the caller while waiting for the producer
+		}
+	}
+}
+
+// WalkBatchRuns calls fn for each batch run matching the filter in the most recent first order, requesting pageSize batch runs at a time.
+// It goes back from maxBatchRunNumber to minBatchRunNumber (0 means no limit) until fn returns false
+func WalkBatchRuns(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	filter BatchRunFilter, pageSize int, maxBatchRunNumber int, minBatchRunNumber int, fn func(BatchRunSummary) bool) *cli.ExitError {
+	options := BatchRunsOptions{Filter: filter, PageSize: pageSize, MaxBatchRunNumber: maxBatchRunNumber, MinBatchRunNumber: minBatchRunNumber}
+	for batchRun, err := range BatchRunsSeq(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, options) {
+		if exitErr, ok := err.(*cli.ExitError); ok {
+			return exitErr
+		} else if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if !fn(batchRun) {
+			break
+		}
+	}
+	return nil
+}
+
+// batchRunSortKeys are the keys SortBatchRuns accepts. The second return value is false if the batch run has no value for the key,
+// e.g. finished_at of a running batch run
+var batchRunSortKeys = map[string]func(*BatchRunSummary) (float64, bool){
+	"number": func(b *BatchRunSummary) (float64, bool) { return float64(b.BatchRunNumber), true },
+	"started_at": func(b *BatchRunSummary) (float64, bool) {
+		return float64(b.StartedAt.UnixNano()), !b.StartedAt.IsZero()
+	},
+	"finished_at": func(b *BatchRunSummary) (float64, bool) {
+		return float64(b.FinishedAt.UnixNano()), !b.FinishedAt.IsZero()
+	},
+	"duration": func(b *BatchRunSummary) (float64, bool) {
+		if b.DurationSeconds == nil {
+			return 0, false
+		}
+		return *b.DurationSeconds, true
+	},
+}
+
+// ValidateBatchRunSortKey returns an error unless SortBatchRuns accepts the key, so that it can be checked before retrieving the batch runs
+func ValidateBatchRunSortKey(key string) error {
+	if _, ok := batchRunSortKeys[key]; !ok {
+		return fmt.Errorf("unknown sort key: %s", key)
+	}
+	return nil
+}
+
+// SortBatchRuns sorts the batch runs by number, started_at, finished_at or duration.
+// The batch runs without the value, e.g. the unfinished ones for finished_at, come last in either order. Ties keep the original order
+func SortBatchRuns(batchRuns []BatchRunSummary, key string, descending bool) error {
+	if err := ValidateBatchRunSortKey(key); err != nil {
+		return err
+	}
+	value := batchRunSortKeys[key]
+	sort.SliceStable(batchRuns, func(i, j int) bool {
+		vi, hasI := value(&batchRuns[i])
+		vj, hasJ := value(&batchRuns[j])
+		if !hasI || !hasJ {
+			return hasI && !hasJ
+		}
+		if descending {
+			return vi > vj
+		}
+		return vi < vj
+	})
+	return nil
+}
@@ -0,0 +1,307 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeBatchRunCount = 25
+
+var fakeBatchRunsStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeBatchRunsServer serves batch runs #1 to #25 started an hour apart, in which every third one failed.
+// The details of the older batch runs take longer, so that the concurrent requests finish out of order
+type fakeBatchRunsServer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	pages       int
+	inFlight    int
+	maxInFlight int
+	failing     int // batch run whose details return an error
+}
+
+func newFakeBatchRunsServer(t *testing.T) *fakeBatchRunsServer {
+	s := &fakeBatchRunsServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/v1.0/org/project/batch-runs/" {
+			s.servePage(w, r)
+			return
+		}
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1.0/org/project/batch-run/"), "/"))
+		if err != nil {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		s.serveDetail(w, number)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func fakeBatchRunSummary(number int) BatchRunSummary {
+	status := BatchRunStatusSucceeded
+	if number%3 == 0 {
+		status = BatchRunStatusFailed
+	}
+	startedAt := fakeBatchRunsStart.Add(time.Duration(number) * time.Hour)
+	return BatchRunSummary{BatchRunNumber: number, TestSettingName: "setting", Status: status,
+		TaskInterval: TaskInterval{StartedAt: ServerTime{Time: startedAt}}}
+}
+
+func (s *fakeBatchRunsServer) servePage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.pages++
+	s.mu.Unlock()
+	count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+	max, _ := strconv.Atoi(r.URL.Query().Get("max_batch_run_number"))
+	min, _ := strconv.Atoi(r.URL.Query().Get("min_batch_run_number"))
+	if max == 0 {
+		max = fakeBatchRunCount
+	}
+	page := []map[string]interface{}{}
+	for number := max; number >= 1 && number >= min && len(page) < count; number-- {
+		summary := fakeBatchRunSummary(number)
+		page = append(page, map[string]interface{}{
+			"batch_run_number":  number,
+			"test_setting_name": summary.TestSettingName,
+			"status":            summary.Status,
+			"started_at":        summary.StartedAt.Format(time.RFC3339),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"batch_runs": page})
+}
+
+func (s *fakeBatchRunsServer) serveDetail(w http.ResponseWriter, number int) {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	time.Sleep(time.Duration(fakeBatchRunCount-number) * time.Millisecond)
+	if number == s.failing {
+		http.Error(w, `{"detail": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, `{"batch_run_number": %d, "status": "%s"}`, number, fakeBatchRunSummary(number).Status)
+}
+
+func TestBatchRunsSeq(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   BatchRunsOptions
+		want      []int
+		wantPages int
+	}{
+		{"all in one page", BatchRunsOptions{}, descending(25, 1), 1},
+		{"small pages", BatchRunsOptions{PageSize: 10}, descending(25, 1), 3},
+		{"max and min", BatchRunsOptions{PageSize: 4, MaxBatchRunNumber: 20, MinBatchRunNumber: 13}, descending(20, 13), 2},
+		{"status filter", BatchRunsOptions{PageSize: 10, MaxBatchRunNumber: 12, Filter: BatchRunFilter{Statuses: []string{"failed"}}}, []int{12, 9, 6, 3}, 2},
+		{"since stops paging", BatchRunsOptions{PageSize: 5, Filter: BatchRunFilter{Since: fakeBatchRunsStart.Add(18 * time.Hour)}}, descending(25, 18), 2},
+		{"until", BatchRunsOptions{PageSize: 10, MaxBatchRunNumber: 10, Filter: BatchRunFilter{Until: fakeBatchRunsStart.Add(4 * time.Hour)}}, descending(3, 1), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeBatchRunsServer(t)
+			got := []int{}
+			for summary, err := range BatchRunsSeq(context.Background(), server.URL, "token", "org", "project", map[string]string{}, tt.options) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, summary.BatchRunNumber)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BatchRunsSeq() = %v, want %v", got, tt.want)
+			}
+			if server.pages != tt.wantPages {
+				t.Errorf("requested %d pages, want %d", server.pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestBatchRunDetailsSeq(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		stopAt  int // batch run after which the iteration is stopped, 0 for none
+		failing int
+		want    []int
+		wantErr bool
+	}{
+		{"one worker", 1, 0, 0, descending(25, 1), false},
+		{"workers keep the order", 4, 0, 0, descending(25, 1), false},
+		{"no worker means one", 0, 0, 0, descending(25, 1), false},
+		{"stopped early", 4, 20, 0, descending(25, 20), false},
+		{"error ends the iteration", 4, 0, 18, descending(25, 19), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeBatchRunsServer(t)
+			server.failing = tt.failing
+			got := []int{}
+			var gotErr error
+			options := BatchRunsOptions{PageSize: 10}
+			for batchRun, err := range BatchRunDetailsSeq(context.Background(), server.URL, "token", "org", "project", map[string]string{}, options, tt.workers) {
+				if err != nil {
+					gotErr = err
+					continue // must not be called again
+				}
+				got = append(got, batchRun.BatchRunNumber)
+				if batchRun.BatchRunNumber == tt.stopAt {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BatchRunDetailsSeq() = %v, want %v", got, tt.want)
+			}
+			if (gotErr != nil) != tt.wantErr {
+				t.Errorf("BatchRunDetailsSeq() error = %v, wantErr %v", gotErr, tt.wantErr)
+			}
+			workers := tt.workers
+			if workers <= 0 {
+				workers = 1
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if server.maxInFlight > workers {
+				t.Errorf("%d requests ran concurrently with %d workers", server.maxInFlight, workers)
+			}
+		})
+	}
+}
+
+func TestBatchRunDetailsSeqCancelled(t *testing.T) {
+	server := newFakeBatchRunsServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	count := 0
+	var gotErr error
+	for batchRun, err := range BatchRunDetailsSeq(ctx, server.URL, "token", "org", "project", map[string]string{}, BatchRunsOptions{}, 4) {
+		if err != nil {
+			gotErr = err
+			continue
+		}
+		count++
+		if batchRun.BatchRunNumber == 23 {
+			cancel()
+		}
+	}
+	if gotErr == nil {
+		t.Error("no error after the cancellation")
+	}
+	if count >= fakeBatchRunCount {
+		t.Errorf("all %d batch runs were iterated after the cancellation", count)
+	}
+}
+
+func descending(from int, to int) []int {
+	numbers := []int{}
+	for n := from; n >= to; n-- {
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+func TestValidateBatchRunSortKey(t *testing.T) {
+	for _, key := range []string{"number", "started_at", "finished_at", "duration"} {
+		if err := ValidateBatchRunSortKey(key); err != nil {
+			t.Errorf("ValidateBatchRunSortKey(%q) = %v", key, err)
+		}
+	}
+	for _, key := range []string{"", "status", "Number"} {
+		if err := ValidateBatchRunSortKey(key); err == nil {
+			t.Errorf("ValidateBatchRunSortKey(%q) must fail", key)
+		}
+	}
+}
+
+func TestBatchRunFilterMatch(t *testing.T) {
+	at := func(hour int) ServerTime { return ServerTime{Time: time.Date(2026, 10, 1, hour, 0, 0, 0, time.UTC)} }
+	batchRun := BatchRunSummary{BatchRunNumber: 1, TestSettingName: "smoke", BranchName: "main", Status: BatchRunStatusFailed,
+		TaskInterval: TaskInterval{StartedAt: at(10)}}
+	notStarted := BatchRunSummary{BatchRunNumber: 2, TestSettingName: "smoke", Status: BatchRunStatusRunning}
+	tests := []struct {
+		name     string
+		filter   BatchRunFilter
+		batchRun BatchRunSummary
+		want     bool
+	}{
+		{"empty", BatchRunFilter{}, batchRun, true},
+		{"one of the statuses", BatchRunFilter{Statuses: []string{"succeeded", "failed"}}, batchRun, true},
+		{"other status", BatchRunFilter{Statuses: []string{"succeeded"}}, batchRun, false},
+		{"test setting", BatchRunFilter{TestSettingName: "smoke"}, batchRun, true},
+		{"other test setting", BatchRunFilter{TestSettingName: "nightly"}, batchRun, false},
+		{"branch", BatchRunFilter{BranchName: "main"}, batchRun, true},
+		{"other branch", BatchRunFilter{BranchName: "feature"}, batchRun, false},
+		{"since the start", BatchRunFilter{Since: at(10).Time}, batchRun, true},
+		{"since after the start", BatchRunFilter{Since: at(11).Time}, batchRun, false},
+		{"until after the start", BatchRunFilter{Until: at(11).Time}, batchRun, true},
+		{"until the start", BatchRunFilter{Until: at(10).Time}, batchRun, false},
+		{"all conditions", BatchRunFilter{Statuses: []string{"failed"}, TestSettingName: "smoke", BranchName: "main", Since: at(9).Time, Until: at(11).Time}, batchRun, true},
+		{"not started with a period", BatchRunFilter{Since: at(9).Time}, notStarted, false},
+		{"not started without a period", BatchRunFilter{Statuses: []string{"running"}}, notStarted, true},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(&tt.batchRun); got != tt.want {
+			t.Errorf("%s: Match() = %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.filter.IsEmpty() != (tt.name == "empty") {
+			t.Errorf("%s: IsEmpty() = %v", tt.name, tt.filter.IsEmpty())
+		}
+	}
+}
+
+func TestSortBatchRuns(t *testing.T) {
+	at := func(hour int) ServerTime { return ServerTime{Time: time.Date(2026, 10, 1, hour, 0, 0, 0, time.UTC)} }
+	duration := func(seconds float64) *float64 { return &seconds }
+	batchRuns := []BatchRunSummary{
+		{BatchRunNumber: 1, TaskInterval: TaskInterval{StartedAt: at(1), FinishedAt: at(5), DurationSeconds: duration(4 * 3600)}},
+		{BatchRunNumber: 2, TaskInterval: TaskInterval{StartedAt: at(2)}}, // running
+		{BatchRunNumber: 3, TaskInterval: TaskInterval{StartedAt: at(3), FinishedAt: at(4), DurationSeconds: duration(3600)}},
+		{BatchRunNumber: 4}, // not started
+	}
+	tests := []struct {
+		key        string
+		descending bool
+		want       []int
+	}{
+		{"number", false, []int{1, 2, 3, 4}},
+		{"number", true, []int{4, 3, 2, 1}},
+		{"started_at", false, []int{1, 2, 3, 4}},
+		{"started_at", true, []int{3, 2, 1, 4}},
+		{"finished_at", false, []int{3, 1, 2, 4}},
+		{"finished_at", true, []int{1, 3, 2, 4}},
+		{"duration", false, []int{3, 1, 2, 4}},
+		{"duration", true, []int{1, 3, 2, 4}},
+	}
+	for _, tt := range tests {
+		sorted := append([]BatchRunSummary{}, batchRuns...)
+		if err := SortBatchRuns(sorted, tt.key, tt.descending); err != nil {
+			t.Fatal(err)
+		}
+		got := []int{}
+		for _, batchRun := range sorted {
+			got = append(got, batchRun.BatchRunNumber)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SortBatchRuns(%s, descending %v) = %v, want %v", tt.key, tt.descending, got, tt.want)
+		}
+	}
+}
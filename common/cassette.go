@@ -0,0 +1,188 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A cassette is a directory of the HTTP interactions of a CLI session, one JSON file per request,
+// named in the order of the requests (0001.json, 0002.json, ...)
+
+type cassetteInteraction struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body,omitempty"`
+}
+
+type cassetteResponse struct {
+	StatusCode   int                 `json:"status_code"`
+	Status       string              `json:"status"`
+	Headers      map[string][]string `json:"headers"`
+	Body         string              `json:"body"`
+	BodyEncoding string              `json:"body_encoding,omitempty"` // "base64" for binary bodies
+}
+
+// sleep is replaced on replay so that the waits for batch runs finish immediately
+var sleep = time.Sleep
+
+// SetupRecording records every following HTTP interaction into dir. The API token and sensitive headers are redacted
+func SetupRecording(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if existing, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(existing) > 0 {
+		return fmt.Errorf("%s already contains a recorded session", dir)
+	}
+	baseTransport = &recordingTransport{next: baseTransport, dir: dir}
+	return nil
+}
+
+// SetupReplay serves every following HTTP request from the interactions recorded in dir without any network access
+func SetupReplay(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no recorded session in %s", dir)
+	}
+	sort.Strings(paths)
+	transport := &replayTransport{}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var interaction cassetteInteraction
+		if err := json.Unmarshal(content, &interaction); err != nil {
+			return fmt.Errorf("%s is not a recorded interaction: %s", path, err)
+		}
+		transport.interactions = append(transport.interactions, interaction)
+	}
+	transport.used = make([]bool, len(transport.interactions))
+	baseTransport = transport
+	sleep = func(time.Duration) {}
+	return nil
+}
+
+func redactedHeaders(header http.Header) map[string][]string {
+	redacted := map[string][]string{}
+	for name, values := range header {
+		redacted[name] = values
+		if isSensitiveHeader(name) {
+			redacted[name] = []string{redactedValue}
+		}
+	}
+	return redacted
+}
+
+type recordingTransport struct {
+	next  http.RoundTripper
+	dir   string
+	mu    sync.Mutex
+	count int
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	interaction := cassetteInteraction{
+		Request: cassetteRequest{
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Path:    req.URL.Path,
+			Query:   req.URL.RawQuery,
+			Headers: redactedHeaders(req.Header),
+			Body:    loggableRequestBody(req), // file uploads are not recorded
+		},
+	}
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	content, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	interaction.Response = cassetteResponse{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Headers:    redactedHeaders(res.Header), // e.g. Set-Cookie
+	}
+	if isTextContent(res.Header.Get("Content-Type")) {
+		interaction.Response.Body = string(content)
+	} else {
+		interaction.Response.Body = base64.StdEncoding.EncodeToString(content)
+		interaction.Response.BodyEncoding = "base64"
+	}
+	encoded, err := json.MarshalIndent(interaction, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count++
+	if err := os.WriteFile(filepath.Join(t.dir, fmt.Sprintf("%04d.json", t.count)), encoded, 0644); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+type replayTransport struct {
+	mu           sync.Mutex
+	interactions []cassetteInteraction
+	used         []bool
+}
+
+// RoundTrip returns the first unused interaction with the same method, path and query,
+// so repeated polls of the same endpoint get the responses in the recorded order
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, interaction := range t.interactions {
+		if t.used[i] || interaction.Request.Method != req.Method ||
+			interaction.Request.Path != req.URL.Path || interaction.Request.Query != req.URL.RawQuery {
+			continue
+		}
+		t.used[i] = true
+		body := []byte(interaction.Response.Body)
+		if interaction.Response.BodyEncoding == "base64" {
+			var err error
+			if body, err = base64.StdEncoding.DecodeString(interaction.Response.Body); err != nil {
+				return nil, err
+			}
+		}
+		return &http.Response{
+			Status:        interaction.Response.Status,
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header(interaction.Response.Headers),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded response left for %s %s", req.Method, req.URL.RequestURI())
+}
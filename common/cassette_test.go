@@ -0,0 +1,85 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCassette restores the transport and sleep replaced by SetupRecording and SetupReplay after the test
+func withCassette(t *testing.T) {
+	originalTransport, originalSleep := baseTransport, sleep
+	t.Cleanup(func() {
+		baseTransport, sleep = originalTransport, originalSleep
+	})
+	sleep = func(time.Duration) {}
+}
+
+func fakeBatchRunServer(t *testing.T) *httptest.Server {
+	polls := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		http.SetCookie(w, &http.Cookie{Name: "sessionid", Value: "secret-session"})
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1.0/org/project/cross-batch-run/":
+			w.Write([]byte(`{"batch_run_number": 7, "status": "running", "url": "https://example.com/7", "test_cases": {"total": 2, "running": 2}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1.0/org/project/batch-run/7/":
+			polls++
+			if polls == 1 {
+				w.Write([]byte(`{"batch_run_number": 7, "status": "running", "test_cases": {"total": 2, "running": 1, "succeeded": 1}}`))
+			} else {
+				w.Write([]byte(`{"batch_run_number": 7, "status": "failed", "test_cases": {"total": 2, "succeeded": 1, "failed": 1}}`))
+			}
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestRecordAndReplayBatchRun(t *testing.T) {
+	withCassette(t)
+	dir := t.TempDir()
+	server := fakeBatchRunServer(t)
+	if err := SetupRecording(dir); err != nil {
+		t.Fatal(err)
+	}
+	recorded, exitErr := RunBatchRun(server.URL, "secret-token", "org", "project", map[string]string{}, 1, "", "", true, WaitLimit{}, false)
+	server.Close()
+	if exitErr != nil {
+		t.Fatal(exitErr)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(paths) != 3 {
+		t.Fatalf("recorded %d interactions, want 3", len(paths))
+	}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{"secret-token", "secret-session"} {
+			if strings.Contains(string(content), secret) {
+				t.Errorf("%s contains %s", path, secret)
+			}
+		}
+	}
+
+	// the server is closed, so the responses must come from the cassette
+	if err := SetupReplay(dir); err != nil {
+		t.Fatal(err)
+	}
+	replayed, exitErr := RunBatchRun(server.URL, "another-token", "org", "project", map[string]string{}, 1, "", "", true, WaitLimit{}, false)
+	if exitErr != nil {
+		t.Fatal(exitErr)
+	}
+	if replayed.BatchRun.Status != recorded.BatchRun.Status || replayed.HasFailures != recorded.HasFailures ||
+		replayed.BatchRun.TestCases.Failed != 1 {
+		t.Errorf("replayed %+v, recorded %+v", replayed, recorded)
+	}
+}
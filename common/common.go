@@ -1,74 +1,85 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-resty/resty"
-	"github.com/mholt/archiver/v3"
 	"github.com/urfave/cli"
 )
 
-type testCasesCounter struct {
-	NotRunning int `json:"not-running,omitempty"`
-	Running    int `json:"running,omitempty"`
-	Succeeded  int `json:"succeeded,omitempty"`
-	Failed     int `json:"failed,omitempty"`
-	Aborted    int `json:"aborted,omitempty"`
-	Unresolved int `json:"unresolved,omitempty"`
-	Total      int `json:"total"`
+// TestCasesSummary stands for the numbers of test cases by status, and the results of each pattern retrieved by GetBatchRun
+type TestCasesSummary struct {
+	NotRunning int              `json:"not-running,omitempty"`
+	Running    int              `json:"running,omitempty"`
+	Succeeded  int              `json:"succeeded,omitempty"`
+	Failed     int              `json:"failed,omitempty"`
+	Aborted    int              `json:"aborted,omitempty"`
+	Unresolved int              `json:"unresolved,omitempty"`
+	Total      int              `json:"total"`
+	Details    []TestCaseDetail `json:"details,omitempty"`
+	Unknown    UnknownFields    `json:"-"`
 }
 
-type taskInterval struct {
-	StartedAt       string   `json:"started_at"`
-	FinishedAt      string   `json:"finished_at"`
-	DurationSeconds *float64 `json:"duration_seconds"`
+// TaskInterval stands for when a batch run or a test case ran
+type TaskInterval struct {
+	StartedAt       ServerTime `json:"started_at"`
+	FinishedAt      ServerTime `json:"finished_at"`
+	DurationSeconds *float64   `json:"duration_seconds"`
 }
 
 // BatchRun stands for a batch run executed on the server
 type BatchRun struct {
-	OrganizationName string `json:"organization_name"`
-	ProjectName      string `json:"project_name"`
-	BatchRunNumber   int    `json:"batch_run_number"`
-	TestSettingName  string `json:"test_setting_name"`
-	BranchName       string `json:"branch_name"`
-	Status           string `json:"status"`
-	StatusNumber     int    `json:"status_number"`
-	taskInterval
-	TestCases struct {
-		testCasesCounter
-		Details []struct {
-			PatternName    *string          `json:"pattern_name"`
-			IncludedLabels []string         `json:"included_labels"`
-			ExcludedLabels []string         `json:"excluded_labels"`
-			Results        []TestCaseResult `json:"results"`
-		} `json:"details"`
-	} `json:"test_cases"`
-	Url string `json:"url"`
+	OrganizationName string         `json:"organization_name"`
+	ProjectName      string         `json:"project_name"`
+	BatchRunNumber   int            `json:"batch_run_number"`
+	TestSettingName  string         `json:"test_setting_name"`
+	BranchName       string         `json:"branch_name"`
+	Status           BatchRunStatus `json:"status"`
+	StatusNumber     int            `json:"status_number"`
+	TaskInterval
+	TestCases TestCasesSummary `json:"test_cases"`
+	Url       string           `json:"url"`
+	Unknown   UnknownFields    `json:"-"`
+}
+
+// TestCaseDetail stands for the results of the test cases run with a pattern, i.e. a test setting of a cross batch run
+type TestCaseDetail struct {
+	PatternName    *string          `json:"pattern_name"`
+	IncludedLabels []string         `json:"included_labels"`
+	ExcludedLabels []string         `json:"excluded_labels"`
+	Results        []TestCaseResult `json:"results"`
+	Unknown        UnknownFields    `json:"-"`
 }
 
 type TestCaseResult struct {
-	Order    int `json:"order"`
-	TestCase struct {
-		Number int    `json:"number"`
-		Name   string `json:"name"`
-		Url    string `json:"url"`
-	} `json:"test_case"`
-	Status string `json:"status"`
-	taskInterval
+	Order    int      `json:"order"`
+	TestCase TestCase `json:"test_case"`
+	Status   string   `json:"status"`
+	TaskInterval
 	DataPatterns []DataPattern `json:"data_patterns"`
+	Unknown      UnknownFields `json:"-"`
+}
+
+type TestCase struct {
+	Number int    `json:"number"`
+	Name   string `json:"name"`
+	Url    string `json:"url"`
 }
 
 type DataPattern struct {
-	DataIndex  int    `json:"data_index"`
-	Status     string `json:"status"`
-	StartedAt  string `json:"started_at"`
-	FinishedAt string `json:"finished_at"`
+	DataIndex  int        `json:"data_index"`
+	Status     string     `json:"status"`
+	StartedAt  ServerTime `json:"started_at"`
+	FinishedAt ServerTime `json:"finished_at"`
 }
 
 // BatchRuns stands for a group of batch runs executed on the server
@@ -79,15 +90,31 @@ type BatchRuns struct {
 }
 
 type BatchRunSummary struct {
-	BatchRunNumber  int    `json:"batch_run_number"`
-	TestSettingName string `json:"test_setting_name"`
-	Status          string `json:"status"`
-	StatusNumber    int    `json:"status_number"`
-	taskInterval
-	TestCases struct {
-		testCasesCounter
-	} `json:"test_cases"`
-	Url string `json:"url"`
+	BatchRunNumber  int            `json:"batch_run_number"`
+	TestSettingName string         `json:"test_setting_name"`
+	BranchName      string         `json:"branch_name,omitempty"`
+	Status          BatchRunStatus `json:"status"`
+	StatusNumber    int            `json:"status_number"`
+	TaskInterval
+	TestCases TestCasesSummary `json:"test_cases"`
+	Url       string           `json:"url"`
+	Unknown   UnknownFields    `json:"-"`
+}
+
+// Summary converts the batch run into the form returned by GetBatchRuns
+func (b *BatchRun) Summary() BatchRunSummary {
+	summary := BatchRunSummary{
+		BatchRunNumber:  b.BatchRunNumber,
+		TestSettingName: b.TestSettingName,
+		BranchName:      b.BranchName,
+		Status:          b.Status,
+		StatusNumber:    b.StatusNumber,
+		TaskInterval:    b.TaskInterval,
+		TestCases:       b.TestCases,
+		Url:             b.Url,
+	}
+	summary.TestCases.Details = nil
+	return summary
 }
 
 // UploadFile stands for a file to be uploaded to the server
@@ -108,19 +135,8 @@ type UploadDataPatternCsvResponse struct {
 	} `json:"errors"`
 }
 
-func zipAppDir(dirPath string) string {
-	zipPath := dirPath + ".zip"
-	if err := os.RemoveAll(zipPath); err != nil {
-		panic(err)
-	}
-	if err := archiver.Archive([]string{dirPath}, zipPath); err != nil {
-		panic(err)
-	}
-	return zipPath
-}
-
 func createBaseRequest(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string) *resty.Request {
-	client := resty.New()
+	client := resty.New().SetTransport(newTransport())
 	return client.
 		SetHostURL(urlBase+"/api/v1.0").R().
 		SetHeader("Authorization", "Token "+string(apiToken)).
@@ -131,43 +147,126 @@ func createBaseRequest(urlBase string, apiToken string, organization string, pro
 		})
 }
 
-func handleError(resp *resty.Response) *cli.ExitError {
+// APIError is an error response of the Web API
+type APIError struct {
+	StatusCode int
+	Status     string      // e.g. "404 Not Found"
+	Message    string      // the response body
+	Header     http.Header // e.g. Retry-After
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+func newAPIError(resp *resty.Response) *APIError {
+	return &APIError{StatusCode: resp.StatusCode(), Status: resp.Status(), Message: resp.String(), Header: resp.Header()}
+}
+
+// errorMessage returns the reason of a client error given by the server, e.g. {"detail": "Not found."}.
+// Other bodies are returned as they are
+func errorMessage(statusCode int, body []byte) string {
+	if reason, ok := errorReason(statusCode, body); ok {
+		return reason
+	}
+	return string(body)
+}
+
+// errorReason returns "detail" or "message" of the body of a client error, if any
+func errorReason(statusCode int, body []byte) (string, bool) {
+	if statusCode < 400 || statusCode >= 500 {
+		return "", false
+	}
+	var reason struct {
+		Detail  string `json:"detail"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &reason) != nil {
+		return "", false
+	}
+	if reason.Detail != "" {
+		return reason.Detail, true
+	}
+	return reason.Message, reason.Message != ""
+}
+
+// responseError returns the error response as *APIError, or nil if the request succeeded
+func responseError(resp *resty.Response) error {
 	if resp.StatusCode() != 200 {
-		return cli.NewExitError(fmt.Sprintf("%s: %s", resp.Status(), resp.String()), 1)
-	} else {
+		return newAPIError(resp)
+	}
+	return nil
+}
+
+func handleError(resp *resty.Response) *cli.ExitError {
+	return toExitError(responseError(resp))
+}
+
+// toExitError converts an error of the functions returning error into that of the command
+func toExitError(err error) *cli.ExitError {
+	if err == nil {
 		return nil
 	}
+	if exitErr, ok := err.(*cli.ExitError); ok {
+		return exitErr
+	}
+	return cli.NewExitError(err.Error(), 1)
 }
 
 // UploadApp uploads app/ipa/apk file to the server
 func UploadApp(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, appPath string) (int, *cli.ExitError) {
-	stat, err := os.Stat(appPath)
-	if err != nil {
-		return 0, cli.NewExitError(fmt.Sprintf("%s does not exist", appPath), 1)
+	fileNo, err := uploadApp(urlBase, apiToken, organization, project, httpHeadersMap, appPath)
+	return fileNo, toExitError(err)
+}
+
+func uploadApp(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, appPath string) (fileNo int, err error) {
+	span := startSpan(nil, "upload app", "magicpod.app_path", appPath)
+	defer func() { span.end(err) }()
+	isAppDir, exitErr := validateAppPath(appPath)
+	if exitErr != nil {
+		return 0, exitErr
 	}
-	var actualPath string
-	if stat.Mode().IsDir() {
-		if strings.HasSuffix(appPath, ".app") {
-			actualPath = zipAppDir(appPath)
-		} else {
-			return 0, cli.NewExitError(fmt.Sprintf("%s is not file but directory.", appPath), 1)
+	actualPath := appPath
+	if isAppDir {
+		zipPath, err := zipAppDir(appPath)
+		if err != nil {
+			return 0, cli.NewExitError(fmt.Sprintf("failed to zip %s: %s", appPath, err), 1)
 		}
-	} else {
-		actualPath = appPath
+		defer os.RemoveAll(filepath.Dir(zipPath))
+		actualPath = zipPath
 	}
 	res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
+		SetContext(contextWithSpan(context.Background(), span)).
 		SetFile("file", actualPath).
 		SetResult(UploadFile{}).
 		Post("/{organization}/{project}/upload-file/")
 	if err != nil {
 		panic(err)
 	}
-	if exitErr := handleError(res); exitErr != nil {
-		return 0, exitErr
+	if err := responseError(res); err != nil {
+		return 0, err
 	}
 	return res.Result().(*UploadFile).FileNo, nil
 }
 
+// validateAppPath checks the app/ipa/apk to upload, and returns true if it is an .app directory to be zipped
+func validateAppPath(appPath string) (bool, *cli.ExitError) {
+	stat, err := os.Stat(appPath)
+	if err != nil {
+		return false, cli.NewExitError(fmt.Sprintf("%s does not exist", appPath), 1)
+	}
+	if stat.Mode().IsDir() {
+		if strings.HasSuffix(appPath, ".app") {
+			if err := validateAppBundle(appPath); err != nil {
+				return false, cli.NewExitError(err.Error(), 1)
+			}
+			return true, nil
+		}
+		return false, cli.NewExitError(fmt.Sprintf("%s is not file but directory.", appPath), 1)
+	}
+	return false, nil
+}
+
 func mergeTestSettingsNumberToSetting(testSettingsMap map[string]interface{}, hasTestSettings bool, testSettingsNumber int) string {
 	testSettingsMap["test_settings_number"] = testSettingsNumber
 
@@ -195,8 +294,46 @@ func mergeTestSettingsNumberToSetting(testSettingsMap map[string]interface{}, ha
 	return string(settingBytes)
 }
 
-// StartBatchRun starts a batch run or a cross batch run on the server
-func StartBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, testSettingsNumber int, branchName string, setting string) (*BatchRun, *cli.ExitError) {
+// InjectAppFileNumber sets the uploaded app file to the setting, or to every entry of its test_settings.
+// An empty setting becomes {"app_file_number":N}, which is merged with test_settings_number like the other settings
+func InjectAppFileNumber(setting string, appFileNumber int) (string, *cli.ExitError) {
+	settingMap := map[string]interface{}{}
+	if setting != "" {
+		if err := json.Unmarshal([]byte(setting), &settingMap); err != nil {
+			return "", cli.NewExitError(fmt.Sprintf("setting must be a JSON object to inject the app file number: %s", err), 1)
+		}
+	}
+	injectTo := func(entry map[string]interface{}) {
+		entry["app_file_number"] = appFileNumber
+		if _, hasAppType := entry["app_type"]; hasAppType {
+			entry["app_type"] = "app_file"
+			delete(entry, "app_url")
+		}
+	}
+	if testSettings, hasTestSettings := settingMap["test_settings"]; hasTestSettings {
+		entries, ok := testSettings.([]interface{})
+		if !ok {
+			return "", cli.NewExitError("test_settings must be a list", 1)
+		}
+		for i, entry := range entries {
+			entryMap, ok := entry.(map[string]interface{})
+			if !ok {
+				return "", cli.NewExitError(fmt.Sprintf("test_settings[%d] must be an object", i), 1)
+			}
+			injectTo(entryMap)
+		}
+	} else {
+		injectTo(settingMap)
+	}
+	settingBytes, err := json.Marshal(settingMap)
+	if err != nil {
+		return "", cli.NewExitError(err.Error(), 1)
+	}
+	return string(settingBytes), nil
+}
+
+// resolveBatchRunRequest merges the options into the setting, and chooses the endpoint of a batch run or a cross batch run
+func resolveBatchRunRequest(testSettingsNumber int, branchName string, setting string) (string, string, *cli.ExitError) {
 	var testSettings interface{}
 	isCrossBatchRunSetting := (testSettingsNumber != 0)
 	if setting == "" {
@@ -215,13 +352,13 @@ func StartBatchRun(urlBase string, apiToken string, organization string, project
 				testSettingsBranchInJSON, hasTestSettingsBranch := testSettingsMap["branch_name"]
 				if branchName != "" {
 					if hasTestSettingsBranch && branchName != testSettingsBranchInJSON {
-						return nil, cli.NewExitError("--branch_name and --setting have different branch name", 1)
+						return "", "", cli.NewExitError("--branch_name and --setting have different branch name", 1)
 					}
 					testSettingsMap["branch_name"] = branchName
 				}
 				if testSettingsNumber != 0 {
 					if hasTestSettingsNumber && testSettingsNumber != testSettingsNumberInJSON {
-						return nil, cli.NewExitError("--test_settings_number and --setting have different number", 1)
+						return "", "", cli.NewExitError("--test_settings_number and --setting have different number", 1)
 					}
 					setting = mergeTestSettingsNumberToSetting(testSettingsMap, hasTestSettings, testSettingsNumber)
 				}
@@ -230,53 +367,77 @@ func StartBatchRun(urlBase string, apiToken string, organization string, project
 		}
 	}
 	if isCrossBatchRunSetting {
-		res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
-			SetHeader("Content-Type", "application/json").
-			SetBody(setting).
-			SetResult(BatchRun{}).
-			Post("/{organization}/{project}/cross-batch-run/")
-		if err != nil {
-			panic(err)
-		}
-		if exitErr := handleError(res); exitErr != nil {
-			return nil, exitErr
-		}
-		return res.Result().(*BatchRun), nil
-	} else { // normal batch run
-		res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
-			SetHeader("Content-Type", "application/json").
-			SetBody(setting).
-			SetResult(BatchRun{}).
-			Post("/{organization}/{project}/batch-run/")
-		if err != nil {
-			panic(err)
-		}
-		if exitErr := handleError(res); exitErr != nil {
-			return nil, exitErr
-		}
-		return res.Result().(*BatchRun), nil
+		return "/{organization}/{project}/cross-batch-run/", setting, nil
 	}
+	return "/{organization}/{project}/batch-run/", setting, nil // normal batch run
 }
 
-// GetBatchRun retrieves status and number of test cases executed of a specified batch run
-func GetBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, batchRunNumber int) (*BatchRun, *cli.ExitError) {
+// StartBatchRun starts a batch run or a cross batch run on the server
+func StartBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, testSettingsNumber int, branchName string, setting string) (*BatchRun, *cli.ExitError) {
+	batchRun, err := startBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, testSettingsNumber, branchName, setting)
+	return batchRun, toExitError(err)
+}
+
+// startBatchRun returns *APIError when the server refuses the request, so that the caller can tell why
+func startBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	testSettingsNumber int, branchName string, setting string) (batchRun *BatchRun, err error) {
+	span := startSpan(nil, "start batch run", "magicpod.test_settings_number", testSettingsNumber, "magicpod.branch_name", branchName)
+	defer func() {
+		if batchRun != nil {
+			span.setAttributes("magicpod.batch_run_number", batchRun.BatchRunNumber)
+		}
+		span.end(err)
+	}()
+	path, setting, exitErr := resolveBatchRunRequest(testSettingsNumber, branchName, setting)
+	if exitErr != nil {
+		return nil, exitErr
+	}
 	res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
+		SetContext(contextWithSpan(context.Background(), span)).
+		SetHeader("Content-Type", "application/json").
+		SetBody(setting).
+		SetResult(BatchRun{}).
+		Post(path)
+	if err != nil {
+		panic(err)
+	}
+	if err := responseError(res); err != nil {
+		return nil, err
+	}
+	batchRun = res.Result().(*BatchRun)
+	return batchRun, nil
+}
+
+func getBatchRun(ctx context.Context, urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, batchRunNumber int) (*resty.Response, error) {
+	return createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
+		SetContext(ctx).
 		SetPathParams(map[string]string{
 			"batch_run_number": strconv.Itoa(batchRunNumber),
 		}).
 		SetResult(BatchRun{}).
 		Get("/{organization}/{project}/batch-run/{batch_run_number}/")
+}
+
+// GetBatchRun retrieves status and number of test cases executed of a specified batch run
+func GetBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, batchRunNumber int) (*BatchRun, *cli.ExitError) {
+	batchRun, err := getBatchRunResult(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
+	return batchRun, toExitError(err)
+}
+
+func getBatchRunResult(ctx context.Context, urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, batchRunNumber int) (*BatchRun, error) {
+	res, err := getBatchRun(ctx, urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
 	if err != nil {
 		panic(err)
 	}
-	if exitErr := handleError(res); exitErr != nil {
-		return nil, exitErr
+	if err := responseError(res); err != nil {
+		return nil, err
 	}
 	return res.Result().(*BatchRun), nil
 }
 
-func getBatchRuns(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, count int, maxBatchRunNumber int, minBatchRunNumber int) (*resty.Response, error) {
+func getBatchRuns(ctx context.Context, urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, count int, maxBatchRunNumber int, minBatchRunNumber int) (*resty.Response, error) {
 	req := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
+		SetContext(ctx).
 		SetQueryParam("count", strconv.Itoa(count)).
 		SetResult(BatchRuns{})
 	// Optional filtering parameters.
@@ -290,7 +451,7 @@ func getBatchRuns(urlBase string, apiToken string, organization string, project
 }
 
 func GetBatchRuns(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, count int, maxBatchRunNumber int, minBatchRunNumber int) (*BatchRuns, *cli.ExitError) {
-	res, err := getBatchRuns(urlBase, apiToken, organization, project, httpHeadersMap, count, maxBatchRunNumber, minBatchRunNumber)
+	res, err := getBatchRuns(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, count, maxBatchRunNumber, minBatchRunNumber)
 	if err != nil {
 		panic(err)
 	}
@@ -301,7 +462,7 @@ func GetBatchRuns(urlBase string, apiToken string, organization string, project
 }
 
 func LatestBatchRunNo(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string) (int, *cli.ExitError) {
-	res, err := getBatchRuns(urlBase, apiToken, organization, project, httpHeadersMap, 1, 0, 0)
+	res, err := getBatchRuns(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, 1, 0, 0)
 	if err != nil {
 		panic(err)
 	}
@@ -317,16 +478,17 @@ func LatestBatchRunNo(urlBase string, apiToken string, organization string, proj
 
 // DeleteApp deletes app/ipa/apk file on the server
 func DeleteApp(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, appFileNumber int) *cli.ExitError {
+	return toExitError(deleteApp(urlBase, apiToken, organization, project, httpHeadersMap, appFileNumber))
+}
+
+func deleteApp(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, appFileNumber int) error {
 	res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
 		SetBody(fmt.Sprintf("{\"app_file_number\":%d}", appFileNumber)).
 		Delete("/{organization}/{project}/delete-file/")
 	if err != nil {
 		panic(err)
 	}
-	if exitErr := handleError(res); exitErr != nil {
-		return exitErr
-	}
-	return nil
+	return responseError(res)
 }
 
 func PrepareScreenshots(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, batchRunNumber int, fileIndexType string, fileNameBodyType string, downloadType string, maskDynamicallyChangedArea bool) int {
@@ -397,7 +559,13 @@ func DownloadPreparedScreenshots(urlBase string, apiToken string, organization s
 
 func GetScreenshots(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
 	batchRunNumber int, downloadPath string, fileIndexType string, fileNameBodyType string, downloadType string,
-	maskDynamicallyChangedArea bool, waitLimit int, printResult bool) error {
+	maskDynamicallyChangedArea bool, waitLimit int, printResult bool) (err error) {
+	span := startSpan(nil, "get screenshots", "magicpod.batch_run_number", batchRunNumber, "magicpod.download_type", downloadType)
+	prepareSpan := startSpan(span, "prepare screenshots")
+	defer func() {
+		prepareSpan.end(err) // no-op if the preparation has succeeded
+		span.end(err)
+	}()
 	batchTaskId := PrepareScreenshots(urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber, fileIndexType, fileNameBodyType, downloadType, maskDynamicallyChangedArea)
 	printMessage(printResult, "Preparing screenshots download.. \n")
 	interval := 5
@@ -411,6 +579,7 @@ func GetScreenshots(urlBase string, apiToken string, organization string, projec
 		status := GetBatchTaskStatus(urlBase, apiToken, organization, project, httpHeadersMap, batchTaskId)
 		if status == "succeeded" {
 			printMessage(printResult, "\nDone.\n")
+			prepareSpan.end(nil)
 			break
 		} else if status == "running" {
 			printMessage(printResult, ".")
@@ -430,10 +599,13 @@ func GetScreenshots(urlBase string, apiToken string, organization string, projec
 			}
 			return cli.NewExitError(errorMessage, 1)
 		}
-		time.Sleep(time.Duration(interval) * time.Second)
+		sleep(time.Duration(interval) * time.Second)
 		passedSeconds += interval
 	}
-	return DownloadPreparedScreenshots(urlBase, apiToken, organization, project, httpHeadersMap, batchTaskId, downloadPath)
+	downloadSpan := startSpan(span, "download screenshots")
+	err = DownloadPreparedScreenshots(urlBase, apiToken, organization, project, httpHeadersMap, batchTaskId, downloadPath)
+	downloadSpan.end(err)
+	return err
 }
 
 func printMessage(printResult bool, format string, args ...interface{}) {
@@ -442,7 +614,45 @@ func printMessage(printResult bool, format string, args ...interface{}) {
 	}
 }
 
+// RunResult stands for the outcome of a batch run started by RunBatchRun or waited for by WaitForBatchRun
+type RunResult struct {
+	BatchRun      *BatchRun // the latest state retrieved from the server
+	HasFailures   bool      // failed or aborted, or its status could not be retrieved
+	HasUnresolved bool
+	TimedOut      bool // the wait limit passed before the batch run finished
+}
+
+// RunBatchRun starts batch run(s) and, if waitForResult is true, waits for its completion with showing progress
+func RunBatchRun(urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, testSettingsNumber int, branchName string, setting string,
+	waitForResult bool, waitLimit WaitLimit, printResult bool) (*RunResult, *cli.ExitError) {
+	result, err := runBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, testSettingsNumber, branchName, setting,
+		waitForResult, waitLimit, printResult)
+	return result, toExitError(err)
+}
+
+func runBatchRun(urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, testSettingsNumber int, branchName string, setting string,
+	waitForResult bool, waitLimit WaitLimit, printResult bool) (*RunResult, error) {
+	batchRun, err := startBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, testSettingsNumber, branchName, setting)
+	if err != nil {
+		return nil, err
+	}
+
+	printMessage(printResult, "test result page:\n")
+	printMessage(printResult, "%s\n", batchRun.Url)
+
+	// finish before the test finish
+	if !waitForResult {
+		return &RunResult{BatchRun: batchRun}, nil
+	}
+
+	return waitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, waitLimit, printResult, waitProgress{})
+}
+
 // ExecuteBatchRun starts batch run(s) and wait for its completion with showing progress
+//
+// Deprecated: use RunBatchRun, or Client.RunBatchRun of the magicpod package, which return a RunResult
 func ExecuteBatchRun(urlBase string, apiToken string, organization string, project string,
 	httpHeadersMap map[string]string, testSettingsNumber int, branchName string, setting string,
 	waitForResult bool, waitLimit int, printResult bool) (*BatchRun /*on which magicpod bitrise step depends */, bool, bool, *cli.ExitError) {
@@ -463,33 +673,103 @@ func ExecuteBatchRun(urlBase string, apiToken string, organization string, proje
 	return WaitForBatchRunResult(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, waitLimit, printResult)
 }
 
+// WaitForBatchRunResult waits for the completion of the batch run with showing progress
+//
+// Deprecated: use WaitForBatchRun, or Client.WaitForBatchRun of the magicpod package, which return a RunResult
 func WaitForBatchRunResult(urlBase string, apiToken string, organization string, project string,
 	httpHeadersMap map[string]string, batchRun *BatchRun,
 	waitLimit int, printResult bool) (*BatchRun /*on which magicpod bitrise step depends */, bool, bool, *cli.ExitError) {
+	result, exitErr := WaitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, WaitLimit{Seconds: waitLimit}, printResult)
+	return batchRun, result.HasFailures, result.HasUnresolved, exitErr
+}
+
+// WaitForBatchRun waits for the completion of the batch run with showing progress.
+// The result is returned with an error when the wait limit passes
+func WaitForBatchRun(urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, batchRun *BatchRun, waitLimit WaitLimit, printResult bool) (*RunResult, *cli.ExitError) {
+	result, err := waitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, waitLimit, printResult, waitProgress{})
+	return result, toExitError(err)
+}
+
+// waitProgress continues an earlier wait for the batch run, e.g. of a process which ended before the batch run
+type waitProgress struct {
+	resumed       bool
+	passedSeconds int                // counted in the wait limit
+	finished      int                // test cases whose finish was already shown
+	onProgress    func(finished int) // called when more test cases finish
+}
+
+func waitForBatchRun(urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, batchRun *BatchRun, waitLimit WaitLimit, printResult bool, progress waitProgress) (*RunResult, error) {
 
 	crossBatchRunTotalTestCount := batchRun.TestCases.Total
 	const initRetryInterval = 10 // retry more frequently at first
 	const retryInterval = 60
+	// the estimate is retrieved only for the automatic wait limit or the ETA shown in the progress, at most once.
+	// It is just a hint, so the wait goes on even if it is not available
+	var estimate *BatchRunDurationEstimate
+	estimated := false
+	estimateDuration := func() *BatchRunDurationEstimate {
+		if !estimated {
+			estimated = true
+			var err error
+			if estimate, err = estimateBatchRunDuration(urlBase, apiToken, organization, project, httpHeadersMap, batchRun.TestSettingName); err != nil {
+				printMessage(printResult, "failed to estimate the duration: %s\n", err)
+			}
+		}
+		return estimate
+	}
 	var limitSeconds int
-	if waitLimit == 0 {
+	if waitLimit.Auto {
+		limitSeconds = estimateDuration().AutoWaitLimit()
+		if limitSeconds == 0 {
+			limitSeconds = crossBatchRunTotalTestCount * 10 * 60
+			printMessage(printResult, "no previous batch run to derive the wait limit from. wait up to test count x 10 minutes\n")
+		} else {
+			printMessage(printResult, "wait limit is automatically set to %s\n", formatSeconds(float64(limitSeconds)))
+		}
+	} else if waitLimit.Seconds == 0 {
 		limitSeconds = crossBatchRunTotalTestCount * 10 * 60 // wait up to test count x 10 minutes by default
 	} else {
-		limitSeconds = waitLimit
+		limitSeconds = waitLimit.Seconds
 	}
-	passedSeconds := 0
+	passedSeconds := progress.passedSeconds
 	existsErr := false
 	existsUnresolved := false
-	printMessage(printResult, "\n#%d wait until %d tests to be finished.. \n", batchRun.BatchRunNumber, batchRun.TestCases.Total)
-	prevFinished := 0
+	if progress.resumed {
+		remainingSeconds := limitSeconds - passedSeconds
+		if remainingSeconds < 0 {
+			remainingSeconds = 0
+		}
+		printMessage(printResult, "\n#%d resume waiting (%d/%d finished, %s of the wait limit left).. \n", batchRun.BatchRunNumber,
+			progress.finished, batchRun.TestCases.Total, formatSeconds(float64(remainingSeconds)))
+	} else {
+		printMessage(printResult, "\n#%d wait until %d tests to be finished.. \n", batchRun.BatchRunNumber, batchRun.TestCases.Total)
+	}
+	if estimate != nil {
+		printMessage(printResult, "%s\n", estimate)
+	}
+	prevFinished := progress.finished
+	latest := batchRun
+	warnedStatus := BatchRunStatus("")
+	waitSpan := startSpan(nil, "wait for batch run", "magicpod.batch_run_number", batchRun.BatchRunNumber, "magicpod.wait_limit_seconds", limitSeconds)
 	for {
-		batchRunUnderProgress, exitErr := GetBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun.BatchRunNumber)
-		if exitErr != nil {
+		pollSpan := startSpan(waitSpan, "poll batch run", "magicpod.batch_run_number", batchRun.BatchRunNumber)
+		batchRunUnderProgress, err := getBatchRunResult(contextWithSpan(context.Background(), pollSpan), urlBase, apiToken, organization, project,
+			httpHeadersMap, batchRun.BatchRunNumber)
+		if err == nil {
+			pollSpan.setAttributes("magicpod.status", batchRunUnderProgress.Status)
+		}
+		pollSpan.end(err)
+		if err != nil {
 			if printResult {
-				fmt.Print(exitErr)
+				fmt.Print(err)
 			}
 			existsErr = true
+			waitSpan.end(err)
 			break // give up the wait here
 		}
+		latest = batchRunUnderProgress
 		finished := batchRunUnderProgress.TestCases.Succeeded + batchRunUnderProgress.TestCases.Failed + batchRunUnderProgress.TestCases.Aborted + batchRunUnderProgress.TestCases.Unresolved
 		printMessage(printResult, ".") // show progress to prevent "long time no output" error on CircleCI etc
 		// output progress
@@ -507,10 +787,31 @@ func WaitForBatchRunResult(urlBase string, apiToken string, organization string,
 			if notSuccessfulCount != "" {
 				notSuccessfulCount = fmt.Sprintf(" (%s)", notSuccessfulCount)
 			}
-			printMessage(printResult, "%d/%d finished%s\n", finished, batchRun.TestCases.Total, notSuccessfulCount)
+			eta := ""
+			if printResult && batchRunUnderProgress.Status == "running" {
+				elapsedSeconds := float64(passedSeconds)
+				if startedAt := batchRunUnderProgress.StartedAt; !startedAt.IsZero() {
+					elapsedSeconds = time.Since(startedAt.Time).Seconds()
+				}
+				if remaining, ok := estimateDuration().RemainingSeconds(elapsedSeconds, finished, batchRun.TestCases.Total); ok {
+					eta = fmt.Sprintf(", ETA %s", formatSeconds(remaining))
+				}
+			}
+			printMessage(printResult, "%d/%d finished%s%s\n", finished, batchRun.TestCases.Total, notSuccessfulCount, eta)
 			prevFinished = finished
+			if progress.onProgress != nil {
+				progress.onProgress(finished)
+			}
+		}
+		if !batchRunUnderProgress.Status.IsKnown() && batchRunUnderProgress.Status != warnedStatus {
+			// a status added on the server later. wait for a known one until the wait limit
+			fmt.Fprintf(os.Stderr, "warning: unknown batch run status '%s'. keep waiting\n", batchRunUnderProgress.Status)
+			warnedStatus = batchRunUnderProgress.Status
 		}
-		if batchRunUnderProgress.Status != "running" {
+		if batchRunUnderProgress.Status.IsTerminal() {
+			waitSpan.setAttributes("magicpod.status", batchRunUnderProgress.Status)
+			recordTestCaseSpans(waitSpan, batchRunUnderProgress)
+			waitSpan.end(nil)
 			if batchRunUnderProgress.TestCases.Unresolved > 0 {
 				existsUnresolved = true
 			}
@@ -536,34 +837,34 @@ func WaitForBatchRunResult(urlBase string, apiToken string, organization string,
 				printMessage(printResult, "batch run aborted\n")
 				existsErr = true
 				break
-			} else {
-				panic(batchRunUnderProgress.Status)
 			}
 		}
 		if passedSeconds > limitSeconds {
-			return batchRun, existsErr, existsUnresolved, cli.NewExitError("batch run never finished", 1)
+			message := "batch run never finished"
+			if !batchRunUnderProgress.Status.IsKnown() {
+				message = fmt.Sprintf("batch run never finished (unknown status '%s')", batchRunUnderProgress.Status)
+			}
+			exitErr := cli.NewExitError(message, 1)
+			recordTestCaseSpans(waitSpan, batchRunUnderProgress)
+			waitSpan.end(exitErr)
+			return &RunResult{BatchRun: latest, HasFailures: existsErr, HasUnresolved: existsUnresolved, TimedOut: true}, exitErr
 		}
 		if passedSeconds < 120 {
-			time.Sleep(initRetryInterval * time.Second)
+			sleep(initRetryInterval * time.Second)
 			passedSeconds += initRetryInterval
 		} else {
-			time.Sleep(retryInterval * time.Second)
+			sleep(retryInterval * time.Second)
 			passedSeconds += retryInterval
 		}
 	}
-	return batchRun, existsErr, existsUnresolved, nil
+	return &RunResult{BatchRun: latest, HasFailures: existsErr, HasUnresolved: existsUnresolved}, nil
 }
 
-func UploadDataPatternCsv(urlBase string, apiToken string, organization string, project string, testCaseNumber int, httpHeadersMap map[string]string, csvFilePath string, overwrite bool, waitLimit int, printResult bool) error {
-	stat, err := os.Stat(csvFilePath)
-	if err != nil {
-		return cli.NewExitError(fmt.Sprintf("Error\n  %s does not exist", csvFilePath), 1)
-	}
-	if stat.Mode().IsDir() {
-		return cli.NewExitError(fmt.Sprintf("Error\n  %s is not file but directory", csvFilePath), 1)
-	}
-	if stat.Size() == 0 {
-		return cli.NewExitError(fmt.Sprintf("Error\n  %s is empty", csvFilePath), 1)
+func UploadDataPatternCsv(urlBase string, apiToken string, organization string, project string, testCaseNumber int, httpHeadersMap map[string]string, csvFilePath string, overwrite bool, waitLimit int, printResult bool) (err error) {
+	span := startSpan(nil, "upload data pattern csv", "magicpod.test_case_number", testCaseNumber, "magicpod.csv_file_path", csvFilePath)
+	defer func() { span.end(err) }()
+	if exitErr := validateCsvFile(csvFilePath); exitErr != nil {
+		return exitErr
 	}
 	printMessage(printResult, "Uploading data pattern CSV file.. \n")
 	batchTaskId, err := RequestUploadingDataPatternCsv(urlBase, apiToken, organization, project, testCaseNumber, httpHeadersMap, csvFilePath, overwrite)
@@ -613,12 +914,26 @@ func UploadDataPatternCsv(urlBase string, apiToken string, organization string,
 			}
 			return cli.NewExitError(errorMessage, 1)
 		}
-		time.Sleep(time.Duration(interval) * time.Second)
+		sleep(time.Duration(interval) * time.Second)
 		passedSeconds += interval
 	}
 	return nil
 }
 
+func validateCsvFile(csvFilePath string) *cli.ExitError {
+	stat, err := os.Stat(csvFilePath)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Error\n  %s does not exist", csvFilePath), 1)
+	}
+	if stat.Mode().IsDir() {
+		return cli.NewExitError(fmt.Sprintf("Error\n  %s is not file but directory", csvFilePath), 1)
+	}
+	if stat.Size() == 0 {
+		return cli.NewExitError(fmt.Sprintf("Error\n  %s is empty", csvFilePath), 1)
+	}
+	return nil
+}
+
 func RequestUploadingDataPatternCsv(urlBase string, apiToken string, organization string, project string, testCaseNumber int, httpHeadersMap map[string]string, csvFilePath string, overwrite bool) (int, error) {
 	res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
 		SetPathParams(map[string]string{
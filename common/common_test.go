@@ -0,0 +1,78 @@
+package common
+
+import "testing"
+
+func TestErrorMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       string
+	}{
+		{"detail", 404, `{"detail": "Not found."}`, "Not found."},
+		{"message", 400, `{"message": "test_settings_number is invalid"}`, "test_settings_number is invalid"},
+		{"field errors", 400, `{"test_settings": ["This field is required."]}`, `{"test_settings": ["This field is required."]}`},
+		{"not json", 403, "Forbidden", "Forbidden"},
+		{"server error", 500, `{"detail": "server error"}`, `{"detail": "server error"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorMessage(tt.statusCode, []byte(tt.body)); got != tt.want {
+				t.Errorf("errorMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       string
+		wantOK     bool
+	}{
+		{"detail", 400, `{"detail": "too many batch runs", "message": "ignored"}`, "too many batch runs", true},
+		{"message", 403, `{"message": "too many batch runs"}`, "too many batch runs", true},
+		{"other field", 400, `{"name": "too many batch runs"}`, "", false},
+		{"not json", 400, "too many batch runs", "", false},
+		{"server error", 503, `{"detail": "too many batch runs"}`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := errorReason(tt.statusCode, []byte(tt.body)); got != tt.want || ok != tt.wantOK {
+				t.Errorf("errorReason() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestInjectAppFileNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", `{"app_file_number":5}`, false},
+		{"top level", `{"model": "iPhone 15", "app_file_number": 1}`, `{"app_file_number":5,"model":"iPhone 15"}`, false},
+		{"app url replaced", `{"app_type": "app_url", "app_url": "https://example.com/app.zip"}`, `{"app_file_number":5,"app_type":"app_file"}`, false},
+		{"every test_settings entry", `{"test_settings_number": 3, "test_settings": [{"model": "iPhone 15"}, {"app_type": "app_url", "app_url": "https://example.com/app.zip"}]}`,
+			`{"test_settings":[{"app_file_number":5,"model":"iPhone 15"},{"app_file_number":5,"app_type":"app_file"}],"test_settings_number":3}`, false},
+		{"empty test_settings", `{"test_settings": []}`, `{"test_settings":[]}`, false},
+		{"test_settings not a list", `{"test_settings": {"model": "iPhone 15"}}`, "", true},
+		{"test_settings entry not an object", `{"test_settings": ["iPhone 15"]}`, "", true},
+		{"not an object", `["iPhone 15"]`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, exitErr := InjectAppFileNumber(tt.setting, 5)
+			if (exitErr != nil) != tt.wantErr {
+				t.Fatalf("InjectAppFileNumber() error = %v, wantErr %v", exitErr, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("InjectAppFileNumber() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
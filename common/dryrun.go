@@ -0,0 +1,114 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// DryRunRequest stands for a request which would be sent to the server, with secrets redacted
+type DryRunRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    interface{}       `json:"body,omitempty"`
+	Form    map[string]string `json:"form,omitempty"`
+	Files   map[string]string `json:"files,omitempty"`
+}
+
+func newDryRunRequest(method string, urlBase string, organization string, project string, httpHeadersMap map[string]string,
+	path string, pathParams map[string]string) *DryRunRequest {
+	params := map[string]string{"organization": organization, "project": project}
+	for k, v := range pathParams {
+		params[k] = v
+	}
+	for k, v := range params {
+		path = strings.Replace(path, "{"+k+"}", url.PathEscape(v), -1)
+	}
+	headers := map[string]string{"Authorization": "Token " + redactedValue}
+	names := make([]string, 0, len(httpHeadersMap))
+	for name := range httpHeadersMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers[name] = httpHeadersMap[name]
+		if isSensitiveHeader(name) {
+			headers[name] = redactedValue
+		}
+	}
+	return &DryRunRequest{Method: method, URL: urlBase + "/api/v1.0" + path, Headers: headers}
+}
+
+// setJSONBody keeps a valid JSON body as is so that it is printed as a part of the dry run output
+func (r *DryRunRequest) setJSONBody(body string) {
+	r.Headers["Content-Type"] = "application/json"
+	if json.Valid([]byte(body)) {
+		r.Body = json.RawMessage(body)
+	} else {
+		r.Body = body
+	}
+}
+
+// String returns the request in indented JSON
+func (r *DryRunRequest) String() string {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%s %s", r.Method, r.URL)
+	}
+	return string(b)
+}
+
+// DryRunBatchRun returns the request StartBatchRun would send, after merging the options into the setting
+func DryRunBatchRun(urlBase string, organization string, project string, httpHeadersMap map[string]string, testSettingsNumber int, branchName string, setting string) (*DryRunRequest, *cli.ExitError) {
+	path, setting, exitErr := resolveBatchRunRequest(testSettingsNumber, branchName, setting)
+	if exitErr != nil {
+		return nil, exitErr
+	}
+	req := newDryRunRequest("POST", urlBase, organization, project, httpHeadersMap, path, nil)
+	req.setJSONBody(setting)
+	return req, nil
+}
+
+// DryRunUploadApp returns the request UploadApp would send
+func DryRunUploadApp(urlBase string, organization string, project string, httpHeadersMap map[string]string, appPath string) (*DryRunRequest, *cli.ExitError) {
+	isAppDir, exitErr := validateAppPath(appPath)
+	if exitErr != nil {
+		return nil, exitErr
+	}
+	req := newDryRunRequest("POST", urlBase, organization, project, httpHeadersMap, "/{organization}/{project}/upload-file/", nil)
+	req.Headers["Content-Type"] = "multipart/form-data"
+	if isAppDir {
+		req.Files = map[string]string{"file": appPath + " (zipped before upload)"}
+	} else {
+		req.Files = map[string]string{"file": appPath}
+	}
+	return req, nil
+}
+
+// DryRunDeleteApp returns the request DeleteApp would send
+func DryRunDeleteApp(urlBase string, organization string, project string, httpHeadersMap map[string]string, appFileNumber int) *DryRunRequest {
+	req := newDryRunRequest("DELETE", urlBase, organization, project, httpHeadersMap, "/{organization}/{project}/delete-file/", nil)
+	req.setJSONBody(fmt.Sprintf("{\"app_file_number\":%d}", appFileNumber))
+	req.Headers["Content-Type"] = "text/plain; charset=utf-8" // DeleteApp does not specify it
+	return req
+}
+
+// DryRunUploadDataPatternCsv returns the request UploadDataPatternCsv would send to start the upload
+func DryRunUploadDataPatternCsv(urlBase string, organization string, project string, testCaseNumber int, httpHeadersMap map[string]string, csvFilePath string, overwrite bool) (*DryRunRequest, *cli.ExitError) {
+	if exitErr := validateCsvFile(csvFilePath); exitErr != nil {
+		return nil, exitErr
+	}
+	req := newDryRunRequest("POST", urlBase, organization, project, httpHeadersMap,
+		"/{organization}/{project}/test-cases/{test_case_number}/start-upload-data-patterns/",
+		map[string]string{"test_case_number": strconv.Itoa(testCaseNumber)})
+	req.Headers["Content-Type"] = "multipart/form-data"
+	req.Form = map[string]string{"overwrite": strconv.FormatBool(overwrite)}
+	req.Files = map[string]string{"file": csvFilePath}
+	return req, nil
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRunBatchRun(t *testing.T) {
+	headers := map[string]string{"X-Api-Key": "secret-key", "X-Request-Id": "42"}
+	req, exitErr := DryRunBatchRun("https://app.magicpod.com", "org", "my project", headers, 3, "main",
+		`{"model": "iPhone 15", "app_file_number": 5}`)
+	if exitErr != nil {
+		t.Fatal(exitErr)
+	}
+	want := `{
+  "method": "POST",
+  "url": "https://app.magicpod.com/api/v1.0/org/my%20project/cross-batch-run/",
+  "headers": {
+    "Authorization": "Token [REDACTED]",
+    "Content-Type": "application/json",
+    "X-Api-Key": "[REDACTED]",
+    "X-Request-Id": "42"
+  },
+  "body": {
+    "branch_name": "main",
+    "test_settings": [
+      {
+        "app_file_number": 5,
+        "model": "iPhone 15"
+      }
+    ],
+    "test_settings_number": 3
+  }
+}`
+	if got := req.String(); got != want {
+		t.Errorf("DryRunBatchRun() =\n%s\nwant\n%s", got, want)
+	}
+
+	if _, exitErr := DryRunBatchRun("https://app.magicpod.com", "org", "project", headers, 3, "main", `{"branch_name": "feature"}`); exitErr == nil {
+		t.Errorf("conflicting branch names are accepted")
+	}
+}
+
+func TestDryRunRedactsHeaders(t *testing.T) {
+	SetRedactHeaders([]string{"X-Tenant"})
+	t.Cleanup(func() { delete(redactHeaders, "x-tenant") })
+	headers := map[string]string{"Cookie": "sessionid=secret", "X-Auth-Token": "secret", "x-tenant": "secret", "Accept-Language": "ja"}
+	req := DryRunDeleteApp("https://app.magicpod.com", "org", "project", headers, 5)
+	output := req.String()
+	if strings.Contains(output, "secret") {
+		t.Errorf("a secret is printed:\n%s", output)
+	}
+	if req.Headers["Accept-Language"] != "ja" {
+		t.Errorf("a header which is not sensitive is redacted:\n%s", output)
+	}
+	if req.Method != "DELETE" || !strings.HasSuffix(req.URL, "/api/v1.0/org/project/delete-file/") || !strings.Contains(output, `"app_file_number": 5`) {
+		t.Errorf("unexpected request:\n%s", output)
+	}
+}
+
+func TestDryRunUploads(t *testing.T) {
+	dir := t.TempDir()
+	apk := filepath.Join(dir, "app.apk")
+	csv := filepath.Join(dir, "patterns.csv")
+	for path, content := range map[string]string{apk: "apk", csv: "a,b\n1,2\n"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, exitErr := DryRunUploadApp("https://app.magicpod.com", "org", "project", map[string]string{}, apk)
+	if exitErr != nil {
+		t.Fatal(exitErr)
+	}
+	if req.Method != "POST" || req.URL != "https://app.magicpod.com/api/v1.0/org/project/upload-file/" || req.Files["file"] != apk {
+		t.Errorf("DryRunUploadApp() =\n%s", req)
+	}
+	if _, exitErr := DryRunUploadApp("https://app.magicpod.com", "org", "project", map[string]string{}, filepath.Join(dir, "missing.apk")); exitErr == nil {
+		t.Errorf("a missing app is accepted")
+	}
+
+	req, exitErr = DryRunUploadDataPatternCsv("https://app.magicpod.com", "org", "project", 12, map[string]string{}, csv, true)
+	if exitErr != nil {
+		t.Fatal(exitErr)
+	}
+	if req.URL != "https://app.magicpod.com/api/v1.0/org/project/test-cases/12/start-upload-data-patterns/" ||
+		req.Form["overwrite"] != "true" || req.Files["file"] != csv {
+		t.Errorf("DryRunUploadDataPatternCsv() =\n%s", req)
+	}
+	if _, exitErr := DryRunUploadDataPatternCsv("https://app.magicpod.com", "org", "project", 12, map[string]string{}, dir, true); exitErr == nil {
+		t.Errorf("a directory is accepted as a CSV file")
+	}
+}
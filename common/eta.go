@@ -0,0 +1,164 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// WaitLimit is how long to wait for a batch run
+type WaitLimit struct {
+	Seconds int  // test count x 10 minutes if 0
+	Auto    bool // derive the wait limit from the durations of the previous batch runs of the same test setting instead of Seconds
+}
+
+const etaHistoryCount = 50            // number of past batch runs to look into
+const autoWaitLimitSafetyFactor = 1.5 // multiplied to p95 of the past durations
+const autoWaitLimitMinSeconds = 10 * 60
+
+// BatchRunDurationEstimate stands for an estimated duration of a batch run based on the past batch runs
+type BatchRunDurationEstimate struct {
+	TestSettingName        string  `json:"test_setting_name"`
+	SampleCount            int     `json:"sample_count"`
+	MedianSeconds          float64 `json:"median_seconds"`
+	P95Seconds             float64 `json:"p95_seconds"`
+	TestCaseAverageSeconds float64 `json:"test_case_average_seconds"`
+}
+
+// EstimateBatchRunDuration estimates the duration of a batch run from the finished batch runs of the same test setting
+func EstimateBatchRunDuration(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, testSettingName string) (*BatchRunDurationEstimate, *cli.ExitError) {
+	estimate, err := estimateBatchRunDuration(urlBase, apiToken, organization, project, httpHeadersMap, testSettingName)
+	return estimate, toExitError(err)
+}
+
+// estimateBatchRunDuration is EstimateBatchRunDuration returning network errors as well, since the estimate is just a hint
+func estimateBatchRunDuration(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, testSettingName string) (*BatchRunDurationEstimate, error) {
+	res, err := getBatchRuns(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, etaHistoryCount, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(res); err != nil {
+		return nil, err
+	}
+	batchRuns := res.Result().(*BatchRuns)
+	estimate := BatchRunDurationEstimate{TestSettingName: testSettingName}
+	durations := []float64{}
+	latestNumber := 0
+	for _, summary := range batchRuns.BatchRuns {
+		if summary.TestSettingName != testSettingName {
+			continue
+		}
+		// aborted runs do not tell how long the whole batch run takes
+		if summary.Status != "succeeded" && summary.Status != "failed" && summary.Status != "unresolved" {
+			continue
+		}
+		if latestNumber == 0 {
+			latestNumber = summary.BatchRunNumber
+		}
+		if summary.DurationSeconds != nil {
+			durations = append(durations, *summary.DurationSeconds)
+		}
+	}
+	if latestNumber == 0 {
+		return &estimate, nil
+	}
+	estimate.SampleCount = len(durations)
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		estimate.MedianSeconds = percentile(durations, 50)
+		estimate.P95Seconds = percentile(durations, 95)
+	}
+
+	// per test case durations of the latest run are used to estimate the rest of a running batch run
+	res, err = getBatchRun(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, latestNumber)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(res); err != nil {
+		return nil, err
+	}
+	latest := res.Result().(*BatchRun)
+	total := 0.0
+	count := 0
+	for _, detail := range latest.TestCases.Details {
+		for _, result := range detail.Results {
+			if result.DurationSeconds != nil {
+				total += *result.DurationSeconds
+				count++
+			}
+		}
+	}
+	if count > 0 {
+		estimate.TestCaseAverageSeconds = total / float64(count)
+	}
+	return &estimate, nil
+}
+
+// AutoWaitLimit returns the wait limit in seconds derived from the estimate, or 0 if there is no history
+func (e *BatchRunDurationEstimate) AutoWaitLimit() int {
+	if e == nil || e.SampleCount == 0 {
+		return 0
+	}
+	limit := int(math.Ceil(e.P95Seconds * autoWaitLimitSafetyFactor))
+	if limit < autoWaitLimitMinSeconds {
+		limit = autoWaitLimitMinSeconds
+	}
+	return limit
+}
+
+// RemainingSeconds estimates how many seconds remain for a batch run which has run for elapsedSeconds.
+// The second return value is false when there is no data to estimate it
+func (e *BatchRunDurationEstimate) RemainingSeconds(elapsedSeconds float64, finished int, total int) (float64, bool) {
+	if e == nil {
+		return 0, false
+	}
+	if e.SampleCount > 0 {
+		return math.Max(e.MedianSeconds-elapsedSeconds, 0), true
+	}
+	if e.TestCaseAverageSeconds > 0 && total > 0 {
+		return float64(total-finished) * e.TestCaseAverageSeconds, true
+	}
+	return 0, false
+}
+
+// String describes the estimate in a human readable form
+func (e *BatchRunDurationEstimate) String() string {
+	if e == nil || (e.SampleCount == 0 && e.TestCaseAverageSeconds == 0) {
+		return "no previous batch run to estimate the duration"
+	}
+	if e.SampleCount == 0 {
+		return fmt.Sprintf("estimated %s per test case based on the previous batch run", formatSeconds(e.TestCaseAverageSeconds))
+	}
+	return fmt.Sprintf("estimated duration %s (p95 %s) based on %d previous batch runs",
+		formatSeconds(e.MedianSeconds), formatSeconds(e.P95Seconds), e.SampleCount)
+}
+
+// percentile returns the nearest-rank percentile of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+// parseServerTime parses a timestamp returned by the server, e.g. started_at
+func parseServerTime(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
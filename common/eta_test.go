@@ -0,0 +1,153 @@
+package common
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name   string
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		{"single value median", []float64{30}, 50, 30},
+		{"single value p95", []float64{30}, 95, 30},
+		{"even count median", []float64{10, 20, 30, 40}, 50, 20},
+		{"odd count median", []float64{10, 20, 30}, 50, 20},
+		{"p95 of 10 values", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 95, 10},
+		{"p95 of 20 values", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, 95, 19},
+		{"p0 is the minimum", []float64{10, 20, 30}, 0, 10},
+		{"p100 is the maximum", []float64{10, 20, 30}, 100, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.sorted, tt.p); got != tt.want {
+				t.Errorf("percentile(%v, %v) = %v, want %v", tt.sorted, tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoWaitLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		estimate *BatchRunDurationEstimate
+		want     int
+	}{
+		{"no estimate", nil, 0},
+		{"no history", &BatchRunDurationEstimate{TestCaseAverageSeconds: 60}, 0},
+		{"at least the minimum", &BatchRunDurationEstimate{SampleCount: 3, P95Seconds: 60}, autoWaitLimitMinSeconds},
+		{"p95 with the safety factor", &BatchRunDurationEstimate{SampleCount: 3, P95Seconds: 1000.5}, 1501},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.estimate.AutoWaitLimit(); got != tt.want {
+				t.Errorf("AutoWaitLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemainingSeconds(t *testing.T) {
+	tests := []struct {
+		name     string
+		estimate *BatchRunDurationEstimate
+		elapsed  float64
+		finished int
+		total    int
+		want     float64
+		wantOK   bool
+	}{
+		{"no estimate", nil, 10, 0, 5, 0, false},
+		{"median minus elapsed", &BatchRunDurationEstimate{SampleCount: 2, MedianSeconds: 300}, 120, 1, 5, 180, true},
+		{"past the median", &BatchRunDurationEstimate{SampleCount: 2, MedianSeconds: 300}, 400, 4, 5, 0, true},
+		{"test case average", &BatchRunDurationEstimate{TestCaseAverageSeconds: 30}, 120, 2, 5, 90, true},
+		{"unknown total", &BatchRunDurationEstimate{TestCaseAverageSeconds: 30}, 120, 2, 0, 0, false},
+		{"no data", &BatchRunDurationEstimate{}, 120, 2, 5, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.estimate.RemainingSeconds(tt.elapsed, tt.finished, tt.total)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("RemainingSeconds() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// newBatchRunHistoryServer serves the batch runs list and the details of the batch runs given by their numbers
+func newBatchRunHistoryServer(t *testing.T, batchRuns string, details map[int]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/org/project/batch-runs/") {
+			fmt.Fprintf(w, `{"organization_name": "org", "project_name": "project", "batch_runs": %s}`, batchRuns)
+			return
+		}
+		for number, detail := range details {
+			if strings.HasSuffix(r.URL.Path, fmt.Sprintf("/org/project/batch-run/%d/", number)) {
+				fmt.Fprint(w, detail)
+				return
+			}
+		}
+		t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEstimateBatchRunDurationFromHistory(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchRuns string
+		details   map[int]string
+		want      BatchRunDurationEstimate
+	}{
+		{
+			name: "finished runs of the same test setting",
+			batchRuns: `[
+				{"batch_run_number": 9, "test_setting_name": "smoke", "status": "running"},
+				{"batch_run_number": 8, "test_setting_name": "smoke", "status": "aborted", "duration_seconds": 5},
+				{"batch_run_number": 7, "test_setting_name": "nightly", "status": "succeeded", "duration_seconds": 3600},
+				{"batch_run_number": 6, "test_setting_name": "smoke", "status": "failed", "duration_seconds": 120},
+				{"batch_run_number": 5, "test_setting_name": "smoke", "status": "succeeded", "duration_seconds": 100},
+				{"batch_run_number": 4, "test_setting_name": "smoke", "status": "unresolved", "duration_seconds": 300},
+				{"batch_run_number": 3, "test_setting_name": "smoke", "status": "succeeded", "duration_seconds": 90}
+			]`,
+			details: map[int]string{6: `{"batch_run_number": 6, "status": "failed", "test_cases": {"details": [{"results": [
+				{"status": "succeeded", "duration_seconds": 40},
+				{"status": "failed", "duration_seconds": 20},
+				{"status": "not-running"}]}]}}`},
+			want: BatchRunDurationEstimate{TestSettingName: "smoke", SampleCount: 4, MedianSeconds: 100, P95Seconds: 300, TestCaseAverageSeconds: 30},
+		},
+		{
+			name:      "finished run without the duration",
+			batchRuns: `[{"batch_run_number": 2, "test_setting_name": "smoke", "status": "succeeded"}]`,
+			details: map[int]string{2: `{"batch_run_number": 2, "status": "succeeded", "test_cases": {"details": [{"results": [
+				{"status": "succeeded", "duration_seconds": 15}]}]}}`},
+			want: BatchRunDurationEstimate{TestSettingName: "smoke", TestCaseAverageSeconds: 15},
+		},
+		{
+			name:      "no finished run",
+			batchRuns: `[{"batch_run_number": 1, "test_setting_name": "smoke", "status": "running"}]`,
+			want:      BatchRunDurationEstimate{TestSettingName: "smoke"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newBatchRunHistoryServer(t, tt.batchRuns, tt.details)
+			got, err := estimateBatchRunDuration(server.URL, "token", "org", "project", map[string]string{}, "smoke")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("estimateBatchRunDuration() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
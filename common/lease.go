@@ -0,0 +1,542 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	leasePollInterval      = 5 * time.Second
+	leaseHeartbeatInterval = 10 * time.Second
+	leaseExpiry            = 60 * time.Second // entries without heartbeat for this long are of crashed jobs
+	detachedLeaseExpiry    = 24 * time.Hour   // in case no waiting job can see the batch run of a detached slot finish
+	detachedCheckInterval  = 30 * time.Second
+)
+
+// LeasedBatchRun is the batch run which keeps the slot after its job ended, e.g. when the wait timed out leaving it running
+type LeasedBatchRun struct {
+	URLBase        string `json:"url_base"`
+	Organization   string `json:"organization"`
+	Project        string `json:"project"`
+	BatchRunNumber int    `json:"batch_run_number"`
+}
+
+// DetachedLease is a slot kept by the batch run of a job which has ended
+type DetachedLease struct {
+	Holder   string         `json:"holder"`
+	BatchRun LeasedBatchRun `json:"batch_run"`
+}
+
+// leaseEntry is a job holding or waiting for a slot of a concurrency group
+type leaseEntry struct {
+	Holder    string          `json:"holder"`
+	Since     time.Time       `json:"since"`
+	Heartbeat time.Time       `json:"heartbeat"`
+	BatchRun  *LeasedBatchRun `json:"batch_run,omitempty"` // set when the slot is detached from the job
+}
+
+// leaseQueue is the state of a concurrency group. Waiting jobs get the slots in the order they came
+type leaseQueue struct {
+	Holders []leaseEntry `json:"holders"`
+	Waiting []leaseEntry `json:"waiting"`
+}
+
+func (q *leaseQueue) expire(now time.Time) {
+	alive := func(entries []leaseEntry) []leaseEntry {
+		kept := []leaseEntry{}
+		for _, entry := range entries {
+			expiry := leaseExpiry
+			if entry.BatchRun != nil {
+				expiry = detachedLeaseExpiry
+			}
+			if now.Sub(entry.Heartbeat) < expiry {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	}
+	q.Holders = alive(q.Holders)
+	q.Waiting = alive(q.Waiting)
+}
+
+// poll acquires a slot for the holder if it is its turn, or returns its 1-based position in the queue
+func (q *leaseQueue) poll(holder string, limit int, now time.Time) (bool, int) {
+	q.expire(now)
+	for i := range q.Holders {
+		if q.Holders[i].Holder == holder {
+			q.Holders[i].Heartbeat = now
+			return true, 0
+		}
+	}
+	position := -1
+	for i := range q.Waiting {
+		if q.Waiting[i].Holder == holder {
+			q.Waiting[i].Heartbeat = now
+			position = i
+		}
+	}
+	if position < 0 {
+		q.Waiting = append(q.Waiting, leaseEntry{Holder: holder, Since: now, Heartbeat: now})
+		position = len(q.Waiting) - 1
+	}
+	if position < limit-len(q.Holders) {
+		entry := q.Waiting[position]
+		q.Waiting = append(q.Waiting[:position], q.Waiting[position+1:]...)
+		entry.Since, entry.Heartbeat = now, now
+		q.Holders = append(q.Holders, entry)
+		return true, 0
+	}
+	return false, position + 1
+}
+
+// renew keeps the slot of the holder. It returns false if the slot has expired
+func (q *leaseQueue) renew(holder string, now time.Time) bool {
+	q.expire(now)
+	for i := range q.Holders {
+		if q.Holders[i].Holder == holder {
+			q.Holders[i].Heartbeat = now
+			return true
+		}
+	}
+	return false
+}
+
+// detach keeps the slot of the holder for the batch run after the job ends. It returns false if the slot has expired
+func (q *leaseQueue) detach(holder string, batchRun LeasedBatchRun, now time.Time) bool {
+	q.expire(now)
+	for i := range q.Holders {
+		if q.Holders[i].Holder == holder {
+			q.Holders[i].Heartbeat = now
+			q.Holders[i].BatchRun = &batchRun
+			return true
+		}
+	}
+	return false
+}
+
+func (q *leaseQueue) detached(now time.Time) []DetachedLease {
+	q.expire(now)
+	detached := []DetachedLease{}
+	for _, entry := range q.Holders {
+		if entry.BatchRun != nil {
+			detached = append(detached, DetachedLease{Holder: entry.Holder, BatchRun: *entry.BatchRun})
+		}
+	}
+	return detached
+}
+
+func (q *leaseQueue) release(holder string) {
+	holders := []leaseEntry{}
+	for _, entry := range q.Holders {
+		if entry.Holder != holder {
+			holders = append(holders, entry)
+		}
+	}
+	q.Holders = holders
+	waiting := []leaseEntry{}
+	for _, entry := range q.Waiting {
+		if entry.Holder != holder {
+			waiting = append(waiting, entry)
+		}
+	}
+	q.Waiting = waiting
+}
+
+// LeaseStore keeps the queues of the concurrency groups. Polling also serves as the heartbeat of the waiting jobs
+type LeaseStore interface {
+	Poll(group string, holder string, limit int) (acquired bool, position int, err error)
+	Renew(group string, holder string) (held bool, err error)
+	Detach(group string, holder string, batchRun LeasedBatchRun) (held bool, err error)
+	Detached(group string) ([]DetachedLease, error)
+	Release(group string, holder string) error
+}
+
+// fileLeaseStore keeps a queue file per group in a directory, which the jobs on a host (or sharing the directory) use
+type fileLeaseStore struct {
+	dir string
+}
+
+// NewFileLeaseStore returns the store for the jobs on this host. dir is concurrency in the state directory if empty
+func NewFileLeaseStore(dir string) (LeaseStore, error) {
+	if dir == "" {
+		statePath, err := localStatePath()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(filepath.Dir(statePath), "concurrency")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileLeaseStore{dir: dir}, nil
+}
+
+// update applies fn to the queue of the group while holding the lock
+func (s *fileLeaseStore) update(group string, fn func(q *leaseQueue)) error {
+	path := filepath.Join(s.dir, url.PathEscape(group)+".json")
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	queue := &leaseQueue{}
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, queue); err != nil {
+			return fmt.Errorf("broken queue file %s: %s", path, err)
+		}
+	}
+	fn(queue)
+	content, err = json.MarshalIndent(queue, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileLeaseStore) Poll(group string, holder string, limit int) (acquired bool, position int, err error) {
+	err = s.update(group, func(q *leaseQueue) {
+		acquired, position = q.poll(holder, limit, time.Now())
+	})
+	return acquired, position, err
+}
+
+func (s *fileLeaseStore) Renew(group string, holder string) (held bool, err error) {
+	err = s.update(group, func(q *leaseQueue) {
+		held = q.renew(holder, time.Now())
+	})
+	return held, err
+}
+
+func (s *fileLeaseStore) Detach(group string, holder string, batchRun LeasedBatchRun) (held bool, err error) {
+	err = s.update(group, func(q *leaseQueue) {
+		held = q.detach(holder, batchRun, time.Now())
+	})
+	return held, err
+}
+
+func (s *fileLeaseStore) Detached(group string) (detached []DetachedLease, err error) {
+	err = s.update(group, func(q *leaseQueue) {
+		detached = q.detached(time.Now())
+	})
+	return detached, err
+}
+
+func (s *fileLeaseStore) Release(group string, holder string) error {
+	return s.update(group, func(q *leaseQueue) {
+		q.release(holder)
+	})
+}
+
+// httpLeaseStore uses the queues of lease-server, which the jobs on several hosts share
+type httpLeaseStore struct {
+	serverURL string
+	secret    string
+	client    *http.Client
+}
+
+// NewHTTPLeaseStore returns the store using the lease server at serverURL, which is given the secret of LeaseHandler
+func NewHTTPLeaseStore(serverURL string, secret string) LeaseStore {
+	// the transport has the proxy and the CA of the command
+	return &httpLeaseStore{serverURL: strings.TrimRight(serverURL, "/"), secret: secret,
+		client: &http.Client{Transport: newTransport(), Timeout: 30 * time.Second}}
+}
+
+func (s *httpLeaseStore) post(group string, action string, query url.Values, body interface{}, result interface{}) error {
+	u := fmt.Sprintf("%s/groups/%s/%s?%s", s.serverURL, url.PathEscape(group), action, query.Encode())
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+s.secret)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("lease server returned %s", res.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func (s *httpLeaseStore) Poll(group string, holder string, limit int) (bool, int, error) {
+	var result leasePollResult
+	err := s.post(group, "poll", url.Values{"holder": {holder}, "limit": {strconv.Itoa(limit)}}, nil, &result)
+	return result.Acquired, result.Position, err
+}
+
+func (s *httpLeaseStore) Renew(group string, holder string) (bool, error) {
+	var result leaseRenewResult
+	err := s.post(group, "renew", url.Values{"holder": {holder}}, nil, &result)
+	return result.Held, err
+}
+
+func (s *httpLeaseStore) Detach(group string, holder string, batchRun LeasedBatchRun) (bool, error) {
+	var result leaseRenewResult
+	err := s.post(group, "detach", url.Values{"holder": {holder}}, batchRun, &result)
+	return result.Held, err
+}
+
+func (s *httpLeaseStore) Detached(group string) ([]DetachedLease, error) {
+	var detached []DetachedLease
+	err := s.post(group, "detached", url.Values{}, nil, &detached)
+	return detached, err
+}
+
+func (s *httpLeaseStore) Release(group string, holder string) error {
+	return s.post(group, "release", url.Values{"holder": {holder}}, nil, nil)
+}
+
+type leasePollResult struct {
+	Acquired bool `json:"acquired"`
+	Position int  `json:"position"`
+}
+
+type leaseRenewResult struct {
+	Held bool `json:"held"`
+}
+
+// LeaseHandler serves the queues of the concurrency groups in memory for NewHTTPLeaseStore.
+// The clients must send the secret as a bearer token, or must be on the loopback address if the secret is empty
+func LeaseHandler(secret string) http.Handler {
+	var mu sync.Mutex
+	queues := map[string]*leaseQueue{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !leaseClientAllowed(r, secret) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// /groups/{group}/{action}
+		parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+		if len(parts) != 3 || parts[0] != "groups" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		group, err := url.PathUnescape(parts[1])
+		holder := r.URL.Query().Get("holder")
+		if err != nil || (holder == "" && parts[2] != "detached") {
+			http.Error(w, "group and holder are required", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		queue, ok := queues[group]
+		if !ok {
+			queue = &leaseQueue{}
+			queues[group] = queue
+		}
+		defer func() {
+			if len(queue.Holders) == 0 && len(queue.Waiting) == 0 {
+				delete(queues, group)
+			}
+		}()
+		switch parts[2] {
+		case "poll":
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil || limit < 1 {
+				http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			var result leasePollResult
+			result.Acquired, result.Position = queue.poll(holder, limit, time.Now())
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+		case "renew":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(leaseRenewResult{Held: queue.renew(holder, time.Now())})
+		case "detach":
+			var batchRun LeasedBatchRun
+			if err := json.NewDecoder(r.Body).Decode(&batchRun); err != nil {
+				http.Error(w, "batch run is required", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(leaseRenewResult{Held: queue.detach(holder, batchRun, time.Now())})
+		case "detached":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(queue.detached(time.Now()))
+		case "release":
+			queue.release(holder)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// leaseClientAllowed checks the bearer token of the request against the secret, or the address of the client without a secret
+func leaseClientAllowed(r *http.Request, secret string) bool {
+	if secret != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Lease is a slot of a concurrency group held until Release
+type Lease struct {
+	store  LeaseStore
+	group  string
+	holder string
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// AcquireLease waits until one of the limit slots of the group is free, in the order the jobs came.
+// onQueued is called with the position in the queue whenever it changes.
+// isFinished tells whether the batch run of a detached slot has finished, which frees the slot
+func AcquireLease(ctx context.Context, store LeaseStore, group string, limit int, onQueued func(position int),
+	isFinished func(batchRun LeasedBatchRun) bool) (*Lease, error) {
+	holder, err := newLeaseHolder()
+	if err != nil {
+		return nil, err
+	}
+	lastPosition := 0
+	var lastChecked time.Time
+	for {
+		acquired, position, err := store.Poll(group, holder, limit)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+		if position != lastPosition && onQueued != nil {
+			onQueued(position)
+		}
+		lastPosition = position
+		if isFinished != nil && time.Since(lastChecked) >= detachedCheckInterval {
+			lastChecked = time.Now()
+			if freed, err := releaseFinishedLeases(store, group, isFinished); err != nil {
+				// the slots are freed by the other jobs or expire
+				fmt.Fprintf(os.Stderr, "failed to check the detached slots of concurrency group '%s': %s\n", group, err)
+			} else if freed {
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			store.Release(group, holder)
+			return nil, ctx.Err()
+		case <-time.After(leasePollInterval):
+		}
+	}
+	lease := &Lease{store: store, group: group, holder: holder, stop: make(chan struct{})}
+	go lease.heartbeat()
+	return lease, nil
+}
+
+// releaseFinishedLeases frees the detached slots whose batch runs have finished. It returns true if any is freed
+func releaseFinishedLeases(store LeaseStore, group string, isFinished func(batchRun LeasedBatchRun) bool) (bool, error) {
+	detached, err := store.Detached(group)
+	if err != nil {
+		return false, err
+	}
+	freed := false
+	for _, lease := range detached {
+		if !isFinished(lease.BatchRun) {
+			continue
+		}
+		if err := store.Release(group, lease.Holder); err != nil {
+			return freed, err
+		}
+		freed = true
+	}
+	return freed, nil
+}
+
+func (l *Lease) heartbeat() {
+	ticker := time.NewTicker(leaseHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			held, err := l.store.Renew(l.group, l.holder)
+			if err != nil {
+				// the slot is kept until it expires, so a temporary error does not matter
+				fmt.Fprintf(os.Stderr, "failed to renew the slot of concurrency group '%s': %s\n", l.group, err)
+			} else if !held {
+				fmt.Fprintf(os.Stderr, "the slot of concurrency group '%s' has expired\n", l.group)
+				return
+			}
+		}
+	}
+}
+
+// Detach keeps the slot after the job ends, until a waiting job sees the batch run finished
+func (l *Lease) Detach(batchRun LeasedBatchRun) error {
+	err := fmt.Errorf("the slot is already freed")
+	l.once.Do(func() {
+		close(l.stop)
+		var held bool
+		if held, err = l.store.Detach(l.group, l.holder, batchRun); err == nil && !held {
+			err = fmt.Errorf("the slot has expired")
+		}
+	})
+	return err
+}
+
+// Release frees the slot for the next job in the queue
+func (l *Lease) Release() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		err = l.store.Release(l.group, l.holder)
+	})
+	return err
+}
+
+func newLeaseHolder() (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random)), nil
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLeaseQueuePoll(t *testing.T) {
+	now := time.Now()
+	q := &leaseQueue{}
+	type step struct {
+		action       string // poll, release or detach
+		holder       string
+		wantAcquired bool
+		wantPosition int
+	}
+	steps := []step{
+		{"poll", "a", true, 0},
+		{"poll", "b", true, 0},
+		{"poll", "c", false, 1},
+		{"poll", "d", false, 2},
+		{"poll", "c", false, 1}, // polling again keeps the position
+		{"release", "a", false, 0},
+		{"poll", "d", false, 2}, // c came first
+		{"poll", "c", true, 0},
+		{"poll", "d", false, 1},
+		{"detach", "b", false, 0},
+		{"poll", "d", false, 1}, // the detached slot is still held
+		{"release", "b", false, 0},
+		{"poll", "d", true, 0},
+	}
+	for i, s := range steps {
+		switch s.action {
+		case "poll":
+			acquired, position := q.poll(s.holder, 2, now)
+			if acquired != s.wantAcquired || position != s.wantPosition {
+				t.Fatalf("step %d: poll(%s) = %v, %d, want %v, %d", i, s.holder, acquired, position, s.wantAcquired, s.wantPosition)
+			}
+		case "release":
+			q.release(s.holder)
+		case "detach":
+			if !q.detach(s.holder, LeasedBatchRun{BatchRunNumber: 7}, now) {
+				t.Fatalf("step %d: detach(%s) failed", i, s.holder)
+			}
+		}
+	}
+}
+
+func TestLeaseQueueExpire(t *testing.T) {
+	start := time.Now()
+	q := &leaseQueue{}
+	q.poll("crashed", 2, start)
+	q.poll("detached", 2, start)
+	q.detach("detached", LeasedBatchRun{BatchRunNumber: 7}, start)
+	q.poll("waiting", 1, start)
+
+	later := start.Add(leaseExpiry)
+	if len(q.detached(later)) != 1 {
+		t.Errorf("the detached slot must be kept after %s", leaseExpiry)
+	}
+	if acquired, position := q.poll("next", 2, later); !acquired {
+		t.Errorf("the slot of the crashed job must expire, got position %d", position)
+	}
+	if detached := q.detached(start.Add(detachedLeaseExpiry)); len(detached) != 0 {
+		t.Errorf("the detached slot must expire after %s: %v", detachedLeaseExpiry, detached)
+	}
+}
+
+func TestAcquireLeaseFreesFinishedDetachedSlot(t *testing.T) {
+	server := httptest.NewServer(LeaseHandler("secret"))
+	defer server.Close()
+	fileStore, err := NewFileLeaseStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]LeaseStore{"file": fileStore, "http": NewHTTPLeaseStore(server.URL, "secret")} {
+		t.Run(name, func(t *testing.T) {
+			first, err := AcquireLease(context.Background(), store, "group", 1, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batchRun := LeasedBatchRun{URLBase: "https://example.com", Organization: "org", Project: "project", BatchRunNumber: 7}
+			if err := first.Detach(batchRun); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			var checked []LeasedBatchRun
+			second, err := AcquireLease(ctx, store, "group", 1, nil, func(b LeasedBatchRun) bool {
+				checked = append(checked, b)
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Release()
+			if len(checked) != 1 || checked[0] != batchRun {
+				t.Errorf("checked %v, want %v", checked, batchRun)
+			}
+		})
+	}
+}
+
+func TestLeaseHandlerAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		remoteAddr string
+		token      string
+		wantStatus int
+	}{
+		{"secret", "secret", "192.0.2.1:1234", "secret", http.StatusOK},
+		{"wrong secret", "secret", "127.0.0.1:1234", "other", http.StatusUnauthorized},
+		{"no token", "secret", "127.0.0.1:1234", "", http.StatusUnauthorized},
+		{"loopback without secret", "", "127.0.0.1:1234", "", http.StatusOK},
+		{"loopback IPv6 without secret", "", "[::1]:1234", "", http.StatusOK},
+		{"remote without secret", "", "192.0.2.1:1234", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/groups/group/detached", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			LeaseHandler(tt.secret).ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const redactedValue = "[REDACTED]"
+const maxLoggedBodyBytes = 4096
+
+// sensitiveHeaderKeywords are the parts of header names whose values are never logged, recorded or printed
+var sensitiveHeaderKeywords = []string{"authorization", "token", "secret", "password", "cookie", "session", "key", "credential"}
+
+// redactHeaders are the lower case names of the headers given by SetRedactHeaders
+var redactHeaders = map[string]bool{}
+
+// SetRedactHeaders adds the headers whose values are redacted in the logs, the recorded sessions and the dry run output,
+// in addition to the ones whose names look sensitive
+func SetRedactHeaders(names []string) {
+	for _, name := range names {
+		redactHeaders[strings.ToLower(name)] = true
+	}
+}
+
+// isSensitiveHeader tells whether the value of the header must be redacted
+func isSensitiveHeader(name string) bool {
+	lowerName := strings.ToLower(name)
+	if redactHeaders[lowerName] {
+		return true
+	}
+	for _, keyword := range sensitiveHeaderKeywords {
+		if strings.Contains(lowerName, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupLogging enables logging of each HTTP request and response to w.
+// format is "text" or "json". If debug is true, headers and bodies are also logged with the sensitive headers redacted
+func SetupLogging(w io.Writer, format string, debug bool) error {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("log format must be 'text' or 'json': %s", format)
+	}
+	logger := slog.New(handler)
+	transportWrappers = append(transportWrappers, func(next http.RoundTripper) http.RoundTripper {
+		// a transport per wrap, as the requests of different transports run concurrently
+		return &loggingTransport{next: next, logger: logger}
+	})
+	return nil
+}
+
+// loggingTransport logs each HTTP request and response with secrets redacted
+type loggingTransport struct {
+	next   http.RoundTripper
+	logger *slog.Logger
+}
+
+func (t *loggingTransport) headerAttrs(header http.Header) []any {
+	attrs := []any{}
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		if isSensitiveHeader(name) {
+			value = redactedValue
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return attrs
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	debug := t.logger.Enabled(req.Context(), slog.LevelDebug)
+	if debug {
+		attrs := []any{"method", req.Method, "url", req.URL.String(), slog.Group("headers", t.headerAttrs(req.Header)...)}
+		if body := loggableRequestBody(req); body != "" {
+			attrs = append(attrs, "body", body)
+		}
+		t.logger.Debug("HTTP request", attrs...)
+	}
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		t.logger.Error("HTTP request failed", "method", req.Method, "path", req.URL.Path, "latency", latency, "error", err)
+		return res, err
+	}
+	attrs := []any{"method", req.Method, "path", req.URL.Path, "status", res.StatusCode, "latency", latency}
+	for _, name := range []string{"X-Request-Id", "X-Amzn-Trace-Id"} {
+		if requestID := res.Header.Get(name); requestID != "" {
+			attrs = append(attrs, "request_id", requestID)
+			break
+		}
+	}
+	level := slog.LevelInfo
+	if res.StatusCode >= 400 {
+		level = slog.LevelWarn
+	}
+	if debug {
+		attrs = append(attrs, slog.Group("headers", t.headerAttrs(res.Header)...))
+		if body := loggableResponseBody(res); body != "" {
+			attrs = append(attrs, "body", body)
+		}
+	}
+	t.logger.Log(req.Context(), level, "HTTP response", attrs...)
+	return res, err
+}
+
+func isTextContent(contentType string) bool {
+	return strings.Contains(contentType, "json") || strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "x-www-form-urlencoded")
+}
+
+// loggableRequestBody returns the request body if it is a small text, leaving the request readable
+func loggableRequestBody(req *http.Request) string {
+	if req.Body == nil || req.GetBody == nil || !isTextContent(req.Header.Get("Content-Type")) {
+		return ""
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	return readLimited(body)
+}
+
+// loggableResponseBody returns the response body if it is text, replacing the body with an unread copy
+func loggableResponseBody(res *http.Response) string {
+	if res.Body == nil || !isTextContent(res.Header.Get("Content-Type")) {
+		return "" // e.g. zipped screenshots
+	}
+	content, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(content))
+	if err != nil {
+		return ""
+	}
+	return readLimited(bytes.NewReader(content))
+}
+
+func readLimited(r io.Reader) string {
+	content, _ := io.ReadAll(io.LimitReader(r, maxLoggedBodyBytes+1))
+	if len(content) > maxLoggedBodyBytes {
+		return string(content[:maxLoggedBodyBytes]) + "...(truncated)"
+	}
+	return string(content)
+}
@@ -0,0 +1,24 @@
+package common
+
+import "testing"
+
+func TestIsSensitiveHeader(t *testing.T) {
+	SetRedactHeaders([]string{"X-Internal-Tenant"})
+	defer func() { redactHeaders = map[string]bool{} }()
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Authorization", true},
+		{"Set-Cookie", true},
+		{"X-Api-Key", true},
+		{"x-internal-tenant", true},
+		{"Content-Type", false},
+		{"X-Request-Id", false},
+	}
+	for _, tt := range tests {
+		if got := isSensitiveHeader(tt.name); got != tt.want {
+			t.Errorf("isSensitiveHeader(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
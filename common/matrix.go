@@ -0,0 +1,264 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// Matrix expands combinations of device/OS settings into test_settings of a cross batch run
+type Matrix struct {
+	Axes    []MatrixAxis
+	Include []map[string]interface{} // combinations added after the product of the axes
+	Exclude []map[string]interface{} // combinations matching all the keys of an entry are removed
+}
+
+// MatrixAxis is a setting key and the values to combine
+type MatrixAxis struct {
+	Name   string
+	Values []interface{}
+}
+
+// ParseMatrixFlags parses the axes in "name=value1,value2" format and include/exclude entries in "name=value,name=value" format
+func ParseMatrixFlags(axes []string, include []string, exclude []string) (*Matrix, error) {
+	matrix := &Matrix{}
+	for _, axis := range axes {
+		kv := strings.SplitN(axis, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("matrix axis must be in name=value1,value2 format: %s", axis)
+		}
+		values := []interface{}{}
+		for _, value := range strings.Split(kv[1], ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+		matrix.Axes = append(matrix.Axes, MatrixAxis{Name: strings.TrimSpace(kv[0]), Values: values})
+	}
+	for _, entries := range []struct {
+		flags  []string
+		target *[]map[string]interface{}
+	}{{include, &matrix.Include}, {exclude, &matrix.Exclude}} {
+		for _, flag := range entries.flags {
+			entry := map[string]interface{}{}
+			for _, pair := range strings.Split(flag, ",") {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+					return nil, fmt.Errorf("matrix include/exclude must be in name=value,name=value format: %s", flag)
+				}
+				entry[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+			*entries.target = append(*entries.target, entry)
+		}
+	}
+	return matrix, nil
+}
+
+// parseMatrixSetting parses the "matrix" block of a setting, e.g. {"os":["ios","android"],"exclude":[{"os":"ios"}]}
+func parseMatrixSetting(value interface{}) (*Matrix, error) {
+	block, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("matrix must be a mapping")
+	}
+	matrix := &Matrix{}
+	for _, key := range sortedKeys(block) {
+		switch key {
+		case "include", "exclude":
+			entries, ok := block[key].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("matrix.%s must be a list", key)
+			}
+			for i, entry := range entries {
+				entryMap, ok := entry.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("matrix.%s[%d] must be a mapping", key, i)
+				}
+				if key == "include" {
+					matrix.Include = append(matrix.Include, entryMap)
+				} else {
+					matrix.Exclude = append(matrix.Exclude, entryMap)
+				}
+			}
+		default:
+			values, ok := block[key].([]interface{})
+			if !ok || len(values) == 0 {
+				return nil, fmt.Errorf("matrix.%s must be a non-empty list", key)
+			}
+			matrix.Axes = append(matrix.Axes, MatrixAxis{Name: key, Values: values})
+		}
+	}
+	return matrix, nil
+}
+
+// merge adds the axes and entries of other. Axes with the same name are replaced
+func (m *Matrix) merge(other *Matrix) {
+	for _, axis := range other.Axes {
+		replaced := false
+		for i := range m.Axes {
+			if m.Axes[i].Name == axis.Name {
+				m.Axes[i] = axis
+				replaced = true
+			}
+		}
+		if !replaced {
+			m.Axes = append(m.Axes, axis)
+		}
+	}
+	m.Include = append(m.Include, other.Include...)
+	m.Exclude = append(m.Exclude, other.Exclude...)
+}
+
+// Combinations returns the product of the axes without the excluded ones, followed by the included ones
+func (m *Matrix) Combinations() []map[string]interface{} {
+	combinations := []map[string]interface{}{}
+	if len(m.Axes) > 0 {
+		combinations = append(combinations, map[string]interface{}{})
+	}
+	for _, axis := range m.Axes {
+		next := []map[string]interface{}{}
+		for _, combination := range combinations {
+			for _, value := range axis.Values {
+				extended := map[string]interface{}{axis.Name: value}
+				for k, v := range combination {
+					extended[k] = v
+				}
+				next = append(next, extended)
+			}
+		}
+		combinations = next
+	}
+	filtered := []map[string]interface{}{}
+	for _, combination := range combinations {
+		excluded := false
+		for _, exclude := range m.Exclude {
+			excluded = excluded || matchesMatrixEntry(combination, exclude)
+		}
+		if !excluded {
+			filtered = append(filtered, combination)
+		}
+	}
+	return append(filtered, m.Include...)
+}
+
+func matchesMatrixEntry(combination map[string]interface{}, entry map[string]interface{}) bool {
+	for k, v := range entry {
+		if fmt.Sprint(combination[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatMatrixCombination describes a combination like "model=iPhone 15, os=ios"
+func FormatMatrixCombination(combination map[string]interface{}) string {
+	pairs := []string{}
+	for _, key := range sortedKeys(combination) {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", key, combination[key]))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// ExpandMatrixSetting expands the "matrix" block of the setting and the given matrix (may be nil) into test_settings.
+// The other setting keys than those of a cross batch run are shared by all the expanded entries.
+// It returns the setting as is with no combination if there is no matrix
+func ExpandMatrixSetting(setting string, matrix *Matrix) (string, []map[string]interface{}, *cli.ExitError) {
+	settingMap := map[string]interface{}{}
+	if setting != "" {
+		if err := json.Unmarshal([]byte(setting), &settingMap); err != nil {
+			if matrix == nil {
+				return setting, nil, nil // leave it to the server to report
+			}
+			return "", nil, cli.NewExitError(fmt.Sprintf("setting must be a JSON object to use a matrix: %s", err), 1)
+		}
+	}
+	merged := &Matrix{}
+	if block, ok := settingMap["matrix"]; ok {
+		parsed, err := parseMatrixSetting(block)
+		if err != nil {
+			return "", nil, cli.NewExitError(err.Error(), 1)
+		}
+		merged.merge(parsed)
+		delete(settingMap, "matrix")
+	} else if matrix == nil {
+		return setting, nil, nil
+	} else if len(matrix.Axes) == 0 && len(matrix.Include) == 0 {
+		return "", nil, cli.NewExitError("matrix exclude requires matrix axes, an include or a matrix block in the setting", 1)
+	}
+	if matrix != nil {
+		merged.merge(matrix)
+	}
+	if _, ok := settingMap["test_settings"]; ok {
+		return "", nil, cli.NewExitError("matrix cannot be used with test_settings", 1)
+	}
+	combinations := merged.Combinations()
+	if len(combinations) == 0 {
+		return "", nil, cli.NewExitError("matrix expanded into no test setting", 1)
+	}
+	base := map[string]interface{}{}
+	for k, v := range settingMap {
+		if _, isCrossBatchRunKey := crossBatchRunKeys[k]; !isCrossBatchRunKey {
+			base[k] = v
+			delete(settingMap, k)
+		}
+	}
+	testSettings := []interface{}{}
+	for _, combination := range combinations {
+		entry := map[string]interface{}{}
+		for k, v := range base {
+			entry[k] = v
+		}
+		for k, v := range combination {
+			entry[k] = v
+		}
+		testSettings = append(testSettings, entry)
+	}
+	settingMap["test_settings"] = testSettings
+	settingBytes, err := json.Marshal(settingMap)
+	if err != nil {
+		return "", nil, cli.NewExitError(err.Error(), 1)
+	}
+	return string(settingBytes), combinations, nil
+}
+
+// MatrixResult is the result of the test cases run with a matrix combination
+type MatrixResult struct {
+	Combination map[string]interface{} `json:"combination"`
+	PatternName string                 `json:"pattern_name"`
+	Counts      map[string]int         `json:"counts"`
+}
+
+// MatrixResults maps the results of the batch run back to the matrix combinations.
+// The details of a cross batch run are in the same order as test_settings, so they must be as many as the combinations
+func MatrixResults(batchRun *BatchRun, combinations []map[string]interface{}) ([]MatrixResult, error) {
+	details := batchRun.TestCases.Details
+	if len(details) != len(combinations) {
+		return nil, fmt.Errorf("the batch run has %d results per test setting for %d matrix combinations", len(details), len(combinations))
+	}
+	results := []MatrixResult{}
+	for i, detail := range details {
+		result := MatrixResult{Combination: combinations[i], Counts: map[string]int{}}
+		if detail.PatternName != nil {
+			result.PatternName = *detail.PatternName
+		}
+		for _, testCase := range detail.Results {
+			result.Counts[testCase.Status]++
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// String describes the result like "os=ios, version=17.0: 3 succeeded, 1 failed"
+func (r MatrixResult) String() string {
+	statuses := make([]string, 0, len(r.Counts))
+	for status := range r.Counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	counts := []string{}
+	for _, status := range statuses {
+		counts = append(counts, fmt.Sprintf("%d %s", r.Counts[status], status))
+	}
+	return fmt.Sprintf("%s: %s", FormatMatrixCombination(r.Combination), strings.Join(counts, ", "))
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func formatCombinations(combinations []map[string]interface{}) []string {
+	formatted := []string{}
+	for _, combination := range combinations {
+		formatted = append(formatted, FormatMatrixCombination(combination))
+	}
+	return formatted
+}
+
+func TestParseMatrixFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		axes    []string
+		include []string
+		exclude []string
+		want    []string
+		wantErr bool
+	}{
+		{"product", []string{"os=ios,android", "version=1, 2"}, nil, nil, []string{"os=ios, version=1", "os=ios, version=2", "os=android, version=1", "os=android, version=2"}, false},
+		{"exclude", []string{"os=ios,android", "version=1,2"}, nil, []string{"os=ios,version=2"}, []string{"os=ios, version=1", "os=android, version=1", "os=android, version=2"}, false},
+		{"exclude by one key", []string{"os=ios,android", "version=1,2"}, nil, []string{"os=android"}, []string{"os=ios, version=1", "os=ios, version=2"}, false},
+		{"include", []string{"os=ios"}, []string{"os=android,model=Pixel 8"}, nil, []string{"os=ios", "model=Pixel 8, os=android"}, false},
+		{"include only", nil, []string{"os=ios"}, nil, []string{"os=ios"}, false},
+		{"all excluded", []string{"os=ios"}, nil, []string{"os=ios"}, []string{}, false},
+		{"axis without values", []string{"os="}, nil, nil, nil, true},
+		{"axis without name", []string{"ios,android"}, nil, nil, nil, true},
+		{"exclude without value", []string{"os=ios"}, nil, []string{"os"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matrix, err := ParseMatrixFlags(tt.axes, tt.include, tt.exclude)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMatrixFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := formatCombinations(matrix.Combinations()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Combinations() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandMatrixSetting(t *testing.T) {
+	tests := []struct {
+		name    string
+		setting string
+		axes    []string
+		exclude []string
+		want    []string // the test settings
+		wantErr bool
+	}{
+		{"no matrix", `{"os":"ios"}`, nil, nil, nil, false},
+		{"flags", `{"environment":"magic_pod","concurrency":2}`, []string{"os=ios,android"}, nil,
+			[]string{"environment=magic_pod, os=ios", "environment=magic_pod, os=android"}, false},
+		{"block", `{"environment":"magic_pod","matrix":{"os":["ios","android"],"exclude":[{"os":"ios"}]}}`, nil, nil,
+			[]string{"environment=magic_pod, os=android"}, false},
+		{"flags replace the axis of the block", `{"matrix":{"os":["ios","android"]}}`, []string{"os=ios"}, nil, []string{"os=ios"}, false},
+		{"exclude flag applies to the block", `{"matrix":{"os":["ios","android"],"version":["1","2"]}}`, nil, []string{"os=ios"},
+			[]string{"os=android, version=1", "os=android, version=2"}, false},
+		{"exclude flag without a matrix", `{"os":"ios"}`, nil, []string{"os=ios"}, nil, true},
+		{"all excluded", `{"matrix":{"os":["ios"]}}`, nil, []string{"os=ios"}, nil, true},
+		{"with test_settings", `{"test_settings":[{"os":"ios"}]}`, []string{"os=ios"}, nil, nil, true},
+		{"invalid block", `{"matrix":{"os":"ios"}}`, nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var matrix *Matrix
+			if tt.axes != nil || tt.exclude != nil {
+				var err error
+				if matrix, err = ParseMatrixFlags(tt.axes, nil, tt.exclude); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setting, combinations, exitErr := ExpandMatrixSetting(tt.setting, matrix)
+			if (exitErr != nil) != tt.wantErr {
+				t.Fatalf("ExpandMatrixSetting() error = %v, wantErr %v", exitErr, tt.wantErr)
+			}
+			if exitErr != nil {
+				return
+			}
+			if tt.want == nil {
+				if setting != tt.setting || combinations != nil {
+					t.Errorf("ExpandMatrixSetting() = %s, %v, want the setting as is", setting, combinations)
+				}
+				return
+			}
+			var expanded struct {
+				TestSettings []map[string]interface{} `json:"test_settings"`
+				Matrix       interface{}              `json:"matrix"`
+			}
+			if err := json.Unmarshal([]byte(setting), &expanded); err != nil {
+				t.Fatal(err)
+			}
+			if got := formatCombinations(expanded.TestSettings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("test_settings = %q, want %q", got, tt.want)
+			}
+			if len(combinations) != len(tt.want) {
+				t.Errorf("%d combinations, want %d", len(combinations), len(tt.want))
+			}
+			if expanded.Matrix != nil {
+				t.Errorf("matrix block is left in %s", setting)
+			}
+		})
+	}
+}
+
+func TestMatrixResults(t *testing.T) {
+	combinations := []map[string]interface{}{{"os": "ios"}, {"os": "android"}}
+	detail := func(statuses ...string) TestCaseDetail {
+		detail := TestCaseDetail{}
+		for _, status := range statuses {
+			detail.Results = append(detail.Results, TestCaseResult{Status: status})
+		}
+		return detail
+	}
+	tests := []struct {
+		name    string
+		details []TestCaseDetail
+		want    []string
+		wantErr bool
+	}{
+		{"one detail per combination", []TestCaseDetail{detail("succeeded", "failed"), detail("succeeded")},
+			[]string{"os=ios: 1 failed, 1 succeeded", "os=android: 1 succeeded"}, false},
+		{"fewer details", []TestCaseDetail{detail("succeeded")}, nil, true},
+		{"more details", []TestCaseDetail{detail("succeeded"), detail("succeeded"), detail("failed")}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batchRun := &BatchRun{TestCases: TestCasesSummary{Details: tt.details}}
+			results, err := MatrixResults(batchRun, combinations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MatrixResults() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := []string{}
+			for _, result := range results {
+				got = append(got, result.String())
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MatrixResults() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty"
+	"github.com/urfave/cli"
+)
+
+// metricFamily is a group of samples sharing one metric name in the Prometheus text exposition format
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string // gauge or counter
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels [][2]string
+	value  float64
+}
+
+func (f *metricFamily) add(value float64, labels ...string) {
+	sample := metricSample{value: value}
+	for i := 0; i+1 < len(labels); i += 2 {
+		sample.labels = append(sample.labels, [2]string{labels[i], labels[i+1]})
+	}
+	f.samples = append(f.samples, sample)
+}
+
+func (f *metricFamily) write(w io.Writer) error {
+	if len(f.samples) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+		return err
+	}
+	for _, sample := range f.samples {
+		labels := make([]string, len(sample.labels))
+		for i, label := range sample.labels {
+			labels[i] = fmt.Sprintf("%s=\"%s\"", label[0], escapeLabelValue(label[1]))
+		}
+		if _, err := fmt.Fprintf(w, "%s{%s} %s\n", f.name, strings.Join(labels, ","), strconv.FormatFloat(sample.value, 'g', -1, 64)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// WriteBatchRunMetrics writes metrics of the batch runs in the Prometheus text exposition format.
+// summaries are aggregated per test setting and branch, and latestRuns (one for each test setting,
+// may be empty) are used for the per test case metrics
+func WriteBatchRunMetrics(w io.Writer, organization string, project string, summaries []BatchRunSummary, latestRuns []*BatchRun) error {
+	runs := metricFamily{name: "magicpod_batch_runs", help: "Number of the retrieved batch runs per status.", kind: "gauge"}
+	passRate := metricFamily{name: "magicpod_batch_run_pass_rate", help: "Ratio of succeeded batch runs among the finished ones.", kind: "gauge"}
+	lastNumber := metricFamily{name: "magicpod_batch_run_last_number", help: "Number of the latest batch run.", kind: "gauge"}
+	lastFinishedNumber := metricFamily{name: "magicpod_batch_run_last_finished_number", help: "Number of the latest finished batch run.", kind: "gauge"}
+	lastDuration := metricFamily{name: "magicpod_batch_run_last_duration_seconds", help: "Duration of the latest finished batch run.", kind: "gauge"}
+	detailsNumber := metricFamily{name: "magicpod_test_case_last_batch_run_number", help: "Number of the batch run which the test case metrics are of.", kind: "gauge"}
+	lastTestCases := metricFamily{name: "magicpod_batch_run_last_test_cases", help: "Number of test cases per status in the latest batch run.", kind: "gauge"}
+	testCaseStatus := metricFamily{name: "magicpod_test_case_last_status", help: "Status of each test case in the latest batch run (1 for the current status).", kind: "gauge"}
+	testCaseDuration := metricFamily{name: "magicpod_test_case_last_duration_seconds", help: "Duration of each test case in the latest batch run.", kind: "gauge"}
+
+	type groupKey struct{ testSetting, branch string }
+	statusCounts := map[groupKey]map[string]int{}
+	latest := map[groupKey]BatchRunSummary{}
+	latestFinished := map[groupKey]BatchRunSummary{}
+	keys := []groupKey{}
+	for _, summary := range summaries {
+		key := groupKey{summary.TestSettingName, summary.BranchName}
+		if _, ok := statusCounts[key]; !ok {
+			statusCounts[key] = map[string]int{}
+			keys = append(keys, key)
+		}
+		statusCounts[key][string(summary.Status)]++
+		// summaries are in the most recent first order
+		if _, ok := latest[key]; !ok {
+			latest[key] = summary
+		}
+		if _, ok := latestFinished[key]; !ok && summary.Status != "running" && summary.DurationSeconds != nil {
+			latestFinished[key] = summary
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].testSetting != keys[j].testSetting {
+			return keys[i].testSetting < keys[j].testSetting
+		}
+		return keys[i].branch < keys[j].branch
+	})
+	for _, key := range keys {
+		base := []string{"organization", organization, "project", project, "test_setting", key.testSetting, "branch", key.branch}
+		counts := statusCounts[key]
+		statuses := make([]string, 0, len(counts))
+		for status := range counts {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			runs.add(float64(counts[status]), append(base, "status", status)...)
+		}
+		finished := 0
+		for status, count := range counts {
+			if status != "running" {
+				finished += count
+			}
+		}
+		if finished > 0 {
+			passRate.add(float64(counts["succeeded"])/float64(finished), base...)
+		}
+		lastNumber.add(float64(latest[key].BatchRunNumber), base...)
+		if summary, ok := latestFinished[key]; ok {
+			// the number is a value rather than a label, which would make a new series for every batch run
+			lastFinishedNumber.add(float64(summary.BatchRunNumber), base...)
+			lastDuration.add(*summary.DurationSeconds, base...)
+		}
+	}
+
+	for _, batchRun := range latestRuns {
+		if batchRun == nil {
+			continue
+		}
+		base := []string{"organization", organization, "project", project, "test_setting", batchRun.TestSettingName, "branch", batchRun.BranchName}
+		detailsNumber.add(float64(batchRun.BatchRunNumber), base...)
+		counter := batchRun.TestCases
+		for _, c := range []struct {
+			status string
+			count  int
+		}{{"not-running", counter.NotRunning}, {"running", counter.Running}, {"succeeded", counter.Succeeded},
+			{"failed", counter.Failed}, {"aborted", counter.Aborted}, {"unresolved", counter.Unresolved}} {
+			lastTestCases.add(float64(c.count), append(base, "status", c.status)...)
+		}
+		for _, detail := range batchRun.TestCases.Details {
+			pattern := ""
+			if detail.PatternName != nil {
+				pattern = *detail.PatternName
+			}
+			for _, result := range detail.Results {
+				labels := append(append([]string{}, base...), "pattern", pattern,
+					"test_case_number", strconv.Itoa(result.TestCase.Number), "test_case_name", result.TestCase.Name)
+				testCaseStatus.add(1, append(labels, "status", result.Status)...)
+				if result.DurationSeconds != nil {
+					testCaseDuration.add(*result.DurationSeconds, labels...)
+				}
+			}
+		}
+	}
+
+	for _, family := range []*metricFamily{&runs, &passRate, &lastNumber, &lastFinishedNumber, &lastDuration,
+		&detailsNumber, &lastTestCases, &testCaseStatus, &testCaseDuration} {
+		if err := family.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectBatchRunMetrics retrieves the recent batch runs and the latest batch run of each test setting,
+// and writes their metrics in the Prometheus text exposition format.
+// Network errors are returned rather than panicking, as the exporter keeps polling after them
+func CollectBatchRunMetrics(w io.Writer, urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, count int) *cli.ExitError {
+	return toExitError(collectBatchRunMetrics(w, urlBase, apiToken, organization, project, httpHeadersMap, count))
+}
+
+func collectBatchRunMetrics(w io.Writer, urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, count int) error {
+	res, err := getBatchRuns(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, count, 0, 0)
+	if err != nil {
+		return err
+	}
+	if err := responseError(res); err != nil {
+		return err
+	}
+	batchRuns := res.Result().(*BatchRuns)
+	latestRuns := []*BatchRun{}
+	seen := map[string]bool{}
+	for _, summary := range batchRuns.BatchRuns {
+		if summary.Status == "running" || seen[summary.TestSettingName] {
+			continue
+		}
+		seen[summary.TestSettingName] = true
+		res, err := getBatchRun(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, summary.BatchRunNumber)
+		if err != nil {
+			return err
+		}
+		if err := responseError(res); err != nil {
+			return err
+		}
+		latestRuns = append(latestRuns, res.Result().(*BatchRun))
+	}
+	return WriteBatchRunMetrics(w, organization, project, batchRuns.BatchRuns, latestRuns)
+}
+
+// PushMetrics pushes metrics in the Prometheus text exposition format to a Pushgateway compatible endpoint
+func PushMetrics(pushURL string, job string, organization string, project string, metrics string) *cli.ExitError {
+	res, err := resty.New().SetTransport(newTransport()).R().
+		SetHeader("Content-Type", "text/plain; version=0.0.4").
+		SetPathParams(map[string]string{
+			"job":          job,
+			"organization": organization,
+			"project":      project,
+		}).
+		SetBody(metrics).
+		Put(strings.TrimSuffix(pushURL, "/") + "/metrics/job/{job}/organization/{organization}/project/{project}")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if res.IsError() {
+		return cli.NewExitError(fmt.Sprintf("%s: %s", res.Status(), res.String()), 1)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteBatchRunMetrics(t *testing.T) {
+	var summaries []BatchRunSummary
+	if err := json.Unmarshal([]byte(`[
+		{"batch_run_number": 12, "test_setting_name": "smoke", "branch_name": "main", "status": "running", "test_cases": {"total": 2}},
+		{"batch_run_number": 11, "test_setting_name": "smoke", "branch_name": "main", "status": "failed", "duration_seconds": 95.5, "test_cases": {"total": 2}},
+		{"batch_run_number": 10, "test_setting_name": "smoke", "branch_name": "main", "status": "succeeded", "duration_seconds": 80, "test_cases": {"total": 2}},
+		{"batch_run_number": 9, "test_setting_name": "nightly \"all\"", "status": "succeeded", "duration_seconds": 600, "test_cases": {"total": 1}}
+	]`), &summaries); err != nil {
+		t.Fatal(err)
+	}
+	var latest BatchRun
+	if err := json.Unmarshal([]byte(`{"batch_run_number": 11, "test_setting_name": "smoke", "branch_name": "main", "status": "failed",
+		"test_cases": {"succeeded": 1, "failed": 1, "total": 2, "details": [{"pattern_name": "iPhone 15", "results": [
+			{"order": 1, "status": "succeeded", "duration_seconds": 30, "test_case": {"number": 1, "name": "login"}},
+			{"order": 2, "status": "failed", "test_case": {"number": 2, "name": "logout"}}]}]}}`), &latest); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteBatchRunMetrics(&buf, "org", "project", summaries, []*BatchRun{&latest}); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP magicpod_batch_runs Number of the retrieved batch runs per status.
+# TYPE magicpod_batch_runs gauge
+magicpod_batch_runs{organization="org",project="project",test_setting="nightly \"all\"",branch="",status="succeeded"} 1
+magicpod_batch_runs{organization="org",project="project",test_setting="smoke",branch="main",status="failed"} 1
+magicpod_batch_runs{organization="org",project="project",test_setting="smoke",branch="main",status="running"} 1
+magicpod_batch_runs{organization="org",project="project",test_setting="smoke",branch="main",status="succeeded"} 1
+# HELP magicpod_batch_run_pass_rate Ratio of succeeded batch runs among the finished ones.
+# TYPE magicpod_batch_run_pass_rate gauge
+magicpod_batch_run_pass_rate{organization="org",project="project",test_setting="nightly \"all\"",branch=""} 1
+magicpod_batch_run_pass_rate{organization="org",project="project",test_setting="smoke",branch="main"} 0.5
+# HELP magicpod_batch_run_last_number Number of the latest batch run.
+# TYPE magicpod_batch_run_last_number gauge
+magicpod_batch_run_last_number{organization="org",project="project",test_setting="nightly \"all\"",branch=""} 9
+magicpod_batch_run_last_number{organization="org",project="project",test_setting="smoke",branch="main"} 12
+# HELP magicpod_batch_run_last_finished_number Number of the latest finished batch run.
+# TYPE magicpod_batch_run_last_finished_number gauge
+magicpod_batch_run_last_finished_number{organization="org",project="project",test_setting="nightly \"all\"",branch=""} 9
+magicpod_batch_run_last_finished_number{organization="org",project="project",test_setting="smoke",branch="main"} 11
+# HELP magicpod_batch_run_last_duration_seconds Duration of the latest finished batch run.
+# TYPE magicpod_batch_run_last_duration_seconds gauge
+magicpod_batch_run_last_duration_seconds{organization="org",project="project",test_setting="nightly \"all\"",branch=""} 600
+magicpod_batch_run_last_duration_seconds{organization="org",project="project",test_setting="smoke",branch="main"} 95.5
+# HELP magicpod_test_case_last_batch_run_number Number of the batch run which the test case metrics are of.
+# TYPE magicpod_test_case_last_batch_run_number gauge
+magicpod_test_case_last_batch_run_number{organization="org",project="project",test_setting="smoke",branch="main"} 11
+# HELP magicpod_batch_run_last_test_cases Number of test cases per status in the latest batch run.
+# TYPE magicpod_batch_run_last_test_cases gauge
+magicpod_batch_run_last_test_cases{organization="org",project="project",test_setting="smoke",branch="main",status="not-running"} 0
+magicpod_batch_run_last_test_cases{organization="org",project="project",test_setting="smoke",branch="main",status="running"} 0
+magicpod_batch_run_last_test_cases{organization="org",project="project",test_setting="smoke",branch="main",status="succeeded"} 1
+magicpod_batch_run_last_test_cases{organization="org",project="project",test_setting="smoke",branch="main",status="failed"} 1
+magicpod_batch_run_last_test_cases{organization="org",project="project",test_setting="smoke",branch="main",status="aborted"} 0
+magicpod_batch_run_last_test_cases{organization="org",project="project",test_setting="smoke",branch="main",status="unresolved"} 0
+# HELP magicpod_test_case_last_status Status of each test case in the latest batch run (1 for the current status).
+# TYPE magicpod_test_case_last_status gauge
+magicpod_test_case_last_status{organization="org",project="project",test_setting="smoke",branch="main",pattern="iPhone 15",test_case_number="1",test_case_name="login",status="succeeded"} 1
+magicpod_test_case_last_status{organization="org",project="project",test_setting="smoke",branch="main",pattern="iPhone 15",test_case_number="2",test_case_name="logout",status="failed"} 1
+# HELP magicpod_test_case_last_duration_seconds Duration of each test case in the latest batch run.
+# TYPE magicpod_test_case_last_duration_seconds gauge
+magicpod_test_case_last_duration_seconds{organization="org",project="project",test_setting="smoke",branch="main",pattern="iPhone 15",test_case_number="1",test_case_name="login"} 30
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteBatchRunMetrics() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCollectBatchRunMetrics(t *testing.T) {
+	// only the latest finished run of each test setting is retrieved for the test case metrics
+	server := newBatchRunHistoryServer(t, `[
+		{"batch_run_number": 5, "test_setting_name": "smoke", "branch_name": "main", "status": "running"},
+		{"batch_run_number": 4, "test_setting_name": "smoke", "branch_name": "main", "status": "succeeded", "duration_seconds": 70},
+		{"batch_run_number": 3, "test_setting_name": "nightly", "status": "failed", "duration_seconds": 900},
+		{"batch_run_number": 2, "test_setting_name": "smoke", "branch_name": "main", "status": "failed", "duration_seconds": 60}
+	]`, map[int]string{
+		4: `{"batch_run_number": 4, "test_setting_name": "smoke", "branch_name": "main", "status": "succeeded",
+			"test_cases": {"succeeded": 1, "total": 1, "details": [{"results": [
+				{"status": "succeeded", "duration_seconds": 42, "test_case": {"number": 7, "name": "login"}}]}]}}`,
+		3: `{"batch_run_number": 3, "test_setting_name": "nightly", "status": "failed",
+			"test_cases": {"failed": 1, "total": 1, "details": [{"results": [
+				{"status": "failed", "test_case": {"number": 8, "name": "checkout"}}]}]}}`,
+	})
+	var buf bytes.Buffer
+	if exitErr := CollectBatchRunMetrics(&buf, server.URL, "token", "org", "project", map[string]string{}, 10); exitErr != nil {
+		t.Fatal(exitErr)
+	}
+	for _, want := range []string{
+		`magicpod_batch_run_pass_rate{organization="org",project="project",test_setting="smoke",branch="main"} 0.5`,
+		`magicpod_batch_run_last_number{organization="org",project="project",test_setting="smoke",branch="main"} 5`,
+		`magicpod_batch_run_last_finished_number{organization="org",project="project",test_setting="smoke",branch="main"} 4`,
+		`magicpod_batch_run_last_duration_seconds{organization="org",project="project",test_setting="nightly",branch=""} 900`,
+		`magicpod_test_case_last_batch_run_number{organization="org",project="project",test_setting="smoke",branch="main"} 4`,
+		`magicpod_test_case_last_duration_seconds{organization="org",project="project",test_setting="smoke",branch="main",pattern="",test_case_number="7",test_case_name="login"} 42`,
+		`magicpod_test_case_last_status{organization="org",project="project",test_setting="nightly",branch="",pattern="",test_case_number="8",test_case_name="checkout",status="failed"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("CollectBatchRunMetrics() output lacks %s\n%s", want, buf.String())
+		}
+	}
+}
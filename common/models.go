@@ -0,0 +1,212 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BatchRunStatus stands for the status of a batch run. The server may add new statuses, which IsKnown returns false for
+type BatchRunStatus string
+
+const (
+	BatchRunStatusRunning    BatchRunStatus = "running"
+	BatchRunStatusSucceeded  BatchRunStatus = "succeeded"
+	BatchRunStatusFailed     BatchRunStatus = "failed"
+	BatchRunStatusUnresolved BatchRunStatus = "unresolved"
+	BatchRunStatusAborted    BatchRunStatus = "aborted"
+)
+
+// IsKnown returns true if the status is one of the statuses this package knows
+func (s BatchRunStatus) IsKnown() bool {
+	return s == BatchRunStatusRunning || s.IsTerminal()
+}
+
+// IsTerminal returns true if the batch run has finished. It returns false for unknown statuses
+func (s BatchRunStatus) IsTerminal() bool {
+	switch s {
+	case BatchRunStatusSucceeded, BatchRunStatusFailed, BatchRunStatusUnresolved, BatchRunStatusAborted:
+		return true
+	}
+	return false
+}
+
+// ServerTime is a time returned by the server. It is zero for null, and is output in the same text as the server returned
+type ServerTime struct {
+	time.Time
+	raw string
+}
+
+func (t *ServerTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*t = ServerTime{}
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	// a time in an unknown format is kept as text only
+	parsed, _ := parseServerTime(value)
+	*t = ServerTime{Time: parsed, raw: value}
+	return nil
+}
+
+func (t ServerTime) MarshalJSON() ([]byte, error) {
+	if t.raw != "" {
+		return json.Marshal(t.raw)
+	}
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Format(time.RFC3339Nano))
+}
+
+func (t ServerTime) String() string {
+	if t.raw != "" {
+		return t.raw
+	}
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// UnknownFields keeps the JSON fields of a response which the model does not know, so that they are output as they are
+type UnknownFields map[string]json.RawMessage
+
+// unmarshalKeepingUnknown unmarshals data into v, a pointer to a struct without the UnmarshalJSON method,
+// and returns the fields which v does not have
+func unmarshalKeepingUnknown(data []byte, v interface{}) (UnknownFields, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	known := jsonFieldNames(reflect.TypeOf(v).Elem())
+	var unknown UnknownFields
+	for name, value := range fields {
+		if !known[name] {
+			if unknown == nil {
+				unknown = UnknownFields{}
+			}
+			unknown[name] = value
+		}
+	}
+	return unknown, nil
+}
+
+// marshalWithUnknown marshals v, a struct without the MarshalJSON method, followed by the unknown fields in name order
+func marshalWithUnknown(v interface{}, unknown UnknownFields) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(unknown) == 0 {
+		return data, err
+	}
+	names := make([]string, 0, len(unknown))
+	for name := range unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1]) // without the closing brace
+	for _, name := range names {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		encodedName, _ := json.Marshal(name)
+		buf.Write(encodedName)
+		buf.WriteByte(':')
+		buf.Write(unknown[name])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// jsonFieldNames returns the JSON names of the fields of the struct type, including those of the embedded structs
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embedded := range jsonFieldNames(field.Type) {
+				names[embedded] = true
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+func (b *BatchRun) UnmarshalJSON(data []byte) error {
+	type plain BatchRun
+	unknown, err := unmarshalKeepingUnknown(data, (*plain)(b))
+	b.Unknown = unknown
+	return err
+}
+
+func (b BatchRun) MarshalJSON() ([]byte, error) {
+	type plain BatchRun
+	return marshalWithUnknown(plain(b), b.Unknown)
+}
+
+func (b *BatchRunSummary) UnmarshalJSON(data []byte) error {
+	type plain BatchRunSummary
+	unknown, err := unmarshalKeepingUnknown(data, (*plain)(b))
+	b.Unknown = unknown
+	return err
+}
+
+func (b BatchRunSummary) MarshalJSON() ([]byte, error) {
+	type plain BatchRunSummary
+	return marshalWithUnknown(plain(b), b.Unknown)
+}
+
+func (s *TestCasesSummary) UnmarshalJSON(data []byte) error {
+	type plain TestCasesSummary
+	unknown, err := unmarshalKeepingUnknown(data, (*plain)(s))
+	s.Unknown = unknown
+	return err
+}
+
+func (s TestCasesSummary) MarshalJSON() ([]byte, error) {
+	type plain TestCasesSummary
+	return marshalWithUnknown(plain(s), s.Unknown)
+}
+
+func (d *TestCaseDetail) UnmarshalJSON(data []byte) error {
+	type plain TestCaseDetail
+	unknown, err := unmarshalKeepingUnknown(data, (*plain)(d))
+	d.Unknown = unknown
+	return err
+}
+
+func (d TestCaseDetail) MarshalJSON() ([]byte, error) {
+	type plain TestCaseDetail
+	return marshalWithUnknown(plain(d), d.Unknown)
+}
+
+func (r *TestCaseResult) UnmarshalJSON(data []byte) error {
+	type plain TestCaseResult
+	unknown, err := unmarshalKeepingUnknown(data, (*plain)(r))
+	r.Unknown = unknown
+	return err
+}
+
+func (r TestCaseResult) MarshalJSON() ([]byte, error) {
+	type plain TestCaseResult
+	return marshalWithUnknown(plain(r), r.Unknown)
+}
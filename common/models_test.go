@@ -0,0 +1,168 @@
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureOutput returns what fn writes to *file, i.e. os.Stdout or os.Stderr
+func captureOutput(t *testing.T, file **os.File, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := *file
+	*file = w
+	defer func() { *file = original }()
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+	fn()
+	w.Close()
+	return <-output
+}
+
+func assertSameJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("invalid JSON: %s\n%s", err, got)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("JSON =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBatchRunKeepsUnknownFields(t *testing.T) {
+	original := `{
+		"organization_name": "org", "project_name": "project", "batch_run_number": 8, "test_setting_name": "nightly", "branch_name": "main",
+		"status": "succeeded", "status_number": 2, "started_at": "2026-10-19 12:00:00", "finished_at": "2026-10-19T12:30:00.123456+09:00",
+		"duration_seconds": 1800.5, "url": "https://example.com/8", "retried_from": 7,
+		"test_cases": {"succeeded": 1, "total": 1, "skipped": 0, "details": [{
+			"pattern_name": null, "included_labels": ["smoke"], "excluded_labels": [], "device": {"model": "iPhone 15"},
+			"results": [{
+				"order": 1, "test_case": {"number": 3, "name": "login", "url": "https://example.com/3"}, "status": "succeeded",
+				"started_at": "2026-10-19 12:00:00", "finished_at": null, "duration_seconds": null, "data_patterns": null,
+				"video_url": "https://example.com/3.mp4"
+			}]
+		}]}
+	}`
+	var batchRun BatchRun
+	if err := json.Unmarshal([]byte(original), &batchRun); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := batchRun.Unknown["retried_from"]; !ok {
+		t.Errorf("unknown field of the batch run is not kept: %v", batchRun.Unknown)
+	}
+	if result := batchRun.TestCases.Details[0].Results[0]; batchRun.StartedAt.Time.IsZero() || !result.FinishedAt.Time.IsZero() {
+		t.Errorf("times are not parsed: %v, %v", batchRun.StartedAt, result.FinishedAt)
+	}
+	marshaled, err := json.Marshal(batchRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the known fields which were omitted, e.g. the zero counts, stay omitted
+	assertSameJSON(t, marshaled, original)
+
+	summary := `{"batch_run_number": 8, "test_setting_name": "nightly", "status": "paused", "status_number": 9, "started_at": "yesterday",
+		"finished_at": null, "duration_seconds": null, "test_cases": {"total": 1}, "url": "", "labels": ["nightly"]}`
+	var batchRunSummary BatchRunSummary
+	if err := json.Unmarshal([]byte(summary), &batchRunSummary); err != nil {
+		t.Fatal(err)
+	}
+	if batchRunSummary.Status.IsKnown() || !batchRunSummary.StartedAt.Time.IsZero() || batchRunSummary.StartedAt.String() != "yesterday" {
+		t.Errorf("unknown status or time is not kept as it is: %+v", batchRunSummary)
+	}
+	marshaled, err = json.Marshal(batchRunSummary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameJSON(t, marshaled, summary)
+}
+
+func TestWaitForBatchRunUnknownStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []string
+		waitLimit   int
+		wantErr     string
+		wantWarning int
+	}{
+		{"finishes after an unknown status", []string{"paused", "paused", "verifying", "succeeded"}, 600, "", 2},
+		{"unknown status until the wait limit", []string{"paused"}, 20, "batch run never finished (unknown status 'paused')", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCassette(t) // for sleep
+			polls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[len(tt.statuses)-1]
+				if polls < len(tt.statuses) {
+					status = tt.statuses[polls]
+				}
+				polls++
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"batch_run_number": 8, "status": "` + status + `", "test_cases": {"total": 1}}`))
+			}))
+			defer server.Close()
+
+			var result *RunResult
+			var err error
+			stderr := captureOutput(t, &os.Stderr, func() {
+				result, err = waitForBatchRun(server.URL, "token", "org", "project", map[string]string{},
+					&BatchRun{BatchRunNumber: 8, Status: BatchRunStatusRunning, TestCases: TestCasesSummary{Total: 1}},
+					WaitLimit{Seconds: tt.waitLimit}, false, waitProgress{})
+			})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("waitForBatchRun() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("waitForBatchRun() error = %v, want %s", err, tt.wantErr)
+			}
+			if result.HasFailures {
+				t.Errorf("an unknown status is counted as a failure")
+			}
+			if warnings := strings.Count(stderr, "warning: unknown batch run status"); warnings != tt.wantWarning {
+				t.Errorf("%d warnings are shown, want %d:\n%s", warnings, tt.wantWarning, stderr)
+			}
+		})
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	tests := []struct {
+		json     string
+		wantTime time.Time
+		wantJSON string
+	}{
+		{`"2026-10-19T12:00:00Z"`, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), `"2026-10-19T12:00:00Z"`},
+		{`"2026-10-19 12:00:00"`, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), `"2026-10-19 12:00:00"`},
+		{`"19/10/2026"`, time.Time{}, `"19/10/2026"`},
+		{`null`, time.Time{}, `null`},
+	}
+	for _, tt := range tests {
+		var serverTime ServerTime
+		if err := json.Unmarshal([]byte(tt.json), &serverTime); err != nil {
+			t.Fatalf("%s: %s", tt.json, err)
+		}
+		if !serverTime.Time.Equal(tt.wantTime) {
+			t.Errorf("%s is parsed as %s, want %s", tt.json, serverTime.Time, tt.wantTime)
+		}
+		if marshaled, err := json.Marshal(serverTime); err != nil || string(marshaled) != tt.wantJSON {
+			t.Errorf("%s is marshaled as %s, %v, want %s", tt.json, marshaled, err, tt.wantJSON)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+// binaryPlistMagic starts a plist in the binary format, which Xcode writes to the built bundles by default
+const binaryPlistMagic = "bplist00"
+
+// binaryPlist reads the objects of a binary plist.
+// The format is a header, the objects, a table of the object offsets and a trailer of 32 bytes
+type binaryPlist struct {
+	content       []byte
+	offsets       []uint64
+	objectRefSize int
+}
+
+// binaryPlistString returns the string value of the key in the top level dictionary of the binary plist,
+// or "" if there is no such key
+func binaryPlistString(content []byte, key string) (string, error) {
+	p, top, err := parseBinaryPlist(content)
+	if err != nil {
+		return "", err
+	}
+	keys, values, err := p.dict(top)
+	if err != nil {
+		return "", err
+	}
+	for i, keyRef := range keys {
+		k, err := p.string(keyRef)
+		if err != nil {
+			return "", err
+		}
+		if k == key {
+			return p.string(values[i])
+		}
+	}
+	return "", nil
+}
+
+func parseBinaryPlist(content []byte) (*binaryPlist, uint64, error) {
+	if len(content) < len(binaryPlistMagic)+32 {
+		return nil, 0, fmt.Errorf("the binary plist is truncated")
+	}
+	trailer := content[len(content)-32:]
+	offsetSize := int(trailer[6])
+	p := &binaryPlist{content: content, objectRefSize: int(trailer[7])}
+	numObjects := binary.BigEndian.Uint64(trailer[8:16])
+	top := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+	if offsetSize < 1 || offsetSize > 8 || p.objectRefSize < 1 || p.objectRefSize > 8 || top >= numObjects ||
+		tableOffset > uint64(len(content)-32) || numObjects > (uint64(len(content)-32)-tableOffset)/uint64(offsetSize) {
+		return nil, 0, fmt.Errorf("the binary plist has an invalid trailer")
+	}
+	p.offsets = make([]uint64, numObjects)
+	for i := range p.offsets {
+		start := tableOffset + uint64(i*offsetSize)
+		p.offsets[i] = readUint(content[start : start+uint64(offsetSize)])
+	}
+	return p, top, nil
+}
+
+func readUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// object returns the marker of the object, the number of its elements (characters for a string) and the offset of its data
+func (p *binaryPlist) object(ref uint64) (byte, uint64, uint64, error) {
+	if ref >= uint64(len(p.offsets)) || p.offsets[ref] >= uint64(len(p.content)) {
+		return 0, 0, 0, fmt.Errorf("the binary plist has an invalid object reference")
+	}
+	offset := p.offsets[ref]
+	marker := p.content[offset]
+	count := uint64(marker & 0x0f)
+	offset++
+	if count == 0x0f {
+		// a larger count follows as an integer object
+		if offset >= uint64(len(p.content)) || p.content[offset]&0xf0 != 0x10 {
+			return 0, 0, 0, fmt.Errorf("the binary plist has an invalid object length")
+		}
+		size := uint64(1) << (p.content[offset] & 0x0f)
+		if size > 8 || offset+1+size > uint64(len(p.content)) {
+			return 0, 0, 0, fmt.Errorf("the binary plist has an invalid object length")
+		}
+		count = readUint(p.content[offset+1 : offset+1+size])
+		offset += 1 + size
+	}
+	return marker >> 4, count, offset, nil
+}
+
+func (p *binaryPlist) dict(ref uint64) ([]uint64, []uint64, error) {
+	kind, count, offset, err := p.object(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := uint64(p.objectRefSize)
+	if kind != 0xd || count > (uint64(len(p.content))-offset)/size/2 {
+		return nil, nil, fmt.Errorf("the binary plist has no dictionary at the top level")
+	}
+	keys := make([]uint64, count)
+	values := make([]uint64, count)
+	for i := uint64(0); i < count; i++ {
+		keys[i] = readUint(p.content[offset+i*size : offset+(i+1)*size])
+		values[i] = readUint(p.content[offset+(count+i)*size : offset+(count+i+1)*size])
+	}
+	return keys, values, nil
+}
+
+// string returns the ASCII or UTF-16 string object, or "" for an object of another type
+func (p *binaryPlist) string(ref uint64) (string, error) {
+	kind, count, offset, err := p.object(ref)
+	if err != nil {
+		return "", err
+	}
+	available := uint64(len(p.content)) - offset
+	switch kind {
+	case 0x5:
+		if count > available {
+			return "", fmt.Errorf("the binary plist has a truncated string")
+		}
+		return string(p.content[offset : offset+count]), nil
+	case 0x6:
+		if count > available/2 {
+			return "", fmt.Errorf("the binary plist has a truncated string")
+		}
+		units := make([]uint16, count)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(p.content[offset+uint64(2*i):])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,207 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// conditions of ExitPolicy.FailOn
+const (
+	FailOnFailed     = "failed"
+	FailOnAborted    = "aborted"
+	FailOnUnresolved = "unresolved"
+	FailOnTimeout    = "timeout"
+)
+
+// ExitPolicy decides the exit code of a finished wait for a batch run.
+// DefaultExitPolicy gives the same exit codes as the earlier versions: 1 for failures, aborts, timeouts and errors, and 2 for unresolved
+type ExitPolicy struct {
+	FailOn          []string // conditions which make the exit code non-zero
+	MaxFailures     int      // failed test cases allowed before "failed" applies
+	MinPassRate     float64  // ratio of succeeded test cases required. 0 means no requirement
+	IgnorePatterns  []string // pattern names of a cross batch run whose test cases do not count
+	TimeoutExitCode int
+	ErrorExitCode   int // for errors of the API or the network, as opposed to test failures
+}
+
+// ExitDecision is the exit code chosen by ExitPolicy with the reasons for it
+type ExitDecision struct {
+	Code    int
+	Reasons []string
+}
+
+func (d ExitDecision) String() string {
+	return fmt.Sprintf("exit code %d: %s", d.Code, strings.Join(d.Reasons, "; "))
+}
+
+// DefaultExitPolicy returns the policy used when no option is given
+func DefaultExitPolicy() *ExitPolicy {
+	return &ExitPolicy{
+		FailOn:          []string{FailOnFailed, FailOnAborted, FailOnUnresolved, FailOnTimeout},
+		TimeoutExitCode: 1,
+		ErrorExitCode:   1,
+	}
+}
+
+// ParseFailOn parses comma separated conditions of --fail_on
+func ParseFailOn(value string) ([]string, error) {
+	conditions := []string{}
+	for _, condition := range strings.Split(value, ",") {
+		condition = strings.TrimSpace(condition)
+		switch condition {
+		case "":
+			continue
+		case FailOnFailed, FailOnAborted, FailOnUnresolved, FailOnTimeout:
+			conditions = append(conditions, condition)
+		default:
+			return nil, fmt.Errorf("unknown condition '%s'. it must be one of failed, aborted, unresolved and timeout", condition)
+		}
+	}
+	return conditions, nil
+}
+
+func (p *ExitPolicy) failsOn(condition string) bool {
+	for _, c := range p.FailOn {
+		if c == condition {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ExitPolicy) ignores(patternName *string) bool {
+	if patternName == nil {
+		return false
+	}
+	for _, ignored := range p.IgnorePatterns {
+		if ignored == *patternName {
+			return true
+		}
+	}
+	return false
+}
+
+// testCaseCounts counts the test cases which the policy takes into account
+type testCaseCounts struct {
+	succeeded, failed, aborted, unresolved int
+}
+
+// countTestCases counts the test cases except those of the ignored patterns.
+// The second return value is false if the ignored patterns could not be applied since the batch run has no results per pattern
+func (p *ExitPolicy) countTestCases(batchRun *BatchRun) (testCaseCounts, bool) {
+	summary := batchRun.TestCases
+	all := testCaseCounts{succeeded: summary.Succeeded, failed: summary.Failed, aborted: summary.Aborted, unresolved: summary.Unresolved}
+	if len(p.IgnorePatterns) == 0 {
+		return all, true
+	}
+	if len(summary.Details) == 0 {
+		return all, false
+	}
+	counts := testCaseCounts{}
+	for _, detail := range summary.Details {
+		if p.ignores(detail.PatternName) {
+			continue
+		}
+		for _, result := range detail.Results {
+			switch BatchRunStatus(result.Status) {
+			case BatchRunStatusSucceeded:
+				counts.succeeded++
+			case BatchRunStatusFailed:
+				counts.failed++
+			case BatchRunStatusAborted:
+				counts.aborted++
+			case BatchRunStatusUnresolved:
+				counts.unresolved++
+			}
+		}
+	}
+	return counts, true
+}
+
+// Evaluate decides the exit code from the result of RunBatchRun or WaitForBatchRun and the error returned with it.
+// When several conditions apply, errors come first, then timeouts, failures and unresolved test cases
+func (p *ExitPolicy) Evaluate(result *RunResult, exitErr *cli.ExitError) ExitDecision {
+	if result == nil || result.BatchRun == nil {
+		message := "the batch run could not be started"
+		if exitErr != nil {
+			message = exitErr.Error()
+		}
+		return ExitDecision{Code: p.ErrorExitCode, Reasons: []string{message}}
+	}
+	batchRun := result.BatchRun
+	if !result.TimedOut && !batchRun.Status.IsTerminal() {
+		// WaitForBatchRun gives up when it fails to get the status
+		message := "the status of the batch run could not be retrieved"
+		if exitErr != nil {
+			message = exitErr.Error()
+		}
+		return ExitDecision{Code: p.ErrorExitCode, Reasons: []string{message}}
+	}
+
+	decision := ExitDecision{}
+	violate := func(code int, format string, args ...interface{}) {
+		if decision.Code == 0 {
+			decision.Code = code
+		}
+		decision.Reasons = append(decision.Reasons, fmt.Sprintf(format, args...))
+	}
+	note := func(format string, args ...interface{}) {
+		decision.Reasons = append(decision.Reasons, fmt.Sprintf(format, args...))
+	}
+
+	if result.TimedOut {
+		if p.failsOn(FailOnTimeout) {
+			violate(p.TimeoutExitCode, "the wait limit passed before the batch run finished")
+		} else {
+			note("the wait limit passed, which is not in --fail_on")
+		}
+	}
+	counts, patternsApplied := p.countTestCases(batchRun)
+	if !patternsApplied {
+		note("the batch run has no results per pattern, so --ignore_pattern is not applied")
+	}
+	ignoring := len(p.IgnorePatterns) > 0 && patternsApplied
+	if p.failsOn(FailOnFailed) {
+		if counts.failed > p.MaxFailures {
+			if p.MaxFailures > 0 {
+				violate(1, "%s exceed --max_failures %d", testCases(counts.failed, "failed"), p.MaxFailures)
+			} else {
+				violate(1, "%s", testCases(counts.failed, "failed"))
+			}
+		} else if counts.failed > 0 {
+			note("%s within --max_failures %d", testCases(counts.failed, "failed"), p.MaxFailures)
+		} else if batchRun.Status == BatchRunStatusFailed && batchRun.TestCases.Failed == 0 {
+			violate(1, "the batch run failed")
+		}
+	}
+	if p.failsOn(FailOnAborted) && batchRun.Status == BatchRunStatusAborted && (!ignoring || counts.aborted > 0) {
+		violate(1, "the batch run was aborted")
+	}
+	// over the finished test cases, so that the running ones at timeout do not lower it
+	if finished := counts.succeeded + counts.failed + counts.aborted + counts.unresolved; p.MinPassRate > 0 && finished > 0 {
+		passRate := float64(counts.succeeded) / float64(finished)
+		if passRate < p.MinPassRate {
+			violate(1, "pass rate %.3f is below --min_pass_rate %.3f", passRate, p.MinPassRate)
+		}
+	}
+	if counts.unresolved > 0 {
+		if p.failsOn(FailOnUnresolved) {
+			violate(2, "%s", testCases(counts.unresolved, "unresolved"))
+		} else {
+			note("%s, which is not in --fail_on", testCases(counts.unresolved, "unresolved"))
+		}
+	}
+	if ignoring && (counts.failed != batchRun.TestCases.Failed || counts.unresolved != batchRun.TestCases.Unresolved) {
+		note("the test cases of %s are ignored", strings.Join(p.IgnorePatterns, ", "))
+	}
+	return decision
+}
+
+func testCases(count int, status string) string {
+	if count == 1 {
+		return fmt.Sprintf("1 %s test case", status)
+	}
+	return fmt.Sprintf("%d %s test cases", count, status)
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func patternDetail(name string, statuses ...BatchRunStatus) TestCaseDetail {
+	detail := TestCaseDetail{PatternName: &name}
+	for _, status := range statuses {
+		detail.Results = append(detail.Results, TestCaseResult{Status: string(status)})
+	}
+	return detail
+}
+
+func TestExitPolicyEvaluate(t *testing.T) {
+	succeeded := &BatchRun{Status: BatchRunStatusSucceeded, TestCases: TestCasesSummary{Succeeded: 4, Total: 4}}
+	failed := &BatchRun{Status: BatchRunStatusFailed, TestCases: TestCasesSummary{Succeeded: 2, Failed: 2, Total: 4}}
+	unresolved := &BatchRun{Status: BatchRunStatusUnresolved, TestCases: TestCasesSummary{Succeeded: 3, Unresolved: 1, Total: 4}}
+	aborted := &BatchRun{Status: BatchRunStatusAborted, TestCases: TestCasesSummary{Succeeded: 3, Aborted: 1, Total: 4}}
+	// 1 failed and 1 succeeded of 4 when the wait timed out
+	running := &BatchRun{Status: BatchRunStatusRunning, TestCases: TestCasesSummary{Succeeded: 1, Failed: 1, Running: 1, NotRunning: 1, Total: 4}}
+	timedOutPassing := &BatchRun{Status: BatchRunStatusRunning, TestCases: TestCasesSummary{Succeeded: 2, Running: 2, Total: 4}}
+	withPatterns := &BatchRun{Status: BatchRunStatusFailed, TestCases: TestCasesSummary{Succeeded: 2, Failed: 1, Unresolved: 1, Total: 4,
+		Details: []TestCaseDetail{
+			patternDetail("iPhone", BatchRunStatusSucceeded, BatchRunStatusSucceeded),
+			patternDetail("experimental", BatchRunStatusFailed, BatchRunStatusUnresolved),
+		}}}
+
+	policy := func(modify func(p *ExitPolicy)) *ExitPolicy {
+		p := DefaultExitPolicy()
+		if modify != nil {
+			modify(p)
+		}
+		return p
+	}
+	tests := []struct {
+		name     string
+		policy   *ExitPolicy
+		result   *RunResult
+		exitErr  *cli.ExitError
+		wantCode int
+	}{
+		{"succeeded", policy(nil), &RunResult{BatchRun: succeeded}, nil, 0},
+		{"failed", policy(nil), &RunResult{BatchRun: failed, HasFailures: true}, nil, 1},
+		{"unresolved", policy(nil), &RunResult{BatchRun: unresolved, HasUnresolved: true}, nil, 2},
+		{"aborted", policy(nil), &RunResult{BatchRun: aborted}, nil, 1},
+		{"unresolved not in fail_on", policy(func(p *ExitPolicy) { p.FailOn = []string{FailOnFailed} }), &RunResult{BatchRun: unresolved}, nil, 0},
+		{"failures within max_failures", policy(func(p *ExitPolicy) { p.MaxFailures = 2 }), &RunResult{BatchRun: failed}, nil, 0},
+		{"failures over max_failures", policy(func(p *ExitPolicy) { p.MaxFailures = 1 }), &RunResult{BatchRun: failed}, nil, 1},
+		{"pass rate met", policy(func(p *ExitPolicy) { p.MaxFailures = 2; p.MinPassRate = 0.5 }), &RunResult{BatchRun: failed}, nil, 0},
+		{"pass rate not met", policy(func(p *ExitPolicy) { p.MaxFailures = 2; p.MinPassRate = 0.75 }), &RunResult{BatchRun: failed}, nil, 1},
+		{"ignored pattern", policy(func(p *ExitPolicy) { p.IgnorePatterns = []string{"experimental"} }), &RunResult{BatchRun: withPatterns}, nil, 0},
+		{"other pattern ignored", policy(func(p *ExitPolicy) { p.IgnorePatterns = []string{"iPhone"} }), &RunResult{BatchRun: withPatterns}, nil, 1},
+		{"timeout", policy(nil), &RunResult{BatchRun: timedOutPassing, TimedOut: true}, nil, 1},
+		{"timeout exit code", policy(func(p *ExitPolicy) { p.TimeoutExitCode = 3 }), &RunResult{BatchRun: running, TimedOut: true}, nil, 3},
+		{"timeout not in fail_on", policy(func(p *ExitPolicy) { p.FailOn = []string{FailOnFailed} }), &RunResult{BatchRun: timedOutPassing, TimedOut: true}, nil, 0},
+		{"pass rate counts only finished test cases at timeout",
+			policy(func(p *ExitPolicy) { p.FailOn = []string{FailOnFailed}; p.MinPassRate = 0.9 }), &RunResult{BatchRun: timedOutPassing, TimedOut: true}, nil, 0},
+		{"failures at timeout", policy(func(p *ExitPolicy) { p.FailOn = []string{FailOnFailed} }), &RunResult{BatchRun: running, TimedOut: true}, nil, 1},
+		{"error", policy(func(p *ExitPolicy) { p.ErrorExitCode = 4 }), nil, cli.NewExitError("500 Internal Server Error", 1), 4},
+		{"status not retrieved", policy(func(p *ExitPolicy) { p.ErrorExitCode = 4 }), &RunResult{BatchRun: running}, cli.NewExitError("502 Bad Gateway", 1), 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := tt.policy.Evaluate(tt.result, tt.exitErr)
+			if decision.Code != tt.wantCode {
+				t.Errorf("Evaluate() = %s, want exit code %d", decision, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// FindIdempotentBatchRun returns the number of the batch run started with the idempotency key, the test settings, the branch and
+// the same setting on this machine (or with the same MAGICPOD_STATE_DIR), or 0 if there is none
+func FindIdempotentBatchRun(organization string, project string, key string, testSettingsNumber int, branchName string, setting string) (int, error) {
+	state, err := loadLocalState()
+	if err != nil {
+		return 0, err
+	}
+	hash := settingHash(setting)
+	for i := len(state.IdempotencyKeys) - 1; i >= 0; i-- {
+		record := state.IdempotencyKeys[i]
+		if record.Organization == organization && record.Project == project && record.Key == key &&
+			record.TestSettingsNumber == testSettingsNumber && record.BranchName == branchName && record.SettingHash == hash &&
+			time.Since(record.RecordedAt) < localStateRetention {
+			return record.BatchRunNumber, nil
+		}
+	}
+	return 0, nil
+}
+
+// RecordIdempotencyKey remembers the batch run started with the idempotency key for FindIdempotentBatchRun
+func RecordIdempotencyKey(organization string, project string, key string, testSettingsNumber int, branchName string, setting string,
+	batchRunNumber int) error {
+	return updateLocalState(func(state *localState) {
+		state.IdempotencyKeys = append(state.IdempotencyKeys, idempotencyKey{
+			Organization:       organization,
+			Project:            project,
+			Key:                key,
+			TestSettingsNumber: testSettingsNumber,
+			BranchName:         branchName,
+			SettingHash:        settingHash(setting),
+			BatchRunNumber:     batchRunNumber,
+			RecordedAt:         time.Now(),
+		})
+	})
+}
+
+// settingHash returns the SHA-256 of the setting, normalized when it is JSON so that the formatting and the order of the keys do not matter
+func settingHash(setting string) string {
+	content := []byte(setting)
+	var value interface{}
+	if json.Unmarshal(content, &value) == nil {
+		if normalized, err := json.Marshal(value); err == nil {
+			content = normalized
+		}
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// FindRunningBatchRun returns the most recent running batch run of the test setting and the branch, or nil if there is none.
+// The batch runs started in the last 7 days are looked into, and the branch is checked on the details of the candidates
+func FindRunningBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	testSettingName string, branchName string) (*BatchRun, *cli.ExitError) {
+	batchRun, err := findRunningBatchRun(context.Background(), urlBase, apiToken, organization, project, httpHeadersMap, testSettingName, branchName)
+	return batchRun, toExitError(err)
+}
+
+func findRunningBatchRun(ctx context.Context, urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	testSettingName string, branchName string) (*BatchRun, error) {
+	// no batch run runs longer than the local state is kept
+	since := time.Now().Add(-localStateRetention)
+	// no filter is given, so that the scan stops at the first old batch run of any test setting.
+	// A batch run which has not started yet has no start time
+	for summary, err := range BatchRunsSeq(ctx, urlBase, apiToken, organization, project, httpHeadersMap, BatchRunsOptions{}) {
+		if err != nil {
+			return nil, err
+		}
+		if startedAt := summary.StartedAt.Time; !startedAt.IsZero() && startedAt.Before(since) {
+			return nil, nil
+		}
+		if summary.TestSettingName != testSettingName || summary.Status.IsTerminal() {
+			continue
+		}
+		batchRun, err := getBatchRunResult(ctx, urlBase, apiToken, organization, project, httpHeadersMap, summary.BatchRunNumber)
+		if err != nil {
+			return nil, err
+		}
+		// the default branch must not match the others, while the filter ignores an empty branch name
+		if !batchRun.Status.IsTerminal() && batchRun.BranchName == branchName {
+			return batchRun, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,167 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindIdempotentBatchRun(t *testing.T) {
+	t.Setenv("MAGICPOD_STATE_DIR", t.TempDir())
+	setting := `{"app_file_number": 3, "model": "iPhone 15"}`
+	if err := RecordIdempotencyKey("org", "project", "sha", 1, "main", setting, 7); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name               string
+		organization       string
+		project            string
+		key                string
+		testSettingsNumber int
+		branchName         string
+		setting            string
+		want               int
+	}{
+		{"same request", "org", "project", "sha", 1, "main", setting, 7},
+		{"setting formatted differently", "org", "project", "sha", 1, "main", `{"model":"iPhone 15","app_file_number":3}`, 7},
+		{"other organization", "other", "project", "sha", 1, "main", setting, 0},
+		{"other project", "org", "other", "sha", 1, "main", setting, 0},
+		{"other key", "org", "project", "other", 1, "main", setting, 0},
+		{"other test settings", "org", "project", "sha", 2, "main", setting, 0},
+		{"other branch", "org", "project", "sha", 1, "", setting, 0},
+		{"other setting", "org", "project", "sha", 1, "main", `{"app_file_number": 4, "model": "iPhone 15"}`, 0},
+	}
+	for _, tt := range tests {
+		got, err := FindIdempotentBatchRun(tt.organization, tt.project, tt.key, tt.testSettingsNumber, tt.branchName, tt.setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: FindIdempotentBatchRun() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindIdempotentBatchRunExpires(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MAGICPOD_STATE_DIR", dir)
+	state := localState{IdempotencyKeys: []idempotencyKey{
+		{Organization: "org", Project: "project", Key: "old", SettingHash: settingHash(""), BatchRunNumber: 1,
+			RecordedAt: time.Now().Add(-localStateRetention - time.Minute)},
+		{Organization: "org", Project: "project", Key: "new", SettingHash: settingHash(""), BatchRunNumber: 2,
+			RecordedAt: time.Now().Add(-localStateRetention + time.Minute)},
+	}}
+	content, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]int{"old": 0, "new": 2} {
+		if got, err := FindIdempotentBatchRun("org", "project", key, 0, "", ""); err != nil || got != want {
+			t.Errorf("FindIdempotentBatchRun(%s) = %d, %v, want %d", key, got, err, want)
+		}
+	}
+
+	// the expired record is dropped when the state is saved next
+	if err := RecordIdempotencyKey("org", "project", "another", 0, "", "", 3); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadLocalState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range saved.IdempotencyKeys {
+		if record.Key == "old" {
+			t.Errorf("the expired record is kept")
+		}
+	}
+}
+
+func TestFindRunningBatchRun(t *testing.T) {
+	now := time.Now().UTC()
+	startedAt := func(ago time.Duration) string { return now.Add(-ago).Format(time.RFC3339) }
+	// batch runs #250 to #1, most recent first. The pages have 100 batch runs at most
+	type batchRun struct {
+		status          string
+		testSettingName string
+		branchName      string
+		startedAt       string
+	}
+	batchRuns := map[int]batchRun{}
+	for number := 1; number <= 250; number++ {
+		batchRuns[number] = batchRun{"succeeded", "other", "main", startedAt(time.Duration(251-number) * time.Minute)}
+	}
+	tests := []struct {
+		name       string
+		candidates map[int]batchRun
+		branchName string
+		want       int
+	}{
+		{"running on the first page", map[int]batchRun{240: {"running", "smoke", "main", startedAt(time.Hour)}}, "main", 240},
+		{"running beyond the first page", map[int]batchRun{20: {"running", "smoke", "main", startedAt(time.Hour)}}, "main", 20},
+		{"not started yet", map[int]batchRun{249: {"not-running", "smoke", "main", ""}}, "main", 249},
+		{"most recent one", map[int]batchRun{200: {"running", "smoke", "main", ""}, 100: {"running", "smoke", "main", ""}}, "main", 200},
+		{"other branch", map[int]batchRun{240: {"running", "smoke", "feature", startedAt(time.Hour)}}, "main", 0},
+		{"default branch", map[int]batchRun{240: {"running", "smoke", "feature", startedAt(time.Hour)}}, "", 0},
+		{"finished", map[int]batchRun{240: {"failed", "smoke", "main", startedAt(time.Hour)}}, "main", 0},
+		{"started too long ago", map[int]batchRun{
+			150: {"succeeded", "other", "main", startedAt(localStateRetention + time.Hour)},
+			100: {"running", "smoke", "main", ""}, // not reached
+		}, "main", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			find := func(number int) batchRun {
+				if candidate, ok := tt.candidates[number]; ok {
+					return candidate
+				}
+				return batchRuns[number]
+			}
+			body := func(number int) string {
+				b := find(number)
+				return fmt.Sprintf(`{"batch_run_number": %d, "status": "%s", "test_setting_name": "%s", "branch_name": "%s", "started_at": "%s"}`,
+					number, b.status, b.testSettingName, b.branchName, b.startedAt)
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if strings.HasSuffix(r.URL.Path, "/batch-runs/") {
+					count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+					max, err := strconv.Atoi(r.URL.Query().Get("max_batch_run_number"))
+					if err != nil {
+						max = 250
+					}
+					entries := []string{}
+					for number := max; number >= 1 && len(entries) < count; number-- {
+						entries = append(entries, body(number))
+					}
+					fmt.Fprintf(w, `{"batch_runs": [%s]}`, strings.Join(entries, ","))
+					return
+				}
+				number, _ := strconv.Atoi(strings.TrimSuffix(r.URL.Path[strings.LastIndex(strings.TrimSuffix(r.URL.Path, "/"), "/")+1:], "/"))
+				w.Write([]byte(body(number)))
+			}))
+			defer server.Close()
+
+			got, exitErr := FindRunningBatchRun(server.URL, "token", "org", "project", map[string]string{}, "smoke", tt.branchName)
+			if exitErr != nil {
+				t.Fatal(exitErr)
+			}
+			gotNumber := 0
+			if got != nil {
+				gotNumber = got.BatchRunNumber
+			}
+			if gotNumber != tt.want {
+				t.Errorf("batch run #%d is found, want #%d", gotNumber, tt.want)
+			}
+		})
+	}
+}
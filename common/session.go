@@ -0,0 +1,50 @@
+package common
+
+import "context"
+
+// Session is a project of the Web API accessed with an API token. Its methods return error, which is *APIError
+// for an error response, instead of *cli.ExitError of the command, so that the magicpod package can convert it
+type Session struct {
+	URLBase      string
+	APIToken     string
+	Organization string
+	Project      string
+	Headers      map[string]string
+}
+
+// UploadApp uploads an app/ipa/apk file, or a zipped .app directory, and returns its file number
+func (s *Session) UploadApp(appPath string) (int, error) {
+	return uploadApp(s.URLBase, s.APIToken, s.Organization, s.Project, s.Headers, appPath)
+}
+
+// DeleteApp deletes an uploaded app file
+func (s *Session) DeleteApp(appFileNumber int) error {
+	return deleteApp(s.URLBase, s.APIToken, s.Organization, s.Project, s.Headers, appFileNumber)
+}
+
+// StartBatchRun starts a batch run or a cross batch run
+func (s *Session) StartBatchRun(testSettingsNumber int, branchName string, setting string) (*BatchRun, error) {
+	return startBatchRun(s.URLBase, s.APIToken, s.Organization, s.Project, s.Headers, testSettingsNumber, branchName, setting)
+}
+
+// GetBatchRun retrieves the current state of a batch run
+func (s *Session) GetBatchRun(batchRunNumber int) (*BatchRun, error) {
+	return getBatchRunResult(context.Background(), s.URLBase, s.APIToken, s.Organization, s.Project, s.Headers, batchRunNumber)
+}
+
+// WaitForBatchRun waits for the completion of the batch run like the function WaitForBatchRun
+func (s *Session) WaitForBatchRun(batchRun *BatchRun, waitLimit WaitLimit, printResult bool) (*RunResult, error) {
+	return waitForBatchRun(s.URLBase, s.APIToken, s.Organization, s.Project, s.Headers, batchRun, waitLimit, printResult, waitProgress{})
+}
+
+// RunBatchRun starts a batch run and, if waitForResult is true, waits for its completion like the function RunBatchRun
+func (s *Session) RunBatchRun(testSettingsNumber int, branchName string, setting string,
+	waitForResult bool, waitLimit WaitLimit, printResult bool) (*RunResult, error) {
+	return runBatchRun(s.URLBase, s.APIToken, s.Organization, s.Project, s.Headers, testSettingsNumber, branchName, setting,
+		waitForResult, waitLimit, printResult)
+}
+
+// CallAPI sends a request to any endpoint and returns the response body, also for an error response
+func (s *Session) CallAPI(apiRequest APIRequest) ([]byte, error) {
+	return callAPI(s.URLBase, s.APIToken, s.Organization, s.Project, s.Headers, apiRequest)
+}
@@ -0,0 +1,393 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// keys of a batch run setting, i.e. of the top level of a single batch run or each entry of test_settings
+var settingKeys = map[string]string{
+	"environment":     "string",
+	"os":              "string",
+	"device_type":     "string",
+	"version":         "string",
+	"model":           "string",
+	"app_type":        "string",
+	"app_url":         "url",
+	"app_file_number": "number",
+	"branch_name":     "string",
+}
+
+// keys only allowed at the top level of a cross batch run setting
+var crossBatchRunKeys = map[string]string{
+	"test_settings":        "list",
+	"test_settings_number": "number",
+	"test_settings_name":   "string",
+	"concurrency":          "number",
+	"branch_name":          "string",
+}
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// LoadSettingFile reads a batch run setting from a YAML or JSON file and returns it as a JSON string.
+// ${ENV} (or ${ENV:-default}) is replaced by the environment variable, and {{ .Var }} by vars, in the string values after parsing.
+// An unquoted value is typed by the substituted text, e.g. a number, and the numbers of the known keys given as text are sent as numbers.
+// An unquoted number of "version" is sent as the text as written.
+// Files listed in the top level "include" key are loaded first and the file is overlaid on them.
+// A "matrix" block is kept to be expanded by ExpandMatrixSetting.
+// Keys known to the Web API are validated, and unknown keys are returned as warnings
+func LoadSettingFile(path string, vars map[string]string) (string, []string, *cli.ExitError) {
+	setting, err := loadSettingMap(path, vars, map[string]bool{})
+	if err != nil {
+		return "", nil, cli.NewExitError(fmt.Sprintf("failed to load %s: %s", path, err), 1)
+	}
+	warnings, errs := ValidateSetting(setting)
+	if len(errs) > 0 {
+		return "", warnings, cli.NewExitError(fmt.Sprintf("invalid setting in %s:\n  %s", path, strings.Join(errs, "\n  ")), 1)
+	}
+	normalizeSettingNumbers(setting)
+	settingBytes, err := json.Marshal(setting)
+	if err != nil {
+		return "", warnings, cli.NewExitError(err.Error(), 1)
+	}
+	return string(settingBytes), warnings, nil
+}
+
+func loadSettingMap(path string, vars map[string]string, loading map[string]bool) (map[string]interface{}, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if loading[absPath] {
+		return nil, fmt.Errorf("%s is included recursively", path)
+	}
+	loading[absPath] = true
+	defer delete(loading, absPath)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var document yaml.Node
+	// YAML is a superset of JSON, so JSON files are parsed as well
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, settingParseError(path, content, err)
+	}
+	if err := expandSettingVariables(&document, vars); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	quoteSettingVersions(&document)
+	var parsed interface{}
+	if document.Kind != 0 {
+		if err := document.Decode(&parsed); err != nil {
+			return nil, settingParseError(path, content, err)
+		}
+	}
+	if parsed == nil {
+		parsed = map[string]interface{}{}
+	}
+	setting, ok := parsed.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: the top level must be a mapping", path)
+	}
+
+	merged := map[string]interface{}{}
+	if includes, ok := setting["include"]; ok {
+		delete(setting, "include")
+		var includePaths []string
+		switch v := includes.(type) {
+		case string:
+			includePaths = []string{v}
+		case []interface{}:
+			for _, includePath := range v {
+				includePaths = append(includePaths, fmt.Sprint(includePath))
+			}
+		default:
+			return nil, fmt.Errorf("%s: include must be a path or a list of paths", path)
+		}
+		for _, includePath := range includePaths {
+			if !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(filepath.Dir(path), includePath)
+			}
+			included, err := loadSettingMap(includePath, vars, loading)
+			if err != nil {
+				return nil, err
+			}
+			merged = overlaySetting(merged, included)
+		}
+	}
+	return overlaySetting(merged, setting), nil
+}
+
+// settingParseError explains the usual cause, as an unquoted {{ }} is read as a YAML mapping
+func settingParseError(path string, content []byte, err error) error {
+	if bytes.Contains(content, []byte("{{")) {
+		return fmt.Errorf("%s: %s. values containing {{ }} must be quoted", path, err)
+	}
+	return fmt.Errorf("%s: %s", path, err)
+}
+
+// overlaySetting merges overlay into base recursively. Lists are replaced, not appended
+func overlaySetting(base map[string]interface{}, overlay map[string]interface{}) map[string]interface{} {
+	for k, v := range overlay {
+		baseMap, baseIsMap := base[k].(map[string]interface{})
+		overlayMap, overlayIsMap := v.(map[string]interface{})
+		if baseIsMap && overlayIsMap {
+			base[k] = overlaySetting(baseMap, overlayMap)
+		} else {
+			base[k] = v
+		}
+	}
+	return base
+}
+
+// expandSettingVariables replaces the variables in the string values of the parsed YAML, so that the values never change its structure.
+// Mapping keys are kept as they are
+func expandSettingVariables(node *yaml.Node, vars map[string]string) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := expandSettingVariables(child, vars); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandSettingVariables(node.Content[i], vars); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if node.ShortTag() != "!!str" {
+			return nil
+		}
+		expanded, err := expandSettingString(node.Value, vars)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", node.Line, err)
+		}
+		if expanded != node.Value {
+			node.Value = expanded
+			if node.Style == 0 {
+				node.Tag = "" // typed again as a plain scalar
+			}
+		}
+	}
+	return nil
+}
+
+// quoteSettingVersions makes the unquoted numbers of "version", e.g. version: 17.0, strings as written,
+// since the OS version is text and the number would lose the trailing zero
+func quoteSettingVersions(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			quoteSettingVersions(child)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			value := node.Content[i]
+			if node.Content[i-1].Value == "version" {
+				versions := []*yaml.Node{value}
+				if value.Kind == yaml.SequenceNode {
+					versions = value.Content // the values of a matrix axis
+				}
+				for _, version := range versions {
+					if version.Kind == yaml.ScalarNode && (version.ShortTag() == "!!int" || version.ShortTag() == "!!float") {
+						version.Tag = "!!str"
+					}
+				}
+			}
+			quoteSettingVersions(value)
+		}
+	}
+}
+
+// expandSettingString replaces ${ENV} and {{ .Var }} in a single pass, so that a substituted value is never expanded again
+func expandSettingString(value string, vars map[string]string) (string, error) {
+	if !strings.Contains(value, "${") && !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	// ${ENV} becomes a call of env, whose result is not parsed as a template
+	source := envVarPattern.ReplaceAllStringFunc(value, func(match string) string {
+		groups := envVarPattern.FindStringSubmatch(match)
+		return fmt.Sprintf("{{ env %s %t %s }}", strconv.Quote(groups[1]), groups[2] != "", strconv.Quote(groups[3]))
+	})
+	tmpl, err := template.New("setting").Option("missingkey=error").Funcs(template.FuncMap{
+		"env": func(name string, hasDefault bool, defaultValue string) (string, error) {
+			if value, ok := os.LookupEnv(name); ok {
+				return value, nil
+			}
+			if hasDefault {
+				return defaultValue, nil
+			}
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		},
+	}).Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// normalizeSettingNumbers converts the numbers given as text, e.g. by a quoted {{ .Var }}, to numbers for the known number keys
+func normalizeSettingNumbers(setting map[string]interface{}) {
+	entries := []interface{}{setting}
+	if testSettings, ok := setting["test_settings"].([]interface{}); ok {
+		entries = append(entries, testSettings...)
+	}
+	for _, entry := range entries {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, value := range entryMap {
+			_, isText := value.(string)
+			if (settingKeys[key] == "number" || crossBatchRunKeys[key] == "number") && isText {
+				if n, err := settingNumber(value); err == nil {
+					entryMap[key] = n
+				}
+			}
+		}
+	}
+}
+
+// ValidateSetting checks the types of the keys known to the Web API.
+// It returns warnings for unknown keys, which are still sent to the server, and errors for invalid values
+func ValidateSetting(setting map[string]interface{}) ([]string, []string) {
+	warnings := []string{}
+	errs := []string{}
+	_, isCrossBatchRun := setting["test_settings"]
+	for _, key := range sortedKeys(setting) {
+		if key == "matrix" {
+			matrix, err := parseMatrixSetting(setting[key])
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			for _, axis := range matrix.Axes {
+				for _, value := range axis.Values {
+					if kind, known := settingKeys[axis.Name]; known {
+						if err := validateSettingValue("matrix."+axis.Name, kind, value); err != "" {
+							errs = append(errs, err)
+						}
+					}
+				}
+			}
+			for i, include := range matrix.Include {
+				for _, name := range sortedKeys(include) {
+					if kind, known := settingKeys[name]; known {
+						if err := validateSettingValue(fmt.Sprintf("matrix.include[%d].%s", i, name), kind, include[name]); err != "" {
+							errs = append(errs, err)
+						}
+					}
+				}
+			}
+			continue
+		}
+		kind, known := crossBatchRunKeys[key]
+		if !known && !isCrossBatchRun {
+			kind, known = settingKeys[key]
+		}
+		if !known {
+			warnings = append(warnings, fmt.Sprintf("unknown key '%s'", key))
+			continue
+		}
+		if err := validateSettingValue(key, kind, setting[key]); err != "" {
+			errs = append(errs, err)
+		}
+	}
+	if testSettings, ok := setting["test_settings"].([]interface{}); ok {
+		if len(testSettings) == 0 {
+			errs = append(errs, "test_settings must not be empty")
+		}
+		for i, entry := range testSettings {
+			entryMap, ok := entry.(map[string]interface{})
+			if !ok {
+				errs = append(errs, fmt.Sprintf("test_settings[%d] must be a mapping", i))
+				continue
+			}
+			for _, key := range sortedKeys(entryMap) {
+				kind, known := settingKeys[key]
+				if !known {
+					warnings = append(warnings, fmt.Sprintf("unknown key 'test_settings[%d].%s'", i, key))
+					continue
+				}
+				if err := validateSettingValue(fmt.Sprintf("test_settings[%d].%s", i, key), kind, entryMap[key]); err != "" {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if concurrency, ok := setting["concurrency"]; ok {
+		if n, err := settingNumber(concurrency); err == nil && n < 1 {
+			errs = append(errs, "concurrency must be 1 or more")
+		}
+	}
+	return warnings, errs
+}
+
+func validateSettingValue(name string, kind string, value interface{}) string {
+	switch kind {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Sprintf("%s must be a string", name)
+		}
+	case "number":
+		if _, err := settingNumber(value); err != nil {
+			return fmt.Sprintf("%s must be a number", name)
+		}
+	case "url":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Sprintf("%s must be a string", name)
+		}
+		if u, err := url.Parse(s); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Sprintf("%s must be an absolute URL", name)
+		}
+	case "list":
+		if _, ok := value.([]interface{}); !ok {
+			return fmt.Sprintf("%s must be a list", name)
+		}
+	}
+	return ""
+}
+
+// settingNumber accepts numbers and numeric strings, e.g. app_file_number substituted by a variable
+func settingNumber(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, fmt.Errorf("not a number: %v", value)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSettingFileVariables(t *testing.T) {
+	t.Setenv("MAGICPOD_TEST_BRANCH", "feature")
+	t.Setenv("MAGICPOD_TEST_MODEL", "iPhone 15\nos: android")
+	t.Setenv("MAGICPOD_TEST_URL", "https://example.com/app.zip?a=b: c")
+	t.Setenv("MAGICPOD_TEST_TEMPLATE", "{{ .secret }}")
+	t.Setenv("MAGICPOD_TEST_NUMBER", "12")
+	tests := []struct {
+		name    string
+		content string
+		vars    map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "env and default",
+			content: "branch_name: ${MAGICPOD_TEST_BRANCH}\ntest_settings_name: ${MAGICPOD_TEST_UNSET:-nightly}\n",
+			want:    `{"branch_name":"feature","test_settings_name":"nightly"}`,
+		},
+		{
+			name:    "env values never change the structure",
+			content: "model: ${MAGICPOD_TEST_MODEL}\napp_url: ${MAGICPOD_TEST_URL}\n",
+			want:    `{"app_url":"https://example.com/app.zip?a=b: c","model":"iPhone 15\nos: android"}`,
+		},
+		{
+			name:    "env values are not executed as templates",
+			content: "model: ${MAGICPOD_TEST_TEMPLATE}\n",
+			vars:    map[string]string{"secret": "leaked"},
+			want:    `{"model":"{{ .secret }}"}`,
+		},
+		{
+			name:    "var values are not expanded as env",
+			content: "model: \"{{ .model }}\"\n",
+			vars:    map[string]string{"model": "${MAGICPOD_TEST_BRANCH}"},
+			want:    `{"model":"${MAGICPOD_TEST_BRANCH}"}`,
+		},
+		{
+			name:    "unquoted values are typed and quoted ones are kept as text",
+			content: "app_file_number: ${MAGICPOD_TEST_NUMBER}\nversion: \"${MAGICPOD_TEST_NUMBER}\"\n",
+			want:    `{"app_file_number":12,"version":"12"}`,
+		},
+		{
+			name:    "unquoted versions are text as written",
+			content: "version: 17.0\ntest_settings:\n  - version: 16\nmatrix:\n  version: [16.4, 17.0]\n",
+			want:    `{"matrix":{"version":["16.4","17.0"]},"test_settings":[{"version":"16"}],"version":"17.0"}`,
+		},
+		{
+			name:    "numbers of known keys given by a quoted template",
+			content: "test_settings:\n  - app_file_number: \"{{ .app_file_number }}\"\n",
+			vars:    map[string]string{"app_file_number": "34"},
+			want:    `{"test_settings":[{"app_file_number":34}]}`,
+		},
+		{
+			name:    "keys are not expanded",
+			content: "${MAGICPOD_TEST_BRANCH}: x\n",
+			want:    `{"${MAGICPOD_TEST_BRANCH}":"x"}`,
+		},
+		{
+			name:    "missing env",
+			content: "branch_name: ${MAGICPOD_TEST_UNSET}\n",
+			wantErr: "environment variable MAGICPOD_TEST_UNSET is not set",
+		},
+		{
+			name:    "missing var",
+			content: "branch_name: \"{{ .branch }}\"\n",
+			wantErr: "branch",
+		},
+		{
+			name:    "unquoted template",
+			content: "app_file_number: {{ .app_file_number }}\n",
+			vars:    map[string]string{"app_file_number": "34"},
+			wantErr: "must be quoted",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "setting.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, _, exitErr := LoadSettingFile(path, tt.vars)
+			if tt.wantErr != "" {
+				if exitErr == nil || !strings.Contains(exitErr.Error(), tt.wantErr) {
+					t.Fatalf("LoadSettingFile() error = %v, want %q", exitErr, tt.wantErr)
+				}
+				return
+			}
+			if exitErr != nil {
+				t.Fatal(exitErr)
+			}
+			if got != tt.want {
+				t.Errorf("LoadSettingFile() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
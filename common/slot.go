@@ -0,0 +1,93 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	slotRetryInitialInterval = 10 * time.Second
+	slotRetryMaxInterval     = 2 * time.Minute
+)
+
+// capacityMessages are the parts of the 4xx messages with which the server refuses a batch run for too many running batch runs.
+// They are matched as whole phrases, as the other 4xx messages such as "too many devices specified" are for invalid requests
+var capacityMessages = []string{
+	"too many batch runs",
+	"too many running batch runs",
+	"batch runs are already running",
+	"同時実行数",
+}
+
+// isCapacityRefusal tells whether the server refused the request for its capacity, so that the same request may succeed later:
+// 429 or 503, a 4xx error with Retry-After, or a 4xx error with one of capacityMessages in the "detail" or "message" of its body
+func isCapacityRefusal(statusCode int, header http.Header, body string) bool {
+	switch {
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable:
+		return true
+	case statusCode >= 400 && statusCode < 500:
+		if retryAfter(header) > 0 {
+			return true
+		}
+		reason, _ := errorReason(statusCode, []byte(body))
+		for _, capacityMessage := range capacityMessages {
+			if strings.Contains(strings.ToLower(reason), capacityMessage) {
+				return true
+			}
+		}
+	case statusCode >= 400:
+		return retryAfter(header) > 0
+	}
+	return false
+}
+
+// retryAfter returns the wait requested by the Retry-After header in seconds, or 0
+func retryAfter(header http.Header) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(header.Get("Retry-After")))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// StartBatchRunWaitingForSlot starts a batch run like StartBatchRun, but keeps retrying with backoff for up to waitForSlot
+// while the server refuses it for its capacity. Other errors are returned at once
+func StartBatchRunWaitingForSlot(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	testSettingsNumber int, branchName string, setting string, waitForSlot time.Duration) (*BatchRun, *cli.ExitError) {
+	deadline := time.Now().Add(waitForSlot)
+	interval := slotRetryInitialInterval
+	for {
+		batchRun, err := startBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, testSettingsNumber, branchName, setting)
+		if err == nil {
+			return batchRun, nil
+		}
+		var refused *APIError
+		if !errors.As(err, &refused) || !isCapacityRefusal(refused.StatusCode, refused.Header, refused.Message) || waitForSlot <= 0 {
+			return nil, toExitError(err)
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, cli.NewExitError(fmt.Sprintf("gave up waiting for a slot after %s. %s", waitForSlot, err), 1)
+		}
+		wait := interval
+		if requested := retryAfter(refused.Header); requested > 0 {
+			wait = requested
+		}
+		if wait > left {
+			wait = left
+		}
+		fmt.Fprintf(os.Stderr, "the server cannot start the batch run now (%s: %s). retrying in %s (%s left to wait for a slot)\n",
+			refused.Status, errorMessage(refused.StatusCode, []byte(refused.Message)), wait.Round(time.Second), left.Round(time.Second))
+		sleep(wait)
+		if interval *= 2; interval > slotRetryMaxInterval {
+			interval = slotRetryMaxInterval
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsCapacityRefusal(t *testing.T) {
+	withRetryAfter := http.Header{"Retry-After": {"30"}}
+	tests := []struct {
+		name       string
+		statusCode int
+		header     http.Header
+		body       string
+		want       bool
+	}{
+		{"too many requests", http.StatusTooManyRequests, http.Header{}, "", true},
+		{"service unavailable", http.StatusServiceUnavailable, http.Header{}, "", true},
+		{"4xx with Retry-After", http.StatusConflict, withRetryAfter, "", true},
+		{"too many batch runs", http.StatusBadRequest, http.Header{}, `{"detail": "Too many batch runs are running. Please wait."}`, true},
+		{"too many batch runs in message", http.StatusForbidden, http.Header{}, `{"message": "too many running batch runs"}`, true},
+		{"validation error", http.StatusBadRequest, http.Header{}, `{"detail": "too many devices specified"}`, false},
+		{"capacity message outside detail", http.StatusBadRequest, http.Header{}, `{"name": "too many batch runs"}`, false},
+		{"unauthorized", http.StatusUnauthorized, http.Header{}, "", false},
+		{"not found", http.StatusNotFound, http.Header{}, "", false},
+		{"server error", http.StatusInternalServerError, http.Header{}, `{"detail": "too many batch runs"}`, false},
+		{"invalid Retry-After", http.StatusBadRequest, http.Header{"Retry-After": {"Wed, 21 Oct 2026 07:28:00 GMT"}}, "", false},
+		{"success", http.StatusOK, withRetryAfter, "", false},
+	}
+	for _, tt := range tests {
+		if got := isCapacityRefusal(tt.statusCode, tt.header, tt.body); got != tt.want {
+			t.Errorf("%s: isCapacityRefusal(%d) = %v, want %v", tt.name, tt.statusCode, got, tt.want)
+		}
+	}
+}
+
+func TestStartBatchRunWaitingForSlot(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		waitForSlot time.Duration
+		wantErr     bool
+		wantPosts   int
+	}{
+		{"started after refusals", []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK}, time.Hour, false, 3},
+		{"started after a capacity message", []int{http.StatusConflict, http.StatusOK}, time.Hour, false, 2},
+		{"no retry without wait", []int{http.StatusTooManyRequests, http.StatusOK}, 0, true, 1},
+		{"validation error fails fast", []int{http.StatusBadRequest, http.StatusOK}, time.Hour, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCassette(t) // for sleep
+			var slept time.Duration
+			sleep = func(d time.Duration) { slept += d }
+			posts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[posts]
+				posts++
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					w.Write([]byte(`{"batch_run_number": 7, "status": "running"}`))
+				} else if status == http.StatusConflict {
+					w.Write([]byte(`{"detail": "Too many batch runs are running."}`))
+				} else {
+					w.Write([]byte(`{"detail": "too many devices specified"}`))
+				}
+			}))
+			defer server.Close()
+			batchRun, exitErr := StartBatchRunWaitingForSlot(server.URL, "token", "org", "project", map[string]string{}, 1, "", "", tt.waitForSlot)
+			if (exitErr != nil) != tt.wantErr {
+				t.Fatalf("StartBatchRunWaitingForSlot() error = %v, wantErr %v", exitErr, tt.wantErr)
+			}
+			if !tt.wantErr && batchRun.BatchRunNumber != 7 {
+				t.Errorf("batch run #%d is started, want #7", batchRun.BatchRunNumber)
+			}
+			if posts != tt.wantPosts {
+				t.Errorf("%d requests are sent, want %d", posts, tt.wantPosts)
+			}
+			// the interval doubles from slotRetryInitialInterval
+			if want := slotRetryInitialInterval * time.Duration(1<<(tt.wantPosts-1)-1); !tt.wantErr && slept != want {
+				t.Errorf("slept %s, want %s", slept, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// localState is the information shared by the invocations of the command on the same machine.
+// It is kept in state.json in MAGICPOD_STATE_DIR, or in magicpod-api-client in the user cache directory
+type localState struct {
+	AppFileReferences []appFileReference `json:"app_file_references,omitempty"`
+	UploadedApps      []uploadedApp      `json:"uploaded_apps,omitempty"`
+	IdempotencyKeys   []idempotencyKey   `json:"idempotency_keys,omitempty"`
+}
+
+// appFileReference records the app files used by a batch run started by this command, for prune-apps
+type appFileReference struct {
+	Organization   string    `json:"organization"`
+	Project        string    `json:"project"`
+	BatchRunNumber int       `json:"batch_run_number"`
+	AppFileNumbers []int     `json:"app_file_numbers"`
+	RecordedAt     time.Time `json:"recorded_at"`
+}
+
+// uploadedApp maps the content of an uploaded app to its file number, for upload-app --reuse_if_identical
+type uploadedApp struct {
+	Organization string    `json:"organization"`
+	Project      string    `json:"project"`
+	SHA256       string    `json:"sha256"`
+	FileNo       int       `json:"file_no"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+}
+
+// idempotencyKey maps the key given by batch-run --idempotency_key to the batch run started with it
+type idempotencyKey struct {
+	Organization       string    `json:"organization"`
+	Project            string    `json:"project"`
+	Key                string    `json:"key"`
+	TestSettingsNumber int       `json:"test_settings_number"`
+	BranchName         string    `json:"branch_name"`
+	SettingHash        string    `json:"setting_hash"` // SHA-256 of the setting, so that a changed setting starts a new batch run
+	BatchRunNumber     int       `json:"batch_run_number"`
+	RecordedAt         time.Time `json:"recorded_at"`
+}
+
+// records older than this are dropped, as no batch run runs that long
+const localStateRetention = 7 * 24 * time.Hour
+
+func localStatePath() (string, error) {
+	dir := os.Getenv("MAGICPOD_STATE_DIR")
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cacheDir, "magicpod-api-client")
+	}
+	return filepath.Join(dir, "state.json"), nil
+}
+
+func loadLocalState() (*localState, error) {
+	state := &localState{}
+	path, err := localStatePath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// fileLockStaleAfter is long enough for a file lock, which is held only while a small file is updated
+const fileLockStaleAfter = 30 * time.Second
+
+// lockFile locks the file at path among the processes and returns the function to unlock it.
+// The lock is a directory next to the file, as creating one is atomic on every platform
+func lockFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	for {
+		err := os.Mkdir(lockPath, 0700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > fileLockStaleAfter {
+			os.Remove(lockPath) // left by a killed process
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return func() { os.Remove(lockPath) }, nil
+}
+
+// updateLocalState applies update to the state and saves it. The state is locked meanwhile so that the records of concurrent jobs
+// are not lost, and the file is replaced atomically so that a crash never breaks it
+func updateLocalState(update func(state *localState)) error {
+	path, err := localStatePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := loadLocalState()
+	if err != nil {
+		return err
+	}
+	update(state)
+	references := []appFileReference{}
+	for _, reference := range state.AppFileReferences {
+		if time.Since(reference.RecordedAt) < localStateRetention {
+			references = append(references, reference)
+		}
+	}
+	state.AppFileReferences = references
+	keys := []idempotencyKey{}
+	for _, key := range state.IdempotencyKeys {
+		if time.Since(key.RecordedAt) < localStateRetention {
+			keys = append(keys, key)
+		}
+	}
+	state.IdempotencyKeys = keys
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "state-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// appFileNumbersInSetting returns app_file_number of the setting and of each entry of its test_settings
+func appFileNumbersInSetting(setting string) []int {
+	var settingMap map[string]interface{}
+	if err := json.Unmarshal([]byte(setting), &settingMap); err != nil {
+		return nil
+	}
+	entries := []interface{}{settingMap}
+	if testSettings, ok := settingMap["test_settings"].([]interface{}); ok {
+		entries = append(entries, testSettings...)
+	}
+	numbers := []int{}
+	for _, entry := range entries {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if value, ok := entryMap["app_file_number"]; ok {
+			if number, err := settingNumber(value); err == nil {
+				numbers = append(numbers, number)
+			}
+		}
+	}
+	return numbers
+}
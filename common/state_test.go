@@ -0,0 +1,32 @@
+package common
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestUpdateLocalStateKeepsConcurrentRecords(t *testing.T) {
+	t.Setenv("MAGICPOD_STATE_DIR", t.TempDir())
+	const jobs = 20
+	var wg sync.WaitGroup
+	for i := 1; i <= jobs; i++ {
+		wg.Add(1)
+		go func(batchRunNumber int) {
+			defer wg.Done()
+			if err := RecordIdempotencyKey("org", "project", "key", batchRunNumber, "", "", batchRunNumber); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 1; i <= jobs; i++ {
+		batchRunNumber, err := FindIdempotentBatchRun("org", "project", "key", i, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batchRunNumber != i {
+			t.Errorf("record of batch run #%d is lost", i)
+		}
+	}
+}
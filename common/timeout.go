@@ -0,0 +1,176 @@
+package common
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// AbortBatchRun asks the server to stop the batch run, e.g. when the wait for it timed out, so that it stops occupying the devices
+func AbortBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, batchRunNumber int) *cli.ExitError {
+	return toExitError(abortBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber))
+}
+
+func abortBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string, batchRunNumber int) error {
+	res, err := createBaseRequest(urlBase, apiToken, organization, project, httpHeadersMap).
+		SetPathParams(map[string]string{
+			"batch_run_number": strconv.Itoa(batchRunNumber),
+		}).
+		Post("/{organization}/{project}/batch-run/{batch_run_number}/stop/")
+	if err != nil {
+		return err
+	}
+	return responseError(res)
+}
+
+// PendingTestCase is a test case which had not finished when the wait timed out
+type PendingTestCase struct {
+	PatternName string   `json:"pattern_name,omitempty"`
+	TestCase    TestCase `json:"test_case"`
+	Status      string   `json:"status"` // running, or not-running for the test cases which had not started
+}
+
+// PendingTestCases returns the test cases of the batch run which have not finished, in the order of the patterns and the test cases
+func PendingTestCases(batchRun *BatchRun) []PendingTestCase {
+	pending := []PendingTestCase{}
+	for _, detail := range batchRun.TestCases.Details {
+		patternName := ""
+		if detail.PatternName != nil {
+			patternName = *detail.PatternName
+		}
+		for _, result := range detail.Results {
+			if BatchRunStatus(result.Status).IsTerminal() {
+				continue
+			}
+			status := result.Status
+			if status != string(BatchRunStatusRunning) {
+				status = "not-running"
+			}
+			pending = append(pending, PendingTestCase{PatternName: patternName, TestCase: result.TestCase, Status: status})
+		}
+	}
+	return pending
+}
+
+// TimeoutDiagnostic explains which test cases and patterns had not finished when the wait timed out
+func TimeoutDiagnostic(batchRun *BatchRun) string {
+	testCases := batchRun.TestCases
+	var b strings.Builder
+	fmt.Fprintf(&b, "batch run #%d was %s at timeout: %d/%d finished, %d running, %d not started\n", batchRun.BatchRunNumber, batchRun.Status,
+		testCases.Succeeded+testCases.Failed+testCases.Aborted+testCases.Unresolved, testCases.Total, testCases.Running, testCases.NotRunning)
+	pending := PendingTestCases(batchRun)
+	if len(pending) == 0 && len(testCases.Details) == 0 {
+		b.WriteString("  no results per test case are available\n")
+	}
+	for _, p := range pending {
+		status := "running"
+		if p.Status != string(BatchRunStatusRunning) {
+			status = "not started"
+		}
+		if p.PatternName != "" {
+			fmt.Fprintf(&b, "  %s: #%d %s (%s)\n", p.PatternName, p.TestCase.Number, p.TestCase.Name, status)
+		} else {
+			fmt.Fprintf(&b, "  #%d %s (%s)\n", p.TestCase.Number, p.TestCase.Name, status)
+		}
+	}
+	return b.String()
+}
+
+// WritePartialReport writes the results of the batch run which had not finished at timeout, in "json" or "junit" format
+func WritePartialReport(w io.Writer, batchRun *BatchRun, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			TimedOut bool              `json:"timed_out"`
+			Pending  []PendingTestCase `json:"pending_test_cases"`
+			BatchRun *BatchRun         `json:"batch_run"`
+		}{true, PendingTestCases(batchRun), batchRun})
+	case "junit":
+		return writeJUnitReport(w, batchRun)
+	}
+	return fmt.Errorf("unknown report format: %s", format)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Name    string           `xml:"name,attr"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr,omitempty"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+}
+
+// writeJUnitReport writes a test suite per pattern. Unfinished test cases are reported as skipped
+func writeJUnitReport(w io.Writer, batchRun *BatchRun) error {
+	report := junitTestSuites{Name: fmt.Sprintf("%s #%d", batchRun.TestSettingName, batchRun.BatchRunNumber)}
+	for _, detail := range batchRun.TestCases.Details {
+		suite := junitTestSuite{Name: batchRun.TestSettingName}
+		if detail.PatternName != nil {
+			suite.Name = *detail.PatternName
+		}
+		for _, result := range detail.Results {
+			testCase := junitTestCase{Name: result.TestCase.Name, ClassName: suite.Name}
+			if result.DurationSeconds != nil {
+				testCase.Time = strconv.FormatFloat(*result.DurationSeconds, 'f', 3, 64)
+			}
+			switch BatchRunStatus(result.Status) {
+			case BatchRunStatusSucceeded:
+			case BatchRunStatusFailed:
+				testCase.Failure = &junitMessage{Message: "failed", Type: "failed"}
+				suite.Failures++
+			case BatchRunStatusUnresolved:
+				testCase.Failure = &junitMessage{Message: "unresolved", Type: "unresolved"}
+				suite.Failures++
+			case BatchRunStatusAborted:
+				testCase.Error = &junitMessage{Message: "aborted"}
+				suite.Errors++
+			case BatchRunStatusRunning:
+				testCase.Skipped = &junitMessage{Message: "still running at timeout"}
+				suite.Skipped++
+			default:
+				testCase.Skipped = &junitMessage{Message: "not started at timeout"}
+				suite.Skipped++
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		suite.Tests = len(suite.Cases)
+		report.Suites = append(report.Suites, suite)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
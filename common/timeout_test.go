@@ -0,0 +1,153 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// partialBatchRun returns a cross batch run which timed out with the test cases in every status
+func partialBatchRun() *BatchRun {
+	iPhone, pixel := "iPhone", "Pixel"
+	duration := 12.5
+	return &BatchRun{
+		BatchRunNumber:  8,
+		TestSettingName: "nightly",
+		Status:          BatchRunStatusRunning,
+		TestCases: TestCasesSummary{
+			NotRunning: 1, Running: 1, Succeeded: 1, Failed: 1, Aborted: 1, Unresolved: 1, Total: 6,
+			Details: []TestCaseDetail{
+				{PatternName: &iPhone, Results: []TestCaseResult{
+					{TestCase: TestCase{Number: 1, Name: "login"}, Status: "succeeded", TaskInterval: TaskInterval{DurationSeconds: &duration}},
+					{TestCase: TestCase{Number: 2, Name: "search"}, Status: "failed"},
+					{TestCase: TestCase{Number: 3, Name: "purchase"}, Status: "running"},
+				}},
+				{PatternName: &pixel, Results: []TestCaseResult{
+					{TestCase: TestCase{Number: 1, Name: "login"}, Status: "aborted"},
+					{TestCase: TestCase{Number: 2, Name: "search"}, Status: "not-running"},
+					{TestCase: TestCase{Number: 3, Name: "purchase"}, Status: "unresolved"},
+				}},
+			},
+		},
+	}
+}
+
+func TestPendingTestCases(t *testing.T) {
+	want := []PendingTestCase{
+		{PatternName: "iPhone", TestCase: TestCase{Number: 3, Name: "purchase"}, Status: "running"},
+		{PatternName: "Pixel", TestCase: TestCase{Number: 2, Name: "search"}, Status: "not-running"},
+	}
+	if got := PendingTestCases(partialBatchRun()); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingTestCases() = %+v, want %+v", got, want)
+	}
+}
+
+func TestTimeoutDiagnostic(t *testing.T) {
+	want := `batch run #8 was running at timeout: 4/6 finished, 1 running, 1 not started
+  iPhone: #3 purchase (running)
+  Pixel: #2 search (not started)
+`
+	if got := TimeoutDiagnostic(partialBatchRun()); got != want {
+		t.Errorf("TimeoutDiagnostic() =\n%s\nwant\n%s", got, want)
+	}
+
+	withoutDetails := &BatchRun{BatchRunNumber: 9, Status: BatchRunStatusRunning, TestCases: TestCasesSummary{Running: 2, Total: 2}}
+	want = `batch run #9 was running at timeout: 0/2 finished, 2 running, 0 not started
+  no results per test case are available
+`
+	if got := TimeoutDiagnostic(withoutDetails); got != want {
+		t.Errorf("TimeoutDiagnostic() without details =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWritePartialReportJUnit(t *testing.T) {
+	var b bytes.Buffer
+	if err := WritePartialReport(&b, partialBatchRun(), "junit"); err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="nightly #8">
+  <testsuite name="iPhone" tests="3" failures="1" errors="0" skipped="1">
+    <testcase name="login" classname="iPhone" time="12.500"></testcase>
+    <testcase name="search" classname="iPhone">
+      <failure message="failed" type="failed"></failure>
+    </testcase>
+    <testcase name="purchase" classname="iPhone">
+      <skipped message="still running at timeout"></skipped>
+    </testcase>
+  </testsuite>
+  <testsuite name="Pixel" tests="3" failures="1" errors="1" skipped="1">
+    <testcase name="login" classname="Pixel">
+      <error message="aborted"></error>
+    </testcase>
+    <testcase name="search" classname="Pixel">
+      <skipped message="not started at timeout"></skipped>
+    </testcase>
+    <testcase name="purchase" classname="Pixel">
+      <failure message="unresolved" type="unresolved"></failure>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	if got := b.String(); got != want {
+		t.Errorf("JUnit report =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWritePartialReportJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := WritePartialReport(&b, partialBatchRun(), "json"); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		TimedOut bool              `json:"timed_out"`
+		Pending  []PendingTestCase `json:"pending_test_cases"`
+		BatchRun BatchRun          `json:"batch_run"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &report); err != nil {
+		t.Fatalf("the JSON report is invalid: %s\n%s", err, b.String())
+	}
+	if !report.TimedOut {
+		t.Errorf("timed_out is false")
+	}
+	if !reflect.DeepEqual(report.Pending, PendingTestCases(partialBatchRun())) {
+		t.Errorf("pending_test_cases = %+v", report.Pending)
+	}
+	if report.BatchRun.BatchRunNumber != 8 || len(report.BatchRun.TestCases.Details) != 2 || len(report.BatchRun.TestCases.Details[1].Results) != 3 {
+		t.Errorf("batch_run does not have the results so far: %+v", report.BatchRun)
+	}
+
+	if err := WritePartialReport(&b, partialBatchRun(), "html"); err == nil {
+		t.Errorf("an unknown format is accepted")
+	}
+}
+
+func TestAbortBatchRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"aborted", http.StatusOK, false},
+		{"refused", http.StatusBadRequest, true},
+	}
+	for _, tt := range tests {
+		var method, path string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method, path = r.Method, r.URL.Path
+			w.WriteHeader(tt.status)
+		}))
+		exitErr := AbortBatchRun(server.URL, "token", "org", "project", map[string]string{}, 8)
+		server.Close()
+		if (exitErr != nil) != tt.wantErr {
+			t.Errorf("%s: AbortBatchRun() error = %v, wantErr %v", tt.name, exitErr, tt.wantErr)
+		}
+		if method != http.MethodPost || !strings.HasSuffix(path, "/org/project/batch-run/8/stop/") {
+			t.Errorf("%s: %s %s is sent", tt.name, method, path)
+		}
+	}
+}
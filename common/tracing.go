@@ -0,0 +1,357 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Tracing is a minimal OpenTelemetry compatible tracer. Spans are kept in memory and exported at once
+// by ShutdownTracing in the OTLP/HTTP JSON encoding, either to an OTLP endpoint or to a file.
+
+const tracerName = "github.com/Magic-Pod/magicpod-api-client/common"
+
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	statusCodeError  = 2
+)
+
+type span struct {
+	traceID       [16]byte
+	spanID        [8]byte
+	parentSpanID  [8]byte
+	name          string
+	kind          int
+	start         time.Time
+	finish        time.Time
+	attributes    []spanAttribute
+	statusError   bool
+	statusMessage string
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+type tracer struct {
+	mu             sync.Mutex
+	traceID        [16]byte
+	rootParentID   [8]byte
+	active         []*span // spans not ended yet, which ShutdownTracing ends
+	finished       []*span
+	otlpEndpoint   string
+	traceFile      string
+	traceTestCases bool
+}
+
+// currentTracer is nil unless SetupTracing is called, which makes every tracing call a no-op
+var currentTracer *tracer
+
+// SetupTracing enables tracing of the HTTP requests and long running operations.
+// The spans nest under the trace context given by the TRACEPARENT environment variable if any.
+// If traceTestCases is true, a span is also recorded for each test case result of waited batch runs
+func SetupTracing(otlpEndpoint string, traceFile string, traceTestCases bool) error {
+	if otlpEndpoint == "" && traceFile == "" {
+		return nil
+	}
+	t := &tracer{otlpEndpoint: otlpEndpoint, traceFile: traceFile, traceTestCases: traceTestCases}
+	if traceparent := os.Getenv("TRACEPARENT"); traceparent != "" {
+		traceID, parentID, ok := parseTraceparent(traceparent)
+		if !ok {
+			return fmt.Errorf("TRACEPARENT is not in the W3C trace context format: %s", traceparent)
+		}
+		t.traceID = traceID
+		t.rootParentID = parentID
+	} else {
+		rand.Read(t.traceID[:])
+	}
+	currentTracer = t
+	transportWrappers = append(transportWrappers, func(next http.RoundTripper) http.RoundTripper {
+		return &tracingTransport{next: next}
+	})
+	return nil
+}
+
+// ShutdownTracing ends the spans still running and exports all the spans
+func ShutdownTracing() error {
+	t := currentTracer
+	if t == nil {
+		return nil
+	}
+	currentTracer = nil
+	t.mu.Lock()
+	for len(t.active) > 0 {
+		s := t.active[len(t.active)-1]
+		t.active = t.active[:len(t.active)-1]
+		s.finish = time.Now()
+		t.finished = append(t.finished, s)
+	}
+	body, err := json.Marshal(t.otlpPayload())
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if t.traceFile != "" {
+		if err := os.WriteFile(t.traceFile, body, 0644); err != nil {
+			return err
+		}
+	}
+	if t.otlpEndpoint != "" {
+		endpoint := strings.TrimSuffix(t.otlpEndpoint, "/")
+		if !strings.HasSuffix(endpoint, "/v1/traces") {
+			endpoint += "/v1/traces"
+		}
+		// currentTracer is already nil, so that the export itself is not traced.
+		// The export is not a part of the session, so it is neither recorded nor replayed
+		client := &http.Client{Transport: networkTransport, Timeout: 30 * time.Second}
+		res, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("failed to export spans to %s: %s", endpoint, res.Status)
+		}
+	}
+	return nil
+}
+
+func parseTraceparent(traceparent string) ([16]byte, [8]byte, bool) {
+	var traceID [16]byte
+	var parentID [8]byte
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// startSpan starts a span as a child of parent, or of the trace context of TRACEPARENT if parent is nil.
+// The parent is given explicitly, as the operations may run concurrently. attributes are given as key value pairs
+func startSpan(parent *span, name string, attributes ...interface{}) *span {
+	return startSpanWithKind(parent, name, spanKindInternal, attributes...)
+}
+
+func startSpanWithKind(parent *span, name string, kind int, attributes ...interface{}) *span {
+	t := currentTracer
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &span{traceID: t.traceID, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.spanID[:])
+	if parent != nil {
+		s.parentSpanID = parent.spanID
+	} else {
+		s.parentSpanID = t.rootParentID
+	}
+	s.addAttributes(attributes...)
+	t.active = append(t.active, s)
+	return s
+}
+
+// setAttributes adds attributes to a running span, which may be exported by ShutdownTracing meanwhile
+func (s *span) setAttributes(attributes ...interface{}) {
+	t := currentTracer
+	if s == nil || t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.addAttributes(attributes...)
+}
+
+// addAttributes is setAttributes for a span which is not shared yet or while the lock is held
+func (s *span) addAttributes(attributes ...interface{}) {
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.attributes = append(s.attributes, spanAttribute{fmt.Sprint(attributes[i]), attributes[i+1]})
+	}
+}
+
+// end ends the span, marking it as an error if err is not nil. It does nothing if the span has already ended.
+// The span is read and updated with the lock held, as it may be ended by ShutdownTracing or by another goroutine at the same time
+func (s *span) end(err error) {
+	t := currentTracer
+	if s == nil || t == nil {
+		return
+	}
+	if exitErr, ok := err.(*cli.ExitError); ok && exitErr == nil {
+		err = nil // typed nil returned by the functions of this package
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !s.finish.IsZero() {
+		return
+	}
+	if err != nil {
+		s.statusError = true
+		s.statusMessage = err.Error()
+	}
+	s.finish = time.Now()
+	for i := len(t.active) - 1; i >= 0; i-- {
+		if t.active[i] == s {
+			t.active = append(t.active[:i], t.active[i+1:]...)
+			break
+		}
+	}
+	t.finished = append(t.finished, s)
+}
+
+type spanContextKey struct{}
+
+// contextWithSpan returns a context whose HTTP requests are traced as children of the span
+func contextWithSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// recordTestCaseSpans records a span for each test case result of the batch run under the given span
+func recordTestCaseSpans(parent *span, batchRun *BatchRun) {
+	t := currentTracer
+	if t == nil || parent == nil || !t.traceTestCases {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, detail := range batchRun.TestCases.Details {
+		for _, result := range detail.Results {
+			startedAt := result.StartedAt.Time
+			if startedAt.IsZero() {
+				continue // not started
+			}
+			finishedAt := result.FinishedAt.Time
+			if finishedAt.IsZero() {
+				finishedAt = time.Now()
+			}
+			s := &span{traceID: parent.traceID, parentSpanID: parent.spanID, name: "test case " + result.TestCase.Name,
+				kind: spanKindInternal, start: startedAt, finish: finishedAt}
+			rand.Read(s.spanID[:])
+			s.addAttributes("magicpod.test_case.number", result.TestCase.Number, "magicpod.test_case.name", result.TestCase.Name,
+				"magicpod.test_case.status", result.Status, "magicpod.test_case.url", result.TestCase.Url)
+			if detail.PatternName != nil {
+				s.addAttributes("magicpod.pattern_name", *detail.PatternName)
+			}
+			if result.Status == "failed" || result.Status == "aborted" {
+				s.statusError = true
+				s.statusMessage = result.Status
+			}
+			t.finished = append(t.finished, s)
+		}
+	}
+}
+
+// otlpPayload builds the ExportTraceServiceRequest in the OTLP JSON encoding
+func (t *tracer) otlpPayload() map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(t.finished))
+	for _, s := range t.finished {
+		attributes := make([]map[string]interface{}, 0, len(s.attributes))
+		for _, a := range s.attributes {
+			attributes = append(attributes, map[string]interface{}{"key": a.key, "value": otlpValue(a.value)})
+		}
+		otlpSpan := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.finish.UnixNano(), 10),
+			"attributes":        attributes,
+		}
+		if s.parentSpanID != [8]byte{} {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentSpanID[:])
+		}
+		if s.statusError {
+			otlpSpan["status"] = map[string]interface{}{"code": statusCodeError, "message": s.statusMessage}
+		}
+		spans = append(spans, otlpSpan)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{
+						map[string]interface{}{"key": "service.name", "value": otlpValue("magicpod-api-client")},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": tracerName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+// tracingTransport records a client span for each HTTP request and propagates the trace context to the server
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := startSpanWithKind(spanFromContext(req.Context()), "HTTP "+req.Method, spanKindClient,
+		"http.request.method", req.Method, "url.path", req.URL.Path, "server.address", req.URL.Host)
+	if s != nil {
+		req = req.Clone(req.Context())
+		req.Header.Set("traceparent", s.traceparent())
+	}
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		s.end(err)
+		return res, err
+	}
+	s.setAttributes("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 400 {
+		s.end(fmt.Errorf("%s", res.Status))
+	} else {
+		s.end(nil)
+	}
+	return res, err
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func withTracer(t *testing.T) *tracer {
+	tr := &tracer{}
+	currentTracer = tr
+	t.Cleanup(func() { currentTracer = nil })
+	return tr
+}
+
+func TestStartSpanParentsOfConcurrentOperations(t *testing.T) {
+	withTracer(t)
+	const workers = 10
+	parents := make([]*span, workers)
+	for i := range parents {
+		parents[i] = startSpan(nil, "wait for batch run")
+	}
+	children := make([]*span, workers)
+	var wg sync.WaitGroup
+	for i := range parents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			children[i] = startSpan(parents[i], "poll batch run")
+			children[i].end(nil)
+		}(i)
+	}
+	wg.Wait()
+	for i, child := range children {
+		if child.parentSpanID != parents[i].spanID {
+			t.Errorf("child %d has the parent %x, want %x", i, child.parentSpanID, parents[i].spanID)
+		}
+		if parents[i].parentSpanID != ([8]byte{}) {
+			t.Errorf("parent %d is not a root span", i)
+		}
+	}
+}
+
+func TestSpanEndsOnceWhenEndedConcurrently(t *testing.T) {
+	tr := withTracer(t)
+	s := startSpan(nil, "wait for batch run")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.setAttributes("magicpod.status", "running")
+			s.end(nil)
+		}()
+	}
+	wg.Wait()
+	if len(tr.finished) != 1 || len(tr.active) != 0 {
+		t.Errorf("%d spans are finished and %d are active, want 1 and 0", len(tr.finished), len(tr.active))
+	}
+}
+
+func TestTracingTransportUsesSpanOfRequestContext(t *testing.T) {
+	tr := withTracer(t)
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &tracingTransport{next: http.DefaultTransport}}
+
+	parent := startSpan(nil, "start batch run")
+	for _, ctx := range []context.Context{contextWithSpan(context.Background(), parent), context.Background()} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	if len(tr.finished) != 2 {
+		t.Fatalf("%d spans are finished, want 2", len(tr.finished))
+	}
+	if got := tr.finished[0].parentSpanID; got != parent.spanID {
+		t.Errorf("HTTP span has the parent %x, want %x", got, parent.spanID)
+	}
+	if got := tr.finished[1].parentSpanID; got != ([8]byte{}) {
+		t.Errorf("HTTP span without a span in the context has the parent %x, want none", got)
+	}
+	if want := tr.finished[1].traceparent(); traceparent != want {
+		t.Errorf("traceparent = %s, want %s", traceparent, want)
+	}
+}
+
+func TestShutdownTracingExportsWithoutRecording(t *testing.T) {
+	withCassette(t)
+	exported := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			exported++
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	if err := SetupRecording(dir); err != nil {
+		t.Fatal(err)
+	}
+	tr := withTracer(t)
+	tr.otlpEndpoint = server.URL
+	startSpan(nil, "wait for batch run").end(nil)
+
+	if err := ShutdownTracing(); err != nil {
+		t.Fatal(err)
+	}
+	if exported != 1 {
+		t.Errorf("spans are exported %d times, want 1", exported)
+	}
+	if recorded, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(recorded) > 0 {
+		t.Errorf("the export is recorded: %v", recorded)
+	}
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// HTTPOptions configures the connection to the server, e.g. for corporate networks
+type HTTPOptions struct {
+	ProxyURL       string        // used for both http and https. HTTPS_PROXY/HTTP_PROXY are used if empty
+	NoProxy        string        // comma separated hosts not to use the proxy for. NO_PROXY is used if empty
+	CACertPath     string        // PEM file of additional root CAs, e.g. of a TLS-intercepting proxy
+	ClientCertPath string        // PEM file of the client certificate for mTLS
+	ClientKeyPath  string        // PEM file of the client key for mTLS
+	ConnectTimeout time.Duration // 0 means the default of 30 seconds
+	ReadTimeout    time.Duration // time to wait for response headers. 0 means no limit
+}
+
+// networkTransport sends the requests to the network. It is replaced by ConfigureHTTP
+var networkTransport http.RoundTripper = http.DefaultTransport
+
+// baseTransport sends the requests of the command. It is networkTransport, wrapped or replaced to record or replay the session
+var baseTransport http.RoundTripper = networkTransport
+
+// transportWrappers wrap the transport of every request created by createBaseRequest, e.g. to trace requests.
+// They are applied in order, so the last one sees a request first
+var transportWrappers []func(http.RoundTripper) http.RoundTripper
+
+func newTransport() http.RoundTripper {
+	transport := baseTransport
+	for _, wrap := range transportWrappers {
+		transport = wrap(transport)
+	}
+	return transport
+}
+
+// ConfigureHTTP applies the options to all the following requests
+func ConfigureHTTP(options HTTPOptions) error {
+	proxyConfig := httpproxy.FromEnvironment()
+	if options.ProxyURL != "" {
+		if _, err := url.Parse(options.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy URL %s: %s", options.ProxyURL, err)
+		}
+		proxyConfig.HTTPProxy = options.ProxyURL
+		proxyConfig.HTTPSProxy = options.ProxyURL
+	}
+	if options.NoProxy != "" {
+		proxyConfig.NoProxy = options.NoProxy
+	}
+	proxyFunc := proxyConfig.ProxyFunc()
+
+	connectTimeout := options.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = 30 * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.ResponseHeaderTimeout = options.ReadTimeout
+
+	tlsConfig := &tls.Config{}
+	if options.CACertPath != "" {
+		pem, err := os.ReadFile(options.CACertPath)
+		if err != nil {
+			return fmt.Errorf("failed to read the CA certificate: %s", err)
+		}
+		// the extra CAs are added to the system ones so that direct connections keep working
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", options.CACertPath)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if options.ClientCertPath != "" || options.ClientKeyPath != "" {
+		if options.ClientCertPath == "" || options.ClientKeyPath == "" {
+			return fmt.Errorf("both of the client certificate and key are required for mTLS")
+		}
+		cert, err := tls.LoadX509KeyPair(options.ClientCertPath, options.ClientKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load the client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	networkTransport = transport
+	baseTransport = transport
+	return nil
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// WaitState is saved by batch-run --state_file so that resume can continue waiting for the batch run in another process
+type WaitState struct {
+	Organization       string          `json:"organization"`
+	Project            string          `json:"project"`
+	BatchRunNumber     int             `json:"batch_run_number"`
+	Url                string          `json:"url"`
+	TestSettingsNumber int             `json:"test_settings_number,omitempty"`
+	BranchName         string          `json:"branch_name,omitempty"`
+	Setting            json.RawMessage `json:"setting,omitempty"`
+	StartedAt          time.Time       `json:"started_at"`                // when the command started the batch run, from which the wait limit is counted
+	WaitLimit          int             `json:"wait_limit"`                // as given by --wait_limit. 0 is resolved when waiting
+	AutoWaitLimit      bool            `json:"auto_wait_limit,omitempty"` // --wait_limit auto, which is resolved when waiting
+	FinishedTestCases  int             `json:"finished_test_cases"`
+}
+
+// NewWaitState returns the state of the batch run which has just been started
+func NewWaitState(organization string, project string, batchRun *BatchRun, testSettingsNumber int, branchName string, setting string, waitLimit WaitLimit) *WaitState {
+	state := &WaitState{
+		Organization:       organization,
+		Project:            project,
+		BatchRunNumber:     batchRun.BatchRunNumber,
+		Url:                batchRun.Url,
+		TestSettingsNumber: testSettingsNumber,
+		BranchName:         branchName,
+		StartedAt:          time.Now(),
+		WaitLimit:          waitLimit.Seconds,
+		AutoWaitLimit:      waitLimit.Auto,
+	}
+	if setting != "" && json.Valid([]byte(setting)) {
+		state.Setting = json.RawMessage(setting)
+	}
+	return state
+}
+
+// LoadWaitState reads the state saved by WaitState.Save
+func LoadWaitState(path string) (*WaitState, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &WaitState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("%s is not a state file: %s", path, err)
+	}
+	if state.BatchRunNumber == 0 {
+		return nil, fmt.Errorf("%s has no batch run number", path)
+	}
+	return state, nil
+}
+
+// Save writes the state to the path. The file is replaced atomically so that a killed job never leaves it broken
+func (s *WaitState) Save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WaitForBatchRunWithState waits for the batch run like WaitForBatchRun, saving the progress to the state file at statePath
+func WaitForBatchRunWithState(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	batchRun *BatchRun, state *WaitState, statePath string, printResult bool) (*RunResult, *cli.ExitError) {
+	result, err := waitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, state.waitLimit(), printResult,
+		state.progress(statePath, false))
+	return result, toExitError(err)
+}
+
+// ResumeWaitForBatchRun continues waiting for the batch run of the state with the rest of the wait limit.
+// The test cases which had finished before are not shown again
+func ResumeWaitForBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	state *WaitState, statePath string, printResult bool) (*RunResult, *cli.ExitError) {
+	if state.Organization != organization || state.Project != project {
+		return nil, cli.NewExitError(fmt.Sprintf("the state file is for %s/%s, not %s/%s", state.Organization, state.Project, organization, project), 1)
+	}
+	batchRun, exitErr := GetBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, state.BatchRunNumber)
+	if exitErr != nil {
+		return nil, exitErr
+	}
+	printMessage(printResult, "test result page:\n")
+	printMessage(printResult, "%s\n", batchRun.Url)
+	result, err := waitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, state.waitLimit(), printResult,
+		state.progress(statePath, true))
+	return result, toExitError(err)
+}
+
+func (s *WaitState) waitLimit() WaitLimit {
+	return WaitLimit{Seconds: s.WaitLimit, Auto: s.AutoWaitLimit}
+}
+
+func (s *WaitState) progress(statePath string, resumed bool) waitProgress {
+	return waitProgress{
+		resumed:       resumed,
+		passedSeconds: int(time.Since(s.StartedAt).Seconds()),
+		finished:      s.FinishedTestCases,
+		onProgress: func(finished int) {
+			s.FinishedTestCases = finished
+			if err := s.Save(statePath); err != nil {
+				// the wait itself goes on
+				fmt.Fprintf(os.Stderr, "failed to save the state file: %s\n", err)
+			}
+		},
+	}
+}
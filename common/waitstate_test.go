@@ -0,0 +1,160 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func TestWaitStateSaveAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	state := NewWaitState("org", "project", &BatchRun{BatchRunNumber: 8, Url: "https://example.com/8"}, 1, "main",
+		`{"model": "iPhone 15"}`, WaitLimit{Auto: true})
+	state.FinishedTestCases = 3
+	if err := state.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadWaitState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.StartedAt.Equal(state.StartedAt) {
+		t.Errorf("StartedAt = %s, want %s", loaded.StartedAt, state.StartedAt)
+	}
+	var setting bytes.Buffer
+	if err := json.Compact(&setting, loaded.Setting); err != nil || setting.String() != `{"model":"iPhone 15"}` {
+		t.Errorf("Setting = %s, %v", loaded.Setting, err)
+	}
+	// the monotonic clock reading is not saved, and the setting is indented
+	loaded.StartedAt, loaded.Setting = state.StartedAt, state.Setting
+	if !reflect.DeepEqual(loaded, state) {
+		t.Errorf("LoadWaitState() = %+v, want %+v", loaded, state)
+	}
+
+	for name, content := range map[string]string{"broken.json": "{", "empty.json": `{"organization": "org"}`} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadWaitState(path); err == nil {
+			t.Errorf("LoadWaitState(%s) succeeded", name)
+		}
+	}
+}
+
+// fakeProgressServer returns the batch run #8 with 4 test cases, finishing finished[i] of them at the i-th poll
+// and running until the last one. The number of polls is counted in polls
+func fakeProgressServer(t *testing.T, finished []int, polls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/org/project/batch-runs/"):
+			w.Write([]byte(`{"batch_runs": []}`)) // no history for the estimate
+		case strings.HasSuffix(r.URL.Path, "/org/project/batch-run/8/"):
+			i := *polls
+			if i >= len(finished) {
+				i = len(finished) - 1
+			}
+			*polls++
+			status := "running"
+			if finished[i] == 4 {
+				status = "succeeded"
+			}
+			fmt.Fprintf(w, `{"batch_run_number": 8, "status": "%s", "url": "https://example.com/8", "test_cases": {"succeeded": %d, "running": %d, "total": 4}}`,
+				status, finished[i], 4-finished[i])
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestResumeWaitForBatchRunCountsFromSavedStart(t *testing.T) {
+	tests := []struct {
+		name      string
+		startedAt time.Duration // before now
+		wantPolls int
+	}{
+		// 500s passed: polls at 500s, 560s and 620s, which is past the limit
+		{"resumed late", 500 * time.Second, 3},
+		// polls every 10s until 120s, and every 60s until past the limit
+		{"resumed at once", 0, 22},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCassette(t) // for sleep
+			polls := 0
+			server := fakeProgressServer(t, []int{0}, &polls)
+			defer server.Close()
+			state := &WaitState{Organization: "org", Project: "project", BatchRunNumber: 8, StartedAt: time.Now().Add(-tt.startedAt), WaitLimit: 600}
+			statePath := filepath.Join(t.TempDir(), "state.json")
+
+			result, exitErr := ResumeWaitForBatchRun(server.URL, "token", "org", "project", map[string]string{}, state, statePath, false)
+			if exitErr == nil || !result.TimedOut {
+				t.Fatalf("ResumeWaitForBatchRun() = %+v, %v, want timeout", result, exitErr)
+			}
+			// the first request gets the batch run before the wait
+			if polls-1 != tt.wantPolls {
+				t.Errorf("polled %d times, want %d", polls-1, tt.wantPolls)
+			}
+		})
+	}
+}
+
+func TestResumeWaitForBatchRunShowsOnlyNewlyFinished(t *testing.T) {
+	withCassette(t) // for sleep
+	polls := 0
+	server := fakeProgressServer(t, []int{2, 2, 3, 3, 4}, &polls)
+	defer server.Close()
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	state := &WaitState{Organization: "org", Project: "project", BatchRunNumber: 8, StartedAt: time.Now(), WaitLimit: 600, FinishedTestCases: 2}
+	if err := state.Save(statePath); err != nil {
+		t.Fatal(err)
+	}
+
+	var result *RunResult
+	stdout := captureOutput(t, &os.Stdout, func() {
+		var exitErr *cli.ExitError
+		result, exitErr = ResumeWaitForBatchRun(server.URL, "token", "org", "project", map[string]string{}, state, statePath, true)
+		if exitErr != nil {
+			t.Errorf("ResumeWaitForBatchRun() error = %v", exitErr)
+		}
+	})
+	if result == nil || result.BatchRun.Status != BatchRunStatusSucceeded {
+		t.Fatalf("ResumeWaitForBatchRun() = %+v", result)
+	}
+	if !strings.Contains(stdout, "resume waiting (2/4 finished") {
+		t.Errorf("the resumed progress is not shown:\n%s", stdout)
+	}
+	for progress, want := range map[string]int{"2/4 finished": 1, "3/4 finished": 1, "4/4 finished": 1} {
+		// 2/4 appears only in the resume message
+		if got := strings.Count(stdout, progress); got != want {
+			t.Errorf("%q is shown %d times, want %d:\n%s", progress, got, want, stdout)
+		}
+	}
+	saved, err := LoadWaitState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.FinishedTestCases != 4 {
+		t.Errorf("saved finished test cases = %d, want 4", saved.FinishedTestCases)
+	}
+}
+
+func TestResumeWaitForBatchRunOfAnotherProject(t *testing.T) {
+	state := &WaitState{Organization: "org", Project: "other", BatchRunNumber: 8}
+	if _, exitErr := ResumeWaitForBatchRun("http://127.0.0.1:1", "token", "org", "project", map[string]string{}, state, "", false); exitErr == nil {
+		t.Errorf("the state file of another project is accepted")
+	}
+}
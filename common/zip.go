@@ -0,0 +1,180 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// zipModTime is set to every zip entry so that the same bundle always becomes the same zip.
+// It is the earliest time the zip format can represent
+var zipModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// zipAppDir zips the .app directory into a new temporary directory, and returns the path of the zip.
+// The caller must remove the directory of the zip. The entries are in path order with fixed timestamps,
+// and symlinks and permissions inside the bundle are kept
+func zipAppDir(dirPath string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "magicpod-app-")
+	if err != nil {
+		return "", err
+	}
+	zipPath := filepath.Join(tmpDir, filepath.Base(dirPath)+".zip")
+	if err := writeAppZip(dirPath, zipPath); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return zipPath, nil
+}
+
+func writeAppZip(dirPath string, zipPath string) error {
+	f, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	baseName := filepath.Base(dirPath)
+	// filepath.Walk visits the files in lexical order and does not follow symlinks
+	err = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(baseName, relPath))
+		header.Modified = zipModTime
+		header.Method = zip.Deflate
+		if info.IsDir() {
+			header.Name += "/"
+			header.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, target) // the content of a symlink entry is its target
+			return err
+		case info.Mode().IsRegular():
+			src, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			_, err = io.Copy(w, src)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// validateAppBundle checks that the .app directory has Info.plist and the executable,
+// at the top level (iOS) or in Contents (macOS).
+// The executable is named by CFBundleExecutable of Info.plist, in the XML or the binary format, since the bundle may be renamed.
+// If Info.plist cannot be read, the executable is not checked and a warning is printed
+func validateAppBundle(dirPath string) error {
+	root := dirPath
+	executableDir := dirPath
+	plist, err := os.Stat(filepath.Join(dirPath, "Info.plist"))
+	if err != nil {
+		root = filepath.Join(dirPath, "Contents")
+		executableDir = filepath.Join(root, "MacOS")
+		if plist, err = os.Stat(filepath.Join(root, "Info.plist")); err != nil {
+			return fmt.Errorf("%s has no Info.plist", dirPath)
+		}
+	}
+	if !plist.Mode().IsRegular() || plist.Size() == 0 {
+		return fmt.Errorf("%s has an empty Info.plist", dirPath)
+	}
+	executable, err := bundleExecutable(filepath.Join(root, "Info.plist"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: the executable of %s is not checked: %s\n", dirPath, err)
+		return nil
+	}
+	stat, err := os.Stat(filepath.Join(executableDir, executable))
+	if err != nil || !stat.Mode().IsRegular() {
+		return fmt.Errorf("%s has no executable %s", dirPath, executable)
+	}
+	return nil
+}
+
+// bundleExecutable returns CFBundleExecutable of Info.plist in the XML or the binary format
+func bundleExecutable(plistPath string) (string, error) {
+	content, err := os.ReadFile(plistPath)
+	if err != nil {
+		return "", err
+	}
+	var executable string
+	if bytes.HasPrefix(content, []byte(binaryPlistMagic)) {
+		executable, err = binaryPlistString(content, "CFBundleExecutable")
+	} else {
+		executable, err = xmlPlistString(content, "CFBundleExecutable")
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot read Info.plist: %s", err)
+	}
+	if executable == "" {
+		return "", fmt.Errorf("Info.plist has no CFBundleExecutable")
+	}
+	return executable, nil
+}
+
+// xmlPlistString returns the string value of the key in the XML plist, or "" if there is no such key
+func xmlPlistString(content []byte, key string) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	isKey := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var text string
+		switch element.Name.Local {
+		case "key":
+			if err := decoder.DecodeElement(&text, &element); err != nil {
+				return "", err
+			}
+			isKey = text == key
+		case "string":
+			if err := decoder.DecodeElement(&text, &element); err != nil {
+				return "", err
+			}
+			if isKey {
+				return text, nil
+			}
+			isKey = false
+		default:
+			isKey = false
+		}
+	}
+}
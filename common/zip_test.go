@@ -0,0 +1,140 @@
+package common
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const xmlInfoPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>CFBundleExecutable</key>
+	<string>MyApp</string>
+</dict>
+</plist>
+`
+
+// binaryInfoPlist is {"CFBundleExecutable": "MyApp", "CFBundleIdentifier": "com.example.MyApp"} in the binary format
+const binaryInfoPlist = "bplist00\xd2\x01\x02\x03\x04_\x10\x12CFBundleExecutable_\x10\x12CFBundleIdentifierUMyApp_\x10\x11com.example.MyApp" +
+	"\x08\x0d\x22\x37\x3d" + "\x00\x00\x00\x00\x00\x00\x01\x01" + "\x00\x00\x00\x00\x00\x00\x00\x05" +
+	"\x00\x00\x00\x00\x00\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x51"
+
+// utf16InfoPlist is {"CFBundleExecutable": "MyÄpp"} in the binary format, which stores a non ASCII string in UTF-16
+const utf16InfoPlist = "bplist00\xd1\x01\x02_\x10\x12CFBundleExecutablee\x00M\x00y\x00\xc4\x00p\x00p" +
+	"\x08\x0b\x20" + "\x00\x00\x00\x00\x00\x00\x01\x01" + "\x00\x00\x00\x00\x00\x00\x00\x03" +
+	"\x00\x00\x00\x00\x00\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x2b"
+
+func TestValidateAppBundle(t *testing.T) {
+	tests := []struct {
+		name    string
+		bundle  string
+		files   map[string]string
+		wantErr bool
+	}{
+		{"xml plist with executable", "MyApp.app", map[string]string{"Info.plist": xmlInfoPlist, "MyApp": "bin"}, false},
+		{"renamed bundle with xml plist", "MyApp-Debug.app", map[string]string{"Info.plist": xmlInfoPlist, "MyApp": "bin"}, false},
+		{"renamed bundle with binary plist", "MyApp-Debug.app", map[string]string{"Info.plist": binaryInfoPlist, "MyApp": "bin"}, false},
+		{"executable named in binary plist is missing", "MyApp.app", map[string]string{"Info.plist": binaryInfoPlist, "Other": "bin"}, true},
+		{"binary plist with utf-16 executable name", "MyApp.app", map[string]string{"Info.plist": utf16InfoPlist, "MyÄpp": "bin"}, false},
+		{"unreadable binary plist is not checked", "MyApp.app", map[string]string{"Info.plist": "bplist00\x01"}, false},
+		{"macOS bundle", "MyApp.app", map[string]string{"Contents/Info.plist": xmlInfoPlist, "Contents/MacOS/MyApp": "bin"}, false},
+		{"executable named in plist is missing", "MyApp.app", map[string]string{"Info.plist": xmlInfoPlist}, true},
+		{"empty plist", "MyApp.app", map[string]string{"Info.plist": "", "MyApp": "bin"}, true},
+		{"no plist", "MyApp.app", map[string]string{"MyApp": "bin"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), tt.bundle)
+			for name, content := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := validateAppBundle(dir)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateAppBundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestZipAppDirIsDeterministic(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "MyApp.app")
+	for name, content := range map[string]string{"Info.plist": xmlInfoPlist, "MyApp": "bin", "Frameworks/A/Lib": "lib"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "MyApp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("A", filepath.Join(dir, "Frameworks", "Current")); err != nil {
+		t.Fatal(err)
+	}
+
+	zipBytes := func() []byte {
+		t.Helper()
+		zipPath, err := zipAppDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(filepath.Dir(zipPath))
+		content, err := os.ReadFile(zipPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	first := zipBytes()
+	// a rebuild of the same bundle only changes the timestamps
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "MyApp"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if second := zipBytes(); !bytes.Equal(first, second) {
+		t.Fatal("zipping the same bundle twice gives different bytes")
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]*zip.File{}
+	for _, f := range reader.File {
+		if !f.Modified.Equal(zipModTime) {
+			t.Errorf("%s has the timestamp %s, want %s", f.Name, f.Modified, zipModTime)
+		}
+		entries[f.Name] = f
+	}
+	if f := entries["MyApp.app/MyApp"]; f == nil || f.Mode()&0111 == 0 {
+		t.Errorf("the executable bit of MyApp.app/MyApp is not kept")
+	}
+	if f := entries["MyApp.app/Info.plist"]; f == nil || f.Mode()&0111 != 0 {
+		t.Errorf("MyApp.app/Info.plist must not be executable")
+	}
+	link := entries["MyApp.app/Frameworks/Current"]
+	if link == nil || link.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("MyApp.app/Frameworks/Current is not kept as a symlink")
+	}
+	rc, err := link.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if target, _ := io.ReadAll(rc); string(target) != "A" {
+		t.Errorf("the symlink points to %q, want \"A\"", target)
+	}
+}
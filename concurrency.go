@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+func concurrencyFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "concurrency_group",
+			Usage: "Name of the group of jobs which share --concurrency_limit. The jobs wait in the order they came until the running batch runs of the group become fewer than the limit",
+		},
+		cli.IntFlag{
+			Name:  "concurrency_limit",
+			Usage: "Number of the batch runs of --concurrency_group which can run at once",
+			Value: 1,
+		},
+		cli.StringFlag{
+			Name:   "lease_server",
+			Usage:  "URL of the lease-server shared by the jobs on several hosts. The jobs on this host are coordinated by files in the state directory if omitted",
+			EnvVar: "MAGICPOD_LEASE_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "lease_secret",
+			Usage:  "Shared secret of --lease_server, which is given to lease-server by --secret",
+			EnvVar: "MAGICPOD_LEASE_SECRET",
+		},
+	}
+}
+
+// acquireConcurrencySlot waits for a slot of --concurrency_group, and returns the function to free it with the result of the wait.
+// The slot of a batch run left running at timeout is kept until a waiting job sees it finished, so that the limit is kept
+func acquireConcurrencySlot(c *cli.Context, urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string) (func(result *common.RunResult), error) {
+	group := c.String("concurrency_group")
+	if group == "" {
+		return func(*common.RunResult) {}, nil
+	}
+	limit := c.Int("concurrency_limit")
+	if limit < 1 {
+		return nil, cli.NewExitError("--concurrency_limit option must be 1 or more", 1)
+	}
+	var store common.LeaseStore
+	if serverURL := c.String("lease_server"); serverURL != "" {
+		store = common.NewHTTPLeaseStore(serverURL, c.String("lease_secret"))
+	} else {
+		var err error
+		if store, err = common.NewFileLeaseStore(""); err != nil {
+			return nil, cli.NewExitError(fmt.Sprintf("failed to prepare concurrency group '%s': %s", group, err), 1)
+		}
+	}
+	lease, err := common.AcquireLease(context.Background(), store, group, limit, func(position int) {
+		fmt.Printf("waiting for a slot of concurrency group '%s' (position %d in the queue)\n", group, position)
+	}, batchRunFinished(urlBase, apiToken, organization, project, httpHeadersMap))
+	if err != nil {
+		return nil, cli.NewExitError(fmt.Sprintf("failed to get a slot of concurrency group '%s': %s", group, err), 1)
+	}
+	return func(result *common.RunResult) {
+		if result != nil && result.BatchRun != nil && !result.BatchRun.Status.IsTerminal() {
+			batchRun := common.LeasedBatchRun{URLBase: urlBase, Organization: organization, Project: project, BatchRunNumber: result.BatchRun.BatchRunNumber}
+			if err := lease.Detach(batchRun); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to keep the slot of concurrency group '%s' for batch run #%d: %s\n", group, batchRun.BatchRunNumber, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "the slot of concurrency group '%s' is kept until batch run #%d finishes\n", group, batchRun.BatchRunNumber)
+			}
+			return
+		}
+		if err := lease.Release(); err != nil {
+			// the slot expires soon anyway
+			fmt.Fprintf(os.Stderr, "failed to free the slot of concurrency group '%s': %s\n", group, err)
+		}
+	}, nil
+}
+
+// batchRunFinished checks the batch run of a detached slot with the API token of this job.
+// The token is sent only to the server, organization and project of this job, since the detached slots may come from anyone
+// who can reach the lease server. The slots of the others are left until they expire
+func batchRunFinished(urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string) func(batchRun common.LeasedBatchRun) bool {
+	return func(batchRun common.LeasedBatchRun) (finished bool) {
+		if batchRun.URLBase != urlBase || batchRun.Organization != organization || batchRun.Project != project {
+			return false
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(error); !ok {
+					panic(r)
+				}
+				finished = false // a network error. checked again later
+			}
+		}()
+		run, exitErr := common.GetBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun.BatchRunNumber)
+		return exitErr == nil && run.Status.IsTerminal()
+	}
+}
+
+func leaseServerFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen, l",
+			Usage: "Address to listen on",
+			Value: ":9734",
+		},
+		cli.StringFlag{
+			Name:   "secret",
+			Usage:  "Shared secret which the jobs must pass by --lease_secret. Only the clients on this host are accepted if omitted",
+			EnvVar: "MAGICPOD_LEASE_SECRET",
+		},
+	}
+}
+
+// leaseServerAction serves the queues of the concurrency groups for batch-run --lease_server. The queues are kept in memory
+func leaseServerAction(c *cli.Context) error {
+	address := c.String("listen")
+	fmt.Printf("serving concurrency groups on %s\n", address)
+	if err := http.ListenAndServe(address, common.LeaseHandler(c.String("secret"))); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
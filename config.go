@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+// networkConfigKeys are the global options which can also be given by the config file
+var networkConfigKeys = []string{"proxy", "no_proxy", "ca_cert", "client_cert", "client_key", "connect_timeout", "read_timeout"}
+
+func networkFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Path to the config file in JSON format whose keys are the global option names (e.g. '{\"proxy\":\"http://proxy:8080\"}'). magicpod-api-client/config.json in the user config directory (e.g. ~/.config on Linux) is used if it exists",
+			EnvVar: "MAGICPOD_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Usage:  "Proxy URL. If not specified, HTTPS_PROXY and HTTP_PROXY are used",
+			EnvVar: "MAGICPOD_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "no_proxy",
+			Usage:  "Comma separated hosts which are connected without the proxy. If not specified, NO_PROXY is used",
+			EnvVar: "MAGICPOD_NO_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "ca_cert",
+			Usage:  "PEM file of additional root CA certificates, e.g. of a TLS-intercepting proxy",
+			EnvVar: "MAGICPOD_CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "client_cert",
+			Usage:  "PEM file of the client certificate for mTLS",
+			EnvVar: "MAGICPOD_CLIENT_CERT",
+		},
+		cli.StringFlag{
+			Name:   "client_key",
+			Usage:  "PEM file of the client key for mTLS",
+			EnvVar: "MAGICPOD_CLIENT_KEY",
+		},
+		cli.StringFlag{
+			Name:   "connect_timeout",
+			Usage:  "Timeout of connecting to the server (e.g. 10s). The default value is 30s",
+			EnvVar: "MAGICPOD_CONNECT_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "read_timeout",
+			Usage:  "Timeout of waiting for a response after sending a request (e.g. 5m). No limit by default",
+			EnvVar: "MAGICPOD_READ_TIMEOUT",
+		},
+	}
+}
+
+// loadConfigFile reads the config file. It returns an empty config if no file is specified and the default one does not exist
+func loadConfigFile(c *cli.Context) (map[string]string, error) {
+	config := map[string]string{}
+	path := c.GlobalString("config")
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return config, nil
+		}
+		path = filepath.Join(configDir, "magicpod-api-client", "config.json")
+		if _, err := os.Stat(path); err != nil {
+			return config, nil
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the config file: %s", err)
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("config file %s must be a JSON object whose keys and values are string: %s", path, err)
+	}
+	return config, nil
+}
+
+// globalOption returns the value of a global option, falling back to the config file
+func globalOption(c *cli.Context, config map[string]string, name string) string {
+	if value := c.GlobalString(name); value != "" {
+		return value
+	}
+	return config[name]
+}
+
+func configureNetwork(c *cli.Context) error {
+	config, err := loadConfigFile(c)
+	if err != nil {
+		return err
+	}
+	for key := range config {
+		known := false
+		for _, configKey := range networkConfigKeys {
+			known = known || key == configKey
+		}
+		if !known {
+			return fmt.Errorf("unknown key in the config file: %s", key)
+		}
+	}
+	options := common.HTTPOptions{
+		ProxyURL:       globalOption(c, config, "proxy"),
+		NoProxy:        globalOption(c, config, "no_proxy"),
+		CACertPath:     globalOption(c, config, "ca_cert"),
+		ClientCertPath: globalOption(c, config, "client_cert"),
+		ClientKeyPath:  globalOption(c, config, "client_key"),
+	}
+	if value := globalOption(c, config, "connect_timeout"); value != "" {
+		if options.ConnectTimeout, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("connect_timeout must be a duration like 10s: %s", value)
+		}
+	}
+	if value := globalOption(c, config, "read_timeout"); value != "" {
+		if options.ReadTimeout, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("read_timeout must be a duration like 5m: %s", value)
+		}
+	}
+	return common.ConfigureHTTP(options)
+}
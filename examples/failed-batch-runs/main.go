@@ -0,0 +1,44 @@
+// failed-batch-runs lists the failed batch runs of a branch in the last 7 days with their failed test cases.
+//
+//	MAGICPOD_API_TOKEN=... go run ./examples/failed-batch-runs <organization> <project> <branch>
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/magicpod"
+)
+
+func main() {
+	if len(os.Args) != 4 {
+		log.Fatal("usage: failed-batch-runs <organization> <project> <branch>")
+	}
+	client := magicpod.NewClient(os.Getenv("MAGICPOD_API_TOKEN"), os.Args[1], os.Args[2])
+	options := magicpod.BatchRunsOptions{Filter: magicpod.BatchRunFilter{
+		Statuses:   []magicpod.BatchRunStatus{magicpod.BatchRunStatusFailed},
+		BranchName: os.Args[3],
+		Since:      time.Now().AddDate(0, 0, -7),
+	}}
+	for batchRun, err := range client.BatchRunDetails(context.Background(), options, 4) {
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("#%d %s\n", batchRun.BatchRunNumber, batchRun.URL)
+		for _, detail := range batchRun.Details {
+			for _, result := range detail.Results {
+				if result.Status != "failed" {
+					continue
+				}
+				if detail.PatternName != "" {
+					fmt.Printf("  %s: %s\n", detail.PatternName, result.TestCase.Name)
+				} else {
+					fmt.Printf("  %s\n", result.TestCase.Name)
+				}
+			}
+		}
+	}
+}
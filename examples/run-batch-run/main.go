@@ -0,0 +1,58 @@
+// run-batch-run uploads an app, runs a batch run for it, and deletes the app if the batch run passed.
+//
+//	MAGICPOD_API_TOKEN=... go run ./examples/run-batch-run <organization> <project> <test_settings_number> <app_path>
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/Magic-Pod/magicpod-api-client/magicpod"
+)
+
+func main() {
+	if len(os.Args) != 5 {
+		log.Fatal("usage: run-batch-run <organization> <project> <test_settings_number> <app_path>")
+	}
+	testSettingsNumber, err := strconv.Atoi(os.Args[3])
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := magicpod.NewClient(os.Getenv("MAGICPOD_API_TOKEN"), os.Args[1], os.Args[2])
+	os.Exit(run(client, testSettingsNumber, os.Args[4]))
+}
+
+// run takes magicpod.API rather than *magicpod.Client, so that it can be tested with a mock
+func run(api magicpod.API, testSettingsNumber int, appPath string) int {
+	fileNo, err := api.UploadApp(appPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := api.RunBatchRun(magicpod.RunOptions{
+		TestSettingsNumber: testSettingsNumber,
+		Setting:            fmt.Sprintf(`{"app_file_number":%d}`, fileNo),
+		Wait:               true,
+		WaitOptions:        magicpod.WaitOptions{AutoWaitLimit: true},
+	})
+	if err != nil {
+		log.Print(err)
+		if result != nil && result.TimedOut {
+			return 3
+		}
+		return 1
+	}
+	fmt.Printf("%s: %s (%d/%d succeeded)\n", result.BatchRun.URL, result.BatchRun.Status,
+		result.BatchRun.TestCases.Succeeded, result.BatchRun.TestCases.Total)
+	switch {
+	case result.HasFailures:
+		return 1
+	case result.HasUnresolved:
+		return 2
+	}
+	if err := api.DeleteApp(fileNo); err != nil {
+		log.Print(err)
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+func exitPolicyFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "fail_on",
+			Usage: "Comma separated conditions which make the exit code non-zero: failed, aborted, unresolved and timeout",
+			Value: "failed,aborted,unresolved,timeout",
+		},
+		cli.IntFlag{
+			Name:  "max_failures",
+			Usage: "Number of failed test cases allowed before 'failed' of --fail_on applies",
+		},
+		cli.Float64Flag{
+			Name:  "min_pass_rate",
+			Usage: "Ratio of succeeded test cases required, e.g. 0.95. Exit code is 1 below it",
+		},
+		cli.StringSliceFlag{
+			Name:  "ignore_pattern",
+			Usage: "Pattern name of a cross batch run whose test cases do not affect the exit code, e.g. an experimental device. Can be specified multiple times",
+		},
+		cli.IntFlag{
+			Name:  "timeout_exit_code",
+			Usage: "Exit code when the wait limit passes",
+			Value: 1,
+		},
+		cli.IntFlag{
+			Name:  "error_exit_code",
+			Usage: "Exit code on errors of the API or the network, as opposed to test failures",
+			Value: 1,
+		},
+	}
+}
+
+func parseExitPolicy(c *cli.Context) (*common.ExitPolicy, error) {
+	policy := common.DefaultExitPolicy()
+	failOn, err := common.ParseFailOn(c.String("fail_on"))
+	if err != nil {
+		return nil, cli.NewExitError(fmt.Sprintf("invalid --fail_on: %s", err), 1)
+	}
+	policy.FailOn = failOn
+	policy.MaxFailures = c.Int("max_failures")
+	if policy.MaxFailures < 0 {
+		return nil, cli.NewExitError("--max_failures option must not be negative", 1)
+	}
+	policy.MinPassRate = c.Float64("min_pass_rate")
+	if policy.MinPassRate < 0 || policy.MinPassRate > 1 {
+		return nil, cli.NewExitError("--min_pass_rate option must be between 0 and 1", 1)
+	}
+	policy.IgnorePatterns = c.StringSlice("ignore_pattern")
+	policy.TimeoutExitCode = c.Int("timeout_exit_code")
+	policy.ErrorExitCode = c.Int("error_exit_code")
+	return policy, nil
+}
+
+// exitByPolicy explains the exit code chosen by the policy on stderr and returns it as an error
+func exitByPolicy(policy *common.ExitPolicy, result *common.RunResult, batchRunError *cli.ExitError) error {
+	decision := policy.Evaluate(result, batchRunError)
+	if len(decision.Reasons) > 0 {
+		fmt.Fprintln(os.Stderr, decision)
+	}
+	if decision.Code == 0 {
+		return nil
+	}
+	return cli.NewExitError("", decision.Code)
+}
+
+// recoverAsErrorExit turns the panic on a network error into the exit code for errors,
+// since the exit code 2 of a panic cannot be told from unresolved test cases.
+// Other panics are bugs, which must not look like errors of the API, so they are not recovered
+func recoverAsErrorExit(policy *common.ExitPolicy, err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(error)
+		if !ok || !isTransportError(e) {
+			panic(r)
+		}
+		*err = cli.NewExitError(e.Error(), policy.ErrorExitCode)
+	}
+}
+
+// apiErrorExit returns the error of the API with the exit code for errors
+func apiErrorExit(policy *common.ExitPolicy, exitErr *cli.ExitError) error {
+	return cli.NewExitError(exitErr.Error(), policy.ErrorExitCode)
+}
+
+// isTransportError tells whether the error is of sending a request or receiving its response
+func isTransportError(err error) bool {
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+func exporterFlags() []cli.Flag {
+	return append(commonFlags(), []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen, l",
+			Usage: "Address to serve /metrics on",
+			Value: ":9733",
+		},
+		cli.IntFlag{
+			Name:  "interval, i",
+			Usage: "Polling interval in seconds",
+			Value: 60,
+		},
+		cli.IntFlag{
+			Name:  "count, c",
+			Usage: "The number of the most recent batch runs to aggregate",
+			Value: 100,
+		},
+		cli.StringFlag{
+			Name:  "textfile",
+			Usage: "Write the metrics once to this .prom file for the node exporter textfile collector and exit",
+		},
+		cli.StringFlag{
+			Name:  "push_url",
+			Usage: "Push the metrics once to this Pushgateway compatible URL and exit",
+		},
+		cli.StringFlag{
+			Name:  "job",
+			Usage: "Job name used for --push_url",
+			Value: "magicpod",
+		},
+	}...)
+}
+
+func exporterAction(c *cli.Context) error {
+	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
+	if err != nil {
+		return err
+	}
+	count := c.Int("count")
+	textfile := c.String("textfile")
+	pushURL := c.String("push_url")
+
+	if textfile != "" || pushURL != "" {
+		var buf bytes.Buffer
+		if exitErr := common.CollectBatchRunMetrics(&buf, urlBase, apiToken, organization, project, httpHeadersMap, count); exitErr != nil {
+			return exitErr
+		}
+		return exportMetrics(buf.String(), textfile, pushURL, c.String("job"), organization, project)
+	}
+
+	interval := c.Int("interval")
+	if interval <= 0 {
+		return cli.NewExitError("--interval option must be a positive number", 1)
+	}
+	var mu sync.RWMutex
+	var metrics []byte
+	go func() {
+		for {
+			var buf bytes.Buffer
+			if exitErr := common.CollectBatchRunMetrics(&buf, urlBase, apiToken, organization, project, httpHeadersMap, count); exitErr != nil {
+				// keep serving the previous metrics
+				fmt.Fprintf(os.Stderr, "failed to collect metrics: %s\n", exitErr)
+			} else {
+				mu.Lock()
+				metrics = buf.Bytes()
+				mu.Unlock()
+			}
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}()
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		defer mu.RUnlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(metrics)
+	})
+	fmt.Printf("serving metrics on %s/metrics\n", c.String("listen"))
+	if err := http.ListenAndServe(c.String("listen"), nil); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+// exportMetrics writes the metrics to the textfile and/or pushes them to the Pushgateway
+func exportMetrics(metrics string, textfile string, pushURL string, job string, organization string, project string) error {
+	if textfile != "" {
+		// write to a temporary file first so that the collector never reads a partial file
+		tmpFile, err := os.CreateTemp(filepath.Dir(textfile), filepath.Base(textfile)+".*.tmp")
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		_, err = tmpFile.WriteString(metrics)
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmpFile.Name(), textfile)
+		}
+		if err != nil {
+			os.Remove(tmpFile.Name())
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if pushURL != "" {
+		if exitErr := common.PushMetrics(pushURL, job, organization, project, metrics); exitErr != nil {
+			return exitErr
+		}
+	}
+	return nil
+}
+
+// exportBatchRunMetrics exports the metrics of a finished batch run as requested by batch-run options
+func exportBatchRunMetrics(c *cli.Context, urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, batchRunNumber int) error {
+	textfile := c.String("metrics_textfile")
+	pushURL := c.String("push_url")
+	if textfile == "" && pushURL == "" {
+		return nil
+	}
+	batchRun, exitErr := common.GetBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
+	if exitErr != nil {
+		return exitErr
+	}
+	var buf bytes.Buffer
+	if err := common.WriteBatchRunMetrics(&buf, organization, project, []common.BatchRunSummary{batchRun.Summary()}, []*common.BatchRun{batchRun}); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return exportMetrics(buf.String(), textfile, pushURL, c.String("job"), organization, project)
+}
@@ -4,25 +4,20 @@ go 1.25.0
 
 require (
 	github.com/go-resty/resty v0.0.0-00010101000000-000000000000
-	github.com/mholt/archiver/v3 v3.3.2
 	github.com/urfave/cli v1.22.5
+	golang.org/x/net v0.55.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.0 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
-	github.com/dsnet/compress v0.0.1 // indirect
-	github.com/frankban/quicktest v1.14.0 // indirect
-	github.com/golang/snappy v0.0.4 // indirect
-	github.com/klauspost/compress v1.10.10 // indirect
-	github.com/klauspost/pgzip v1.2.4 // indirect
-	github.com/nwaples/rardecode v1.1.2 // indirect
-	github.com/pierrec/lz4/v3 v3.3.2 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/russross/blackfriday/v2 v2.0.1 // indirect
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
-	github.com/ulikunitz/xz v0.5.14 // indirect
-	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
-	golang.org/x/net v0.55.0 // indirect
+	golang.org/x/text v0.37.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
+	gopkg.in/resty.v1 v1.12.0 // indirect
 )
 
 replace github.com/go-resty/resty => gopkg.in/resty.v1 v1.11.0
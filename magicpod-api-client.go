@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Magic-Pod/magicpod-api-client/common"
 	"github.com/urfave/cli"
@@ -22,12 +25,65 @@ func main() {
 			Value:  "https://app.magicpod.com",
 			Hidden: true,
 		},
+		cli.StringFlag{
+			Name:   "otlp_endpoint",
+			Usage:  "OTLP/HTTP endpoint to export the trace of this command to (e.g. http://localhost:4318). The trace nests under TRACEPARENT if it is set",
+			EnvVar: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,OTEL_EXPORTER_OTLP_ENDPOINT",
+		},
+		cli.StringFlag{
+			Name:  "trace_file",
+			Usage: "Write the trace of this command to the file in the OTLP JSON format",
+		},
+		cli.BoolFlag{
+			Name:  "trace_test_cases",
+			Usage: "Record a span for each test case result of the waited batch runs",
+		},
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "Log each HTTP request and response (method, path, status, latency, request id) to stderr",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Log also the headers and bodies of HTTP requests and responses. Secrets are redacted",
+		},
+		cli.StringFlag{
+			Name:  "log_format",
+			Usage: "'text' or 'json'",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:  "log_file",
+			Usage: "Write the logs to the file instead of stderr. Implies --verbose",
+		},
+		cli.StringSliceFlag{
+			Name:  "redact_header",
+			Usage: "Name of an additional HTTP header whose value must not be logged, recorded or printed by --dry_run. Can be specified multiple times",
+		},
+		cli.StringFlag{
+			Name:  "record",
+			Usage: "Record every HTTP request and response of this command into the directory. The API token is redacted",
+		},
+		cli.StringFlag{
+			Name:  "replay",
+			Usage: "Serve the HTTP requests of this command from the directory recorded by --record without network access",
+		},
+	}
+	app.Flags = append(app.Flags, networkFlags()...)
+	app.Before = setupGlobalOptions
+	app.After = func(c *cli.Context) error {
+		shutdownGlobalOptions()
+		return nil
+	}
+	app.ExitErrHandler = func(c *cli.Context, err error) {
+		// cli.HandleExitCoder exits the process, so After is not called for errors
+		shutdownGlobalOptions()
+		cli.HandleExitCoder(err)
 	}
 	app.Commands = []cli.Command{
 		{
 			Name:  "batch-run",
 			Usage: "Run batch test",
-			Flags: append(commonFlags(), []cli.Flag{
+			Flags: append(append(commonFlags(), []cli.Flag{
 				cli.IntFlag{
 					Name:  "test_settings_number, S",
 					Usage: "Test settings number defined in the project batch run page",
@@ -40,15 +96,56 @@ func main() {
 					Name:  "setting, s",
 					Usage: "Test setting in JSON format. Please check https://app.magicpod.com/api/v1.0/doc/ for more detail",
 				},
+				cli.StringFlag{
+					Name:  "setting_file, f",
+					Usage: "Path to the test setting file in YAML or JSON format, which can use ${ENV}, {{ .Var }} and 'include'. Cannot be used with --setting",
+				},
+				cli.StringSliceFlag{
+					Name:  "var",
+					Usage: "Variable for --setting_file in name=value format. Can be specified multiple times",
+				},
+				cli.StringSliceFlag{
+					Name:  "matrix",
+					Usage: "Matrix axis in name=value1,value2 format (e.g. os=ios,android), which is expanded into test_settings with the other axes. Can be specified multiple times",
+				},
+				cli.StringSliceFlag{
+					Name:  "matrix_include",
+					Usage: "Additional matrix combination in name=value,name=value format. Can be specified multiple times",
+				},
+				cli.StringSliceFlag{
+					Name:  "matrix_exclude",
+					Usage: "Matrix combinations to remove in name=value,name=value format. Combinations matching all the pairs are removed, also from the matrix block of the setting. Can be specified multiple times",
+				},
 				cli.BoolFlag{
 					Name:  "no_wait, n",
 					Usage: "Return immediately without waiting the batch run to be finished",
 				},
-				cli.IntFlag{
+				cli.StringFlag{
 					Name:  "wait_limit, w",
-					Usage: "Wait limit in seconds. If 0 is specified, the value is test count x 10 minutes",
+					Usage: "Wait limit in seconds. If 0 is specified, the value is test count x 10 minutes. If 'auto' is specified, the value is derived from the durations of the previous batch runs of the same test setting",
 				},
-			}...),
+				cli.StringFlag{
+					Name:  "state_file",
+					Usage: "Save the batch run number, the settings, the start time and the wait limit to this file, so that the 'resume' command can continue waiting for the batch run, e.g. with --no_wait or after the job is killed",
+				},
+				cli.StringFlag{
+					Name:  "metrics_textfile",
+					Usage: "Write the metrics of the finished batch run to this .prom file for the node exporter textfile collector",
+				},
+				cli.StringFlag{
+					Name:  "push_url",
+					Usage: "Push the metrics of the finished batch run to this Pushgateway compatible URL",
+				},
+				cli.StringFlag{
+					Name:  "job",
+					Usage: "Job name used for --push_url",
+					Value: "magicpod",
+				},
+				cli.BoolFlag{
+					Name:  "dry_run",
+					Usage: "Print the request to be sent (the API token is redacted) without sending it",
+				},
+			}...), append(append(append(append(reattachFlags(), slotFlags()...), concurrencyFlags()...), timeoutFlags()...), exitPolicyFlags()...)...),
 			Action: batchRunAction,
 		},
 		{
@@ -81,6 +178,44 @@ func main() {
 					Usage:    "The least recent batch run number to stop retrieving records at.",
 					Required: false,
 				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Retrieve all the records page by page, ignoring --count",
+				},
+				cli.StringSliceFlag{
+					Name:  "status",
+					Usage: "Retrieve only the records of the status (e.g. failed). Can be specified multiple times or comma separated",
+				},
+				cli.StringFlag{
+					Name:  "test_setting_name",
+					Usage: "Retrieve only the records of the test setting",
+				},
+				cli.StringFlag{
+					Name:  "branch",
+					Usage: "Retrieve only the records of the branch",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Retrieve only the records started at or after the date (e.g. 2026-10-01) or time in RFC 3339 format",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Retrieve only the records started before the time in RFC 3339 format, or by the end of the date (e.g. 2026-10-31)",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "Sort the records by 'number', 'started_at', 'finished_at' or 'duration'. The records without the value, e.g. the unfinished ones for 'finished_at', come last. The records are output after all of them are retrieved",
+				},
+				cli.StringFlag{
+					Name:  "order",
+					Usage: "Order of --sort, 'asc' or 'desc'",
+					Value: "desc",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "'json' or 'ndjson' (one record per line, output as soon as retrieved)",
+					Value: "json",
+				},
 			}...),
 			Action: getBatchRunsAction,
 		},
@@ -98,6 +233,14 @@ func main() {
 					Name:  "app_path, a",
 					Usage: "Path to the app/ipa/apk file to upload",
 				},
+				cli.BoolFlag{
+					Name:  "reuse_if_identical",
+					Usage: "Return the file number of the identical app uploaded before from this machine instead of uploading it again, unless it was deleted by delete-app or run-app on this machine",
+				},
+				cli.BoolFlag{
+					Name:  "dry_run",
+					Usage: "Print the request to be sent (the API token is redacted) without sending it",
+				},
 			}...),
 			Action: uploadAppAction,
 		},
@@ -109,6 +252,10 @@ func main() {
 					Name:  "app_file_number, a",
 					Usage: "File number of the uploaded file",
 				},
+				cli.BoolFlag{
+					Name:  "dry_run",
+					Usage: "Print the request to be sent (the API token is redacted) without sending it",
+				},
 			}...),
 			Action: deleteAppAction,
 		},
@@ -154,18 +301,29 @@ func main() {
 		{
 			Name:  "wait-for-batch-run",
 			Usage: "Wait until a batch run ends",
-			Flags: append(commonFlags(), []cli.Flag{
+			Flags: append(append(commonFlags(), []cli.Flag{
 				cli.IntFlag{
 					Name:  "batch_run_number, b",
 					Usage: "Batch run number",
 				},
-				cli.IntFlag{
+				cli.StringFlag{
 					Name:  "wait_limit, w",
-					Usage: "Wait limit in seconds. If 0 is specified, the value is test count x 10 minutes",
+					Usage: "Wait limit in seconds. If 0 is specified, the value is test count x 10 minutes. If 'auto' is specified, the value is derived from the durations of the previous batch runs of the same test setting",
 				},
-			}...),
+			}...), append(timeoutFlags(), exitPolicyFlags()...)...),
 			Action: waitForBatchRunAction,
 		},
+		{
+			Name:  "resume",
+			Usage: "Continue waiting for the batch run saved by batch-run --state_file with the rest of the wait limit",
+			Flags: append(append(commonFlags(), []cli.Flag{
+				cli.StringFlag{
+					Name:  "state_file",
+					Usage: "State file saved by batch-run --state_file",
+				},
+			}...), append(timeoutFlags(), exitPolicyFlags()...)...),
+			Action: resumeAction,
+		},
 		{
 			Name:  "upload-data-pattern-csv",
 			Usage: "Upload data pattern CSV file",
@@ -190,13 +348,106 @@ func main() {
 					Name:  "quiet, q",
 					Usage: "Do not output any logs during upload. Disabled by default",
 				},
+				cli.BoolFlag{
+					Name:  "dry_run",
+					Usage: "Print the request to be sent (the API token is redacted) without sending it",
+				},
 			}...),
 			Action: uploadDataPatternCsvAction,
 		},
+		{
+			Name:   "list-apps",
+			Usage:  "List the app files uploaded to the project",
+			Flags:  commonFlags(),
+			Action: listAppsAction,
+		},
+		{
+			Name:   "prune-apps",
+			Usage:  "Delete old app files, keeping the newest ones and the ones used by running batch runs",
+			Flags:  pruneAppsFlags(),
+			Action: pruneAppsAction,
+		},
+		{
+			Name:   "run-app",
+			Usage:  "Upload app, run batch test for it, wait until the batch run is finished, and delete the app according to --cleanup",
+			Flags:  runAppFlags(),
+			Action: runAppAction,
+		},
+		{
+			Name:      "api",
+			Usage:     "Call an arbitrary endpoint of MagicPod Web API (see https://app.magicpod.com/api/v1.0/doc/)",
+			ArgsUsage: "[METHOD] PATH",
+			Flags:     apiFlags(),
+			Action:    apiAction,
+		},
+		{
+			Name:   "exporter",
+			Usage:  "Serve the batch run results as Prometheus metrics, or write/push them once",
+			Flags:  exporterFlags(),
+			Action: exporterAction,
+		},
+		{
+			Name:   "lease-server",
+			Usage:  "Serve the queues of batch-run --concurrency_group for the jobs on several hosts",
+			Flags:  leaseServerFlags(),
+			Action: leaseServerAction,
+		},
 	}
 	app.Run(os.Args)
 }
 
+var logFile *os.File
+
+func setupGlobalOptions(c *cli.Context) error {
+	if err := configureNetwork(c); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	// before recording starts, as the headers are redacted also in the recorded sessions
+	common.SetRedactHeaders(c.GlobalStringSlice("redact_header"))
+	if c.GlobalString("record") != "" && c.GlobalString("replay") != "" {
+		return cli.NewExitError("--record and --replay cannot be specified at the same time", 1)
+	}
+	if recordDir := c.GlobalString("record"); recordDir != "" {
+		if err := common.SetupRecording(recordDir); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if replayDir := c.GlobalString("replay"); replayDir != "" {
+		if err := common.SetupReplay(replayDir); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if err := common.SetupTracing(c.GlobalString("otlp_endpoint"), c.GlobalString("trace_file"), c.GlobalBool("trace_test_cases")); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	logFilePath := c.GlobalString("log_file")
+	if c.GlobalBool("verbose") || c.GlobalBool("debug") || logFilePath != "" {
+		logWriter := os.Stderr
+		if logFilePath != "" {
+			var err error
+			logFile, err = os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("failed to open the log file: %s", err), 1)
+			}
+			logWriter = logFile
+		}
+		if err := common.SetupLogging(logWriter, c.GlobalString("log_format"), c.GlobalBool("debug")); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	return nil
+}
+
+func shutdownGlobalOptions() {
+	if err := common.ShutdownTracing(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to export the trace: %s\n", err)
+	}
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+}
+
 func getBatchRunAction(c *cli.Context) error {
 	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
 	if err != nil {
@@ -231,11 +482,85 @@ func getBatchRunsAction(c *cli.Context) error {
 	if maxBatchRunNumber != 0 && minBatchRunNumber != 0 && maxBatchRunNumber < minBatchRunNumber {
 		return cli.NewExitError("--max_batch_run_number value is smaller than --min_batch_run_number value", 1)
 	}
-	batchRuns, exitErr := common.GetBatchRuns(urlBase, apiToken, organization, project, httpHeadersMap, count, maxBatchRunNumber, minBatchRunNumber)
+	filter, err := parseBatchRunFilter(c)
+	if err != nil {
+		return err
+	}
+	all := c.Bool("all")
+	sortKey := c.String("sort")
+	if sortKey != "" {
+		// checked before retrieving the batch runs, which may take many requests with --all
+		if common.ValidateBatchRunSortKey(sortKey) != nil {
+			return cli.NewExitError(fmt.Sprintf("--sort option must be 'number', 'started_at', 'finished_at' or 'duration', not '%s'", sortKey), 1)
+		}
+	}
+	order := c.String("order")
+	if order != "asc" && order != "desc" {
+		return cli.NewExitError("--order option must be 'asc' or 'desc'", 1)
+	}
+	format := c.String("format")
+	if format != "json" && format != "ndjson" {
+		return cli.NewExitError("--format option must be 'json' or 'ndjson'", 1)
+	}
+
+	if !all && filter.IsEmpty() && sortKey == "" && format == "json" {
+		batchRuns, exitErr := common.GetBatchRuns(urlBase, apiToken, organization, project, httpHeadersMap, count, maxBatchRunNumber, minBatchRunNumber)
+		if exitErr != nil {
+			return exitErr
+		}
+		b, err := json.Marshal(batchRuns)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	// stream the records unless they have to be sorted or wrapped in a single JSON
+	stream := format == "ndjson" && sortKey == ""
+	encoder := json.NewEncoder(os.Stdout)
+	pageSize := count
+	if all || !filter.IsEmpty() {
+		pageSize = common.BatchRunsPageSize
+	}
+	batchRuns := []common.BatchRunSummary{}
+	found := 0
+	var encodeErr error
+	exitErr := common.WalkBatchRuns(urlBase, apiToken, organization, project, httpHeadersMap, filter, pageSize, maxBatchRunNumber, minBatchRunNumber,
+		func(batchRun common.BatchRunSummary) bool {
+			found++
+			if stream {
+				if encodeErr = encoder.Encode(batchRun); encodeErr != nil {
+					return false // e.g. the pipe is closed
+				}
+			} else {
+				batchRuns = append(batchRuns, batchRun)
+			}
+			return all || found < count
+		})
 	if exitErr != nil {
 		return exitErr
 	}
-	b, err := json.Marshal(batchRuns)
+	if encodeErr != nil {
+		return cli.NewExitError(encodeErr.Error(), 1)
+	}
+	if stream {
+		return nil
+	}
+	if sortKey != "" {
+		if err := common.SortBatchRuns(batchRuns, sortKey, order == "desc"); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if format == "ndjson" {
+		for _, batchRun := range batchRuns {
+			if err := encoder.Encode(batchRun); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+		}
+		return nil
+	}
+	b, err := json.Marshal(common.BatchRuns{OrganizationName: organization, ProjectName: project, BatchRuns: batchRuns})
 	if err != nil {
 		return err
 	}
@@ -243,6 +568,48 @@ func getBatchRunsAction(c *cli.Context) error {
 	return nil
 }
 
+// parseBatchRunFilter returns the client side filter given by the options of get-batch-runs
+func parseBatchRunFilter(c *cli.Context) (common.BatchRunFilter, error) {
+	filter := common.BatchRunFilter{
+		TestSettingName: c.String("test_setting_name"),
+		BranchName:      c.String("branch"),
+	}
+	for _, status := range c.StringSlice("status") {
+		for _, s := range strings.Split(status, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				filter.Statuses = append(filter.Statuses, s)
+			}
+		}
+	}
+	if since := c.String("since"); since != "" {
+		t, _, err := parseDateOrTime(since)
+		if err != nil {
+			return filter, cli.NewExitError(fmt.Sprintf("--since must be a date like 2026-10-01 or a time in RFC 3339 format: %s", since), 1)
+		}
+		filter.Since = t
+	}
+	if until := c.String("until"); until != "" {
+		t, isDate, err := parseDateOrTime(until)
+		if err != nil {
+			return filter, cli.NewExitError(fmt.Sprintf("--until must be a date like 2026-10-31 or a time in RFC 3339 format: %s", until), 1)
+		}
+		if isDate {
+			t = t.AddDate(0, 0, 1) // include the whole day
+		}
+		filter.Until = t
+	}
+	return filter, nil
+}
+
+// parseDateOrTime parses a date in the local time zone or a time in RFC 3339 format. The second return value is true for a date
+func parseDateOrTime(value string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
 func latestBatchRunNoAction(c *cli.Context) error {
 	// handle command line arguments
 	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
@@ -268,7 +635,27 @@ func uploadAppAction(c *cli.Context) error {
 	if appPath == "" {
 		return cli.NewExitError("--app_path option is required", 1)
 	}
+	if c.Bool("dry_run") {
+		req, exitErr := common.DryRunUploadApp(urlBase, organization, project, httpHeadersMap, appPath)
+		if exitErr != nil {
+			return exitErr
+		}
+		fmt.Println(req)
+		return nil
+	}
 
+	if c.Bool("reuse_if_identical") {
+		fileNo, reused, exitErr := common.UploadAppIfChanged(urlBase, apiToken, organization, project, httpHeadersMap, appPath)
+		if exitErr != nil {
+			return exitErr
+		}
+		if reused {
+			// stdout is kept only for the file number
+			fmt.Fprintf(os.Stderr, "identical app is already uploaded\n")
+		}
+		fmt.Printf("%d\n", fileNo)
+		return nil
+	}
 	fileNo, exitErr := common.UploadApp(urlBase, apiToken, organization, project, httpHeadersMap, appPath)
 	if exitErr != nil {
 		return exitErr
@@ -287,10 +674,15 @@ func deleteAppAction(c *cli.Context) error {
 	if appFileNumber == 0 {
 		return cli.NewExitError("--app_file_number option is not specified or 0", 1)
 	}
+	if c.Bool("dry_run") {
+		fmt.Println(common.DryRunDeleteApp(urlBase, organization, project, httpHeadersMap, appFileNumber))
+		return nil
+	}
 	exitErr := common.DeleteApp(urlBase, apiToken, organization, project, httpHeadersMap, appFileNumber)
 	if exitErr != nil {
 		return exitErr
 	}
+	forgetDeletedApp(organization, project, appFileNumber)
 	return nil
 }
 
@@ -350,7 +742,7 @@ func getScreenshotsAction(c *cli.Context) error {
 	return nil
 }
 
-func batchRunAction(c *cli.Context) error {
+func batchRunAction(c *cli.Context) (err error) {
 	// handle command line arguments
 	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
 	if err != nil {
@@ -358,28 +750,108 @@ func batchRunAction(c *cli.Context) error {
 	}
 	testSettingsNumber := c.Int("test_settings_number")
 	branchName := c.String("branch_name")
-	setting := c.String("setting")
+	setting, err := parseSettingFlags(c)
+	if err != nil {
+		return err
+	}
+	setting, combinations, err := expandMatrix(c, setting)
+	if err != nil {
+		return err
+	}
 	if testSettingsNumber == 0 && setting == "" {
-		return cli.NewExitError("Either of --test_settings_number or --setting option is required", 1)
+		return cli.NewExitError("Either of --test_settings_number, --setting or --setting_file option is required", 1)
 	}
 	noWait := c.Bool("no_wait")
-	waitLimit := c.Int("wait_limit")
+	waitLimit, err := parseWaitLimit(c)
+	if err != nil {
+		return err
+	}
+	policy, err := parseExitPolicy(c)
+	if err != nil {
+		return err
+	}
+	waitForSlot, err := parseWaitForSlot(c)
+	if err != nil {
+		return err
+	}
+	onTimeout, err := parseTimeoutFlags(c)
+	if err != nil {
+		return err
+	}
+	defer recoverAsErrorExit(policy, &err)
+	if len(combinations) > 0 {
+		// keep stdout parsable as JSON on dry run
+		out := os.Stdout
+		if c.Bool("dry_run") {
+			out = os.Stderr
+		}
+		fmt.Fprintf(out, "matrix expanded into %d test settings:\n", len(combinations))
+		for i, combination := range combinations {
+			fmt.Fprintf(out, "  %d: %s\n", i+1, common.FormatMatrixCombination(combination))
+		}
+	}
+	if c.Bool("dry_run") {
+		req, exitErr := common.DryRunBatchRun(urlBase, organization, project, httpHeadersMap, testSettingsNumber, branchName, setting)
+		if exitErr != nil {
+			return exitErr
+		}
+		fmt.Println(req)
+		return nil
+	}
 
-	_, existsErr, existsUnresolved, batchRunError := common.ExecuteBatchRun(urlBase, apiToken, organization,
-		project, httpHeadersMap, testSettingsNumber, branchName, setting, !noWait, waitLimit, true)
-	if batchRunError != nil {
-		return batchRunError
+	if noWait && c.String("concurrency_group") != "" {
+		return cli.NewExitError("--concurrency_group cannot be used with --no_wait, as the slot is held until the batch run finishes", 1)
 	}
-	if existsErr {
-		return cli.NewExitError("", 1)
+	releaseSlot, err := acquireConcurrencySlot(c, urlBase, apiToken, organization, project, httpHeadersMap)
+	if err != nil {
+		return err
 	}
-	if existsUnresolved {
-		return cli.NewExitError("", 2)
+	var result *common.RunResult
+	defer func() {
+		releaseSlot(result)
+	}()
+
+	batchRun, batchRunError := startOrAttachBatchRun(c, urlBase, apiToken, organization, project, httpHeadersMap,
+		testSettingsNumber, branchName, setting, waitForSlot)
+	if batchRunError == nil {
+		var state *common.WaitState
+		stateFile := c.String("state_file")
+		if stateFile != "" {
+			state = common.NewWaitState(organization, project, batchRun, testSettingsNumber, branchName, setting, waitLimit)
+			if err := state.Save(stateFile); err != nil {
+				return cli.NewExitError(fmt.Sprintf("failed to save the state file: %s", err), 1)
+			}
+		}
+		if noWait {
+			result = &common.RunResult{BatchRun: batchRun}
+		} else if state != nil {
+			result, batchRunError = common.WaitForBatchRunWithState(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, state, stateFile, true)
+		} else {
+			result, batchRunError = common.WaitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, waitLimit, true)
+		}
 	}
-	return nil
+	if result != nil && !noWait {
+		if len(combinations) > 0 {
+			if err := printMatrixResults(urlBase, apiToken, organization, project, httpHeadersMap, result.BatchRun.BatchRunNumber, combinations); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to summarize the matrix results: %s\n", err)
+			}
+		}
+		// metrics are a side product, so their failure does not change the test result
+		if err := exportBatchRunMetrics(c, urlBase, apiToken, organization, project, httpHeadersMap, result.BatchRun.BatchRunNumber); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export metrics: %s\n", err)
+		}
+	}
+	if noWait && batchRunError != nil {
+		return batchRunError
+	}
+	if noWait {
+		return nil
+	}
+	handleTimeout(c, onTimeout, urlBase, apiToken, organization, project, httpHeadersMap, result)
+	return exitByPolicy(policy, result, batchRunError)
 }
 
-func waitForBatchRunAction(c *cli.Context) error {
+func waitForBatchRunAction(c *cli.Context) (err error) {
 	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
 	if err != nil {
 		return err
@@ -388,27 +860,137 @@ func waitForBatchRunAction(c *cli.Context) error {
 	if batchRunNumber == 0 {
 		return cli.NewExitError("--batch_run_number option is not specified or 0", 1)
 	}
-	waitLimit := c.Int("wait_limit")
+	waitLimit, err := parseWaitLimit(c)
+	if err != nil {
+		return err
+	}
+	policy, err := parseExitPolicy(c)
+	if err != nil {
+		return err
+	}
+	onTimeout, err := parseTimeoutFlags(c)
+	if err != nil {
+		return err
+	}
+	defer recoverAsErrorExit(policy, &err)
 
 	batchRunUnderProgress, batchRunError := common.GetBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
 	if batchRunError != nil {
-		return batchRunError
+		return apiErrorExit(policy, batchRunError)
 	}
 
-	_, existsErr, existsUnresolved, batchRunError := common.WaitForBatchRunResult(urlBase, apiToken, organization,
+	result, batchRunError := common.WaitForBatchRun(urlBase, apiToken, organization,
 		project, httpHeadersMap, batchRunUnderProgress, waitLimit, true)
-	if batchRunError != nil {
-		return batchRunError
+	handleTimeout(c, onTimeout, urlBase, apiToken, organization, project, httpHeadersMap, result)
+	return exitByPolicy(policy, result, batchRunError)
+}
+
+func resumeAction(c *cli.Context) (err error) {
+	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
+	if err != nil {
+		return err
+	}
+	stateFile := c.String("state_file")
+	if stateFile == "" {
+		return cli.NewExitError("--state_file option is required", 1)
+	}
+	policy, err := parseExitPolicy(c)
+	if err != nil {
+		return err
+	}
+	onTimeout, err := parseTimeoutFlags(c)
+	if err != nil {
+		return err
+	}
+	defer recoverAsErrorExit(policy, &err)
+	state, err := common.LoadWaitState(stateFile)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	result, batchRunError := common.ResumeWaitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, state, stateFile, true)
+	handleTimeout(c, onTimeout, urlBase, apiToken, organization, project, httpHeadersMap, result)
+	return exitByPolicy(policy, result, batchRunError)
+}
+
+// parseSettingFlags returns the setting JSON given by --setting or --setting_file
+func parseSettingFlags(c *cli.Context) (string, error) {
+	setting := c.String("setting")
+	settingFile := c.String("setting_file")
+	if settingFile == "" {
+		return setting, nil
+	}
+	if setting != "" {
+		return "", cli.NewExitError("--setting and --setting_file cannot be specified at the same time", 1)
+	}
+	vars := map[string]string{}
+	for _, v := range c.StringSlice("var") {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", cli.NewExitError(fmt.Sprintf("--var must be in name=value format: %s", v), 1)
+		}
+		vars[kv[0]] = kv[1]
+	}
+	setting, warnings, exitErr := common.LoadSettingFile(settingFile, vars)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s in %s\n", warning, settingFile)
+	}
+	if exitErr != nil {
+		return "", exitErr
 	}
-	if existsErr {
-		return cli.NewExitError("", 1)
+	return setting, nil
+}
+
+// expandMatrix expands the matrix given by the options and the "matrix" block of the setting into test_settings
+func expandMatrix(c *cli.Context, setting string) (string, []map[string]interface{}, error) {
+	var matrix *common.Matrix
+	if len(c.StringSlice("matrix")) > 0 || len(c.StringSlice("matrix_include")) > 0 || len(c.StringSlice("matrix_exclude")) > 0 {
+		var err error
+		// --matrix_exclude alone applies to the matrix block of the setting
+		matrix, err = common.ParseMatrixFlags(c.StringSlice("matrix"), c.StringSlice("matrix_include"), c.StringSlice("matrix_exclude"))
+		if err != nil {
+			return "", nil, cli.NewExitError(err.Error(), 1)
+		}
 	}
-	if existsUnresolved {
-		return cli.NewExitError("", 2)
+	setting, combinations, exitErr := common.ExpandMatrixSetting(setting, matrix)
+	if exitErr != nil {
+		return "", nil, exitErr
+	}
+	return setting, combinations, nil
+}
+
+func printMatrixResults(urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, batchRunNumber int, combinations []map[string]interface{}) error {
+	batchRun, exitErr := common.GetBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
+	if exitErr != nil {
+		return exitErr
+	}
+	results, err := common.MatrixResults(batchRun, combinations)
+	if err != nil {
+		return err
+	}
+	fmt.Println("results by matrix combination:")
+	for _, result := range results {
+		fmt.Printf("  %s\n", result)
 	}
 	return nil
 }
 
+func parseWaitLimit(c *cli.Context) (common.WaitLimit, error) {
+	waitLimitStr := c.String("wait_limit")
+	if waitLimitStr == "" {
+		return common.WaitLimit{}, nil
+	}
+	if waitLimitStr == "auto" {
+		return common.WaitLimit{Auto: true}, nil
+	}
+	waitLimit, err := strconv.Atoi(waitLimitStr)
+	if err != nil || waitLimit < 0 {
+		return common.WaitLimit{}, cli.NewExitError("--wait_limit option must be a non-negative number or 'auto'", 1)
+	}
+	return common.WaitLimit{Seconds: waitLimit}, nil
+}
+
 func commonFlags() []cli.Flag {
 	return []cli.Flag{
 		cli.StringFlag{
@@ -482,6 +1064,14 @@ func uploadDataPatternCsvAction(c *cli.Context) error {
 		waitLimit = -1
 	}
 	quiet := c.Bool("quiet")
+	if c.Bool("dry_run") {
+		req, exitErr := common.DryRunUploadDataPatternCsv(urlBase, organization, project, testCaseNumber, httpHeadersMap, csvFilePath, overwrite)
+		if exitErr != nil {
+			return exitErr
+		}
+		fmt.Println(req)
+		return nil
+	}
 
 	exitErr := common.UploadDataPatternCsv(urlBase, apiToken, organization, project, testCaseNumber, httpHeadersMap, csvFilePath, overwrite, waitLimit, !quiet)
 	if exitErr != nil {
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDateOrTime(t *testing.T) {
+	tests := []struct {
+		value      string
+		want       time.Time
+		wantIsDate bool
+		wantErr    bool
+	}{
+		{"2026-10-01", time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), true, false},
+		{"2026-10-01T09:30:00+09:00", time.Date(2026, 10, 1, 0, 30, 0, 0, time.UTC), false, false},
+		{"2026-10-01T00:30:00Z", time.Date(2026, 10, 1, 0, 30, 0, 0, time.UTC), false, false},
+		{"2026-10-01 00:30:00", time.Time{}, false, true},
+		{"2026/10/01", time.Time{}, false, true},
+		{"2026-13-01", time.Time{}, false, true},
+		{"yesterday", time.Time{}, false, true},
+	}
+	for _, tt := range tests {
+		got, isDate, err := parseDateOrTime(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDateOrTime(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (!got.Equal(tt.want) || isDate != tt.wantIsDate) {
+			t.Errorf("parseDateOrTime(%q) = %s, %v, want %s, %v", tt.value, got, isDate, tt.want, tt.wantIsDate)
+		}
+	}
+}
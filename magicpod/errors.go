@@ -0,0 +1,61 @@
+package magicpod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+)
+
+// Error is returned when the Web API responds with an error, or when a request cannot be made or completed
+type Error struct {
+	StatusCode int    // HTTP status code of the error response. 0 if there is no response, e.g. for a network error or an invalid argument
+	Message    string // the response body for an error response
+	err        error
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Unwrap returns the cause of the error, e.g. *url.Error for a network error
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// toError converts an error of the package common at the boundary. The cancellation of a context is returned as it is
+func toError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	var apiErr *common.APIError
+	if errors.As(err, &apiErr) {
+		return &Error{StatusCode: apiErr.StatusCode, Message: apiErr.Message, err: err}
+	}
+	return &Error{Message: err.Error(), err: err}
+}
+
+// recoverError turns the panics of common on network errors into an error, since a library should not crash its caller.
+// Other panics, e.g. runtime errors, are bugs and are not recovered
+func recoverError(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if e, ok := r.(error); ok {
+		if _, isRuntime := e.(runtime.Error); !isRuntime {
+			*err = toError(e)
+			return
+		}
+	}
+	panic(r)
+}
@@ -0,0 +1,178 @@
+// Package magicpod is the Go SDK of MagicPod Web API, on which magicpod-api-client is built.
+//
+// The exported identifiers of this package follow semantic versioning shown by Version:
+// they are not removed or changed incompatibly without a new major version.
+// The types of this package are its own, and the package common, which implements the command, has no such guarantee.
+// The errors returned are *Error, except for the cancellation of a context.
+//
+//	client := magicpod.NewClient(os.Getenv("MAGICPOD_API_TOKEN"), "my-organization", "my-project")
+//	result, err := client.RunBatchRun(magicpod.RunOptions{TestSettingsNumber: 1, Wait: true})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if result.HasFailures {
+//		os.Exit(1)
+//	}
+package magicpod
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+)
+
+// Version is the version of the API of this package
+const Version = "1.0.0"
+
+// DefaultURLBase is the server used when Client.URLBase is empty
+const DefaultURLBase = "https://app.magicpod.com"
+
+// API is the set of operations Client provides. Code using MagicPod can depend on it to replace Client with a mock in its tests
+type API interface {
+	UploadApp(appPath string) (int, error)
+	DeleteApp(appFileNumber int) error
+	StartBatchRun(testSettingsNumber int, branchName string, setting string) (*BatchRun, error)
+	GetBatchRun(batchRunNumber int) (*BatchRun, error)
+	WaitForBatchRun(batchRunNumber int, options WaitOptions) (*RunResult, error)
+	RunBatchRun(options RunOptions) (*RunResult, error)
+	BatchRuns(ctx context.Context, options BatchRunsOptions) iter.Seq2[BatchRunSummary, error]
+	BatchRunDetails(ctx context.Context, options BatchRunsOptions, workers int) iter.Seq2[*BatchRun, error]
+	Call(request APIRequest) ([]byte, error)
+}
+
+var _ API = (*Client)(nil)
+
+// Client calls MagicPod Web API for a project
+type Client struct {
+	URLBase      string // DefaultURLBase if empty
+	APIToken     string
+	Organization string
+	Project      string
+	Headers      map[string]string // additional HTTP headers sent with every request
+}
+
+// NewClient returns a client of the project on the default server
+func NewClient(apiToken string, organization string, project string) *Client {
+	return &Client{URLBase: DefaultURLBase, APIToken: apiToken, Organization: organization, Project: project}
+}
+
+// WaitOptions controls how to wait for a batch run
+type WaitOptions struct {
+	WaitLimit     time.Duration // test count x 10 minutes if 0
+	AutoWaitLimit bool          // derive the wait limit from the durations of the recent batch runs of the same test setting instead of WaitLimit
+	PrintProgress bool          // print the progress to stdout like the command
+}
+
+// waitLimit returns the wait limit in the form of the package common
+func (o WaitOptions) waitLimit() common.WaitLimit {
+	return common.WaitLimit{Seconds: int(o.WaitLimit / time.Second), Auto: o.AutoWaitLimit}
+}
+
+// RunOptions stands for a batch run to start
+type RunOptions struct {
+	TestSettingsNumber int
+	BranchName         string
+	Setting            string // test setting in JSON format, overriding that of TestSettingsNumber
+	Wait               bool   // wait for the completion. RunResult only has the started batch run otherwise
+	WaitOptions
+}
+
+func (c *Client) session() *common.Session {
+	urlBase := c.URLBase
+	if urlBase == "" {
+		urlBase = DefaultURLBase
+	}
+	return &common.Session{URLBase: urlBase, APIToken: c.APIToken, Organization: c.Organization, Project: c.Project, Headers: c.Headers}
+}
+
+// UploadApp uploads an app/ipa/apk file, or a zipped .app directory, and returns its file number
+func (c *Client) UploadApp(appPath string) (fileNo int, err error) {
+	defer recoverError(&err)
+	fileNo, err = c.session().UploadApp(appPath)
+	return fileNo, toError(err)
+}
+
+// DeleteApp deletes an uploaded app file
+func (c *Client) DeleteApp(appFileNumber int) (err error) {
+	defer recoverError(&err)
+	return toError(c.session().DeleteApp(appFileNumber))
+}
+
+// StartBatchRun starts a batch run, or a cross batch run, and returns immediately
+func (c *Client) StartBatchRun(testSettingsNumber int, branchName string, setting string) (batchRun *BatchRun, err error) {
+	defer recoverError(&err)
+	started, err := c.session().StartBatchRun(testSettingsNumber, branchName, setting)
+	return fromBatchRun(started), toError(err)
+}
+
+// GetBatchRun retrieves the current state of a batch run
+func (c *Client) GetBatchRun(batchRunNumber int) (batchRun *BatchRun, err error) {
+	defer recoverError(&err)
+	got, err := c.session().GetBatchRun(batchRunNumber)
+	return fromBatchRun(got), toError(err)
+}
+
+// WaitForBatchRun waits until the batch run finishes. When the wait limit passes,
+// the result with TimedOut set is returned together with an error
+func (c *Client) WaitForBatchRun(batchRunNumber int, options WaitOptions) (result *RunResult, err error) {
+	defer recoverError(&err)
+	session := c.session()
+	batchRun, err := session.GetBatchRun(batchRunNumber)
+	if err != nil {
+		return nil, toError(err)
+	}
+	waited, err := session.WaitForBatchRun(batchRun, options.waitLimit(), options.PrintProgress)
+	return fromRunResult(waited), toError(err)
+}
+
+// RunBatchRun starts a batch run and, if options.Wait is true, waits until it finishes
+func (c *Client) RunBatchRun(options RunOptions) (result *RunResult, err error) {
+	defer recoverError(&err)
+	run, err := c.session().RunBatchRun(options.TestSettingsNumber, options.BranchName, options.Setting,
+		options.Wait, options.waitLimit(), options.PrintProgress)
+	return fromRunResult(run), toError(err)
+}
+
+// BatchRuns iterates over the batch runs matching the options in the most recent first order
+func (c *Client) BatchRuns(ctx context.Context, options BatchRunsOptions) iter.Seq2[BatchRunSummary, error] {
+	session := c.session()
+	return func(yield func(BatchRunSummary, error) bool) {
+		for summary, err := range common.BatchRunsSeq(ctx, session.URLBase, session.APIToken, session.Organization, session.Project,
+			session.Headers, options.toCommon()) {
+			if err != nil {
+				yield(BatchRunSummary{}, toError(err))
+				return
+			}
+			if !yield(fromBatchRunSummary(&summary), nil) {
+				return
+			}
+		}
+	}
+}
+
+// BatchRunDetails iterates over the details of the batch runs matching the options in the most recent first order,
+// retrieving up to workers batch runs concurrently
+func (c *Client) BatchRunDetails(ctx context.Context, options BatchRunsOptions, workers int) iter.Seq2[*BatchRun, error] {
+	session := c.session()
+	return func(yield func(*BatchRun, error) bool) {
+		for batchRun, err := range common.BatchRunDetailsSeq(ctx, session.URLBase, session.APIToken, session.Organization, session.Project,
+			session.Headers, options.toCommon(), workers) {
+			if err != nil {
+				yield(nil, toError(err))
+				return
+			}
+			if !yield(fromBatchRun(batchRun), nil) {
+				return
+			}
+		}
+	}
+}
+
+// Call sends a request to any endpoint of the Web API and returns the response body, which is also returned with *Error for an error response
+func (c *Client) Call(request APIRequest) (body []byte, err error) {
+	defer recoverError(&err)
+	body, err = c.session().CallAPI(request.toCommon())
+	return body, toError(err)
+}
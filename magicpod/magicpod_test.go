@@ -0,0 +1,117 @@
+package magicpod
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+)
+
+func TestClientGetBatchRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1.0/org/project/batch-run/7/":
+			w.Write([]byte(`{"batch_run_number": 7, "status": "failed", "url": "https://example.com/7",
+				"started_at": "2026-10-01T10:00:00Z", "duration_seconds": 90.5,
+				"test_cases": {"failed": 1, "total": 1, "details": [{"pattern_name": null, "results": [
+					{"order": 1, "status": "failed", "test_case": {"number": 3, "name": "login", "url": "https://example.com/tc/3"}}]}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail": "Not found."}`))
+		}
+	}))
+	defer server.Close()
+	client := &Client{URLBase: server.URL, APIToken: "token", Organization: "org", Project: "project"}
+
+	batchRun, err := client.GetBatchRun(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batchRun.Status != BatchRunStatusFailed || batchRun.URL != "https://example.com/7" || batchRun.TestCases.Failed != 1 {
+		t.Errorf("unexpected batch run: %+v", batchRun)
+	}
+	if want := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC); !batchRun.StartedAt.Equal(want) || batchRun.Duration != 90500*time.Millisecond {
+		t.Errorf("StartedAt = %s, Duration = %s", batchRun.StartedAt, batchRun.Duration)
+	}
+	if len(batchRun.Details) != 1 || batchRun.Details[0].PatternName != "" || batchRun.Details[0].Results[0].TestCase.Name != "login" {
+		t.Errorf("unexpected details: %+v", batchRun.Details)
+	}
+
+	_, err = client.GetBatchRun(8)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("GetBatchRun(8) error = %#v, want *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusNotFound || apiErr.Message != `{"detail": "Not found."}` {
+		t.Errorf("StatusCode = %d, Message = %q", apiErr.StatusCode, apiErr.Message)
+	}
+}
+
+func TestToError(t *testing.T) {
+	apiErr := &common.APIError{StatusCode: http.StatusConflict, Status: "409 Conflict", Message: `{"detail": "busy"}`}
+	networkErr := &url.Error{Op: "Get", URL: "https://app.magicpod.com", Err: errors.New("connection refused")}
+	tests := []struct {
+		name       string
+		err        error
+		wantError  string
+		wantStatus int
+	}{
+		{"error response", apiErr, `409 Conflict: {"detail": "busy"}`, http.StatusConflict},
+		{"wrapped error response", fmt.Errorf("start: %w", apiErr), `409 Conflict: {"detail": "busy"}`, http.StatusConflict},
+		{"network error", networkErr, networkErr.Error(), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := toError(tt.err)
+			var sdkErr *Error
+			if !errors.As(err, &sdkErr) {
+				t.Fatalf("toError() = %#v, want *Error", err)
+			}
+			if sdkErr.StatusCode != tt.wantStatus || sdkErr.Error() != tt.wantError {
+				t.Errorf("toError() = %d %q, want %d %q", sdkErr.StatusCode, sdkErr.Error(), tt.wantStatus, tt.wantError)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("toError() does not wrap %v", tt.err)
+			}
+		})
+	}
+
+	if err := toError(nil); err != nil {
+		t.Errorf("toError(nil) = %v", err)
+	}
+	canceled := fmt.Errorf("wait: %w", context.Canceled)
+	if err := toError(canceled); err != canceled {
+		t.Errorf("toError() = %v, want the cancellation as it is", err)
+	}
+}
+
+func TestRecoverError(t *testing.T) {
+	networkErr := errors.New("connection refused")
+	recovered := func() (err error) {
+		defer recoverError(&err)
+		panic(networkErr)
+	}()
+	var sdkErr *Error
+	if !errors.As(recovered, &sdkErr) || sdkErr.StatusCode != 0 || !errors.Is(recovered, networkErr) {
+		t.Errorf("recovered error = %#v, want *Error of the network error", recovered)
+	}
+
+	defer func() {
+		if _, ok := recover().(runtime.Error); !ok {
+			t.Error("a runtime error must not be recovered")
+		}
+	}()
+	func() (err error) {
+		defer recoverError(&err)
+		var batchRun *BatchRun
+		return errors.New(batchRun.URL)
+	}()
+}
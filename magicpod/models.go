@@ -0,0 +1,245 @@
+package magicpod
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+)
+
+// BatchRunStatus is the status of a batch run. The server may add new statuses, which IsKnown returns false for
+type BatchRunStatus string
+
+const (
+	BatchRunStatusRunning    BatchRunStatus = "running"
+	BatchRunStatusSucceeded  BatchRunStatus = "succeeded"
+	BatchRunStatusFailed     BatchRunStatus = "failed"
+	BatchRunStatusUnresolved BatchRunStatus = "unresolved"
+	BatchRunStatusAborted    BatchRunStatus = "aborted"
+)
+
+// IsKnown returns true if the status is one of the statuses this package knows
+func (s BatchRunStatus) IsKnown() bool {
+	return s == BatchRunStatusRunning || s.IsTerminal()
+}
+
+// IsTerminal returns true if the batch run has finished. It returns false for unknown statuses
+func (s BatchRunStatus) IsTerminal() bool {
+	switch s {
+	case BatchRunStatusSucceeded, BatchRunStatusFailed, BatchRunStatusUnresolved, BatchRunStatusAborted:
+		return true
+	}
+	return false
+}
+
+// TestCasesSummary is the numbers of the test cases of a batch run by status
+type TestCasesSummary struct {
+	NotRunning int
+	Running    int
+	Succeeded  int
+	Failed     int
+	Aborted    int
+	Unresolved int
+	Total      int
+}
+
+// BatchRunSummary is a batch run as listed by Client.BatchRuns
+type BatchRunSummary struct {
+	BatchRunNumber  int
+	TestSettingName string
+	BranchName      string
+	Status          BatchRunStatus
+	StartedAt       time.Time     // zero if not started
+	FinishedAt      time.Time     // zero if not finished
+	Duration        time.Duration // 0 if not given by the server
+	TestCases       TestCasesSummary
+	URL             string
+}
+
+// BatchRun is a batch run with the results of its test cases
+type BatchRun struct {
+	BatchRunSummary
+	OrganizationName string
+	ProjectName      string
+	Details          []TestCaseDetail // the results of each pattern. Empty for the batch runs just started
+}
+
+// TestCaseDetail is the results of the test cases run with a pattern, i.e. a test setting of a cross batch run
+type TestCaseDetail struct {
+	PatternName    string // empty if the batch run has a single pattern
+	IncludedLabels []string
+	ExcludedLabels []string
+	Results        []TestCaseResult
+}
+
+// TestCaseResult is the result of a test case in a pattern
+type TestCaseResult struct {
+	Order        int
+	TestCase     TestCase
+	Status       string
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	Duration     time.Duration
+	DataPatterns []DataPattern
+}
+
+// TestCase identifies a test case of the project
+type TestCase struct {
+	Number int
+	Name   string
+	URL    string
+}
+
+// DataPattern is the result of a data pattern of a test case
+type DataPattern struct {
+	DataIndex  int
+	Status     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// RunResult is the outcome of a batch run. HasFailures and HasUnresolved correspond to the exit codes 1 and 2 of the command
+type RunResult struct {
+	BatchRun      *BatchRun // the latest state retrieved from the server
+	HasFailures   bool      // failed or aborted, or its status could not be retrieved
+	HasUnresolved bool
+	TimedOut      bool // the wait limit passed before the batch run finished
+}
+
+// BatchRunFilter narrows down the batch runs iterated by Client.BatchRuns. The zero value matches every batch run
+type BatchRunFilter struct {
+	Statuses        []BatchRunStatus
+	TestSettingName string
+	BranchName      string
+	Since           time.Time // started at or after
+	Until           time.Time // started before
+}
+
+// BatchRunsOptions controls which batch runs Client.BatchRuns iterates over
+type BatchRunsOptions struct {
+	Filter            BatchRunFilter
+	PageSize          int // batch runs requested at a time. A default size if 0
+	MaxBatchRunNumber int // the latest batch run if 0
+	MinBatchRunNumber int // the first batch run if 0
+}
+
+// APIRequest is a request to any endpoint of the Web API for Client.Call
+type APIRequest struct {
+	Method     string
+	Path       string            // path under /api/v1.0, e.g. /{organization}/{project}/batch-runs/
+	PathParams map[string]string // values of the placeholders in Path other than {organization} and {project}
+	Query      url.Values
+	Body       []byte            // sent as JSON if not nil
+	Form       map[string]string // sent as multipart form data with Files
+	Files      map[string]string // form field name to file path
+}
+
+func fromDuration(seconds *float64) time.Duration {
+	if seconds == nil {
+		return 0
+	}
+	return time.Duration(*seconds * float64(time.Second))
+}
+
+func fromTestCasesSummary(s common.TestCasesSummary) TestCasesSummary {
+	return TestCasesSummary{
+		NotRunning: s.NotRunning,
+		Running:    s.Running,
+		Succeeded:  s.Succeeded,
+		Failed:     s.Failed,
+		Aborted:    s.Aborted,
+		Unresolved: s.Unresolved,
+		Total:      s.Total,
+	}
+}
+
+func fromBatchRunSummary(b *common.BatchRunSummary) BatchRunSummary {
+	return BatchRunSummary{
+		BatchRunNumber:  b.BatchRunNumber,
+		TestSettingName: b.TestSettingName,
+		BranchName:      b.BranchName,
+		Status:          BatchRunStatus(b.Status),
+		StartedAt:       b.StartedAt.Time,
+		FinishedAt:      b.FinishedAt.Time,
+		Duration:        fromDuration(b.DurationSeconds),
+		TestCases:       fromTestCasesSummary(b.TestCases),
+		URL:             b.Url,
+	}
+}
+
+func fromBatchRun(b *common.BatchRun) *BatchRun {
+	if b == nil {
+		return nil
+	}
+	summary := b.Summary()
+	batchRun := &BatchRun{
+		BatchRunSummary:  fromBatchRunSummary(&summary),
+		OrganizationName: b.OrganizationName,
+		ProjectName:      b.ProjectName,
+	}
+	for _, d := range b.TestCases.Details {
+		detail := TestCaseDetail{IncludedLabels: d.IncludedLabels, ExcludedLabels: d.ExcludedLabels}
+		if d.PatternName != nil {
+			detail.PatternName = *d.PatternName
+		}
+		for _, r := range d.Results {
+			result := TestCaseResult{
+				Order:      r.Order,
+				TestCase:   TestCase{Number: r.TestCase.Number, Name: r.TestCase.Name, URL: r.TestCase.Url},
+				Status:     r.Status,
+				StartedAt:  r.StartedAt.Time,
+				FinishedAt: r.FinishedAt.Time,
+				Duration:   fromDuration(r.DurationSeconds),
+			}
+			for _, p := range r.DataPatterns {
+				result.DataPatterns = append(result.DataPatterns, DataPattern{
+					DataIndex:  p.DataIndex,
+					Status:     p.Status,
+					StartedAt:  p.StartedAt.Time,
+					FinishedAt: p.FinishedAt.Time,
+				})
+			}
+			detail.Results = append(detail.Results, result)
+		}
+		batchRun.Details = append(batchRun.Details, detail)
+	}
+	return batchRun
+}
+
+func fromRunResult(r *common.RunResult) *RunResult {
+	if r == nil {
+		return nil
+	}
+	return &RunResult{BatchRun: fromBatchRun(r.BatchRun), HasFailures: r.HasFailures, HasUnresolved: r.HasUnresolved, TimedOut: r.TimedOut}
+}
+
+func (o BatchRunsOptions) toCommon() common.BatchRunsOptions {
+	statuses := make([]string, 0, len(o.Filter.Statuses))
+	for _, status := range o.Filter.Statuses {
+		statuses = append(statuses, string(status))
+	}
+	return common.BatchRunsOptions{
+		Filter: common.BatchRunFilter{
+			Statuses:        statuses,
+			TestSettingName: o.Filter.TestSettingName,
+			BranchName:      o.Filter.BranchName,
+			Since:           o.Filter.Since,
+			Until:           o.Filter.Until,
+		},
+		PageSize:          o.PageSize,
+		MaxBatchRunNumber: o.MaxBatchRunNumber,
+		MinBatchRunNumber: o.MinBatchRunNumber,
+	}
+}
+
+func (r APIRequest) toCommon() common.APIRequest {
+	return common.APIRequest{
+		Method:     r.Method,
+		Path:       r.Path,
+		PathParams: r.PathParams,
+		Query:      r.Query,
+		Body:       r.Body,
+		Form:       r.Form,
+		Files:      r.Files,
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+func reattachFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "idempotency_key",
+			Usage: "Key such as a commit hash. If a batch run of the same test settings, branch and setting was started with the key in the last 7 days, it is waited for instead of starting a new one. Set MAGICPOD_STATE_DIR to a shared directory to share the keys between machines",
+		},
+		cli.BoolFlag{
+			Name:  "attach_if_running",
+			Usage: "Wait for the running batch run of --test_setting_name and the same branch started in the last 7 days, if any, instead of starting a new one",
+		},
+		cli.StringFlag{
+			Name:  "test_setting_name",
+			Usage: "Name of the test setting, as shown in the batch runs, to look for with --attach_if_running. Required with --attach_if_running",
+		},
+	}
+}
+
+// startOrAttachBatchRun returns the batch run to wait for: the one started with --idempotency_key, the running one for --attach_if_running,
+// or a new one, retried for up to waitForSlot while the server is at capacity
+func startOrAttachBatchRun(c *cli.Context, urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	testSettingsNumber int, branchName string, setting string, waitForSlot time.Duration) (*common.BatchRun, *cli.ExitError) {
+	idempotencyKey := c.String("idempotency_key")
+	if idempotencyKey != "" {
+		batchRunNumber, err := common.FindIdempotentBatchRun(organization, project, idempotencyKey, testSettingsNumber, branchName, setting)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read the idempotency keys: %s\n", err)
+		} else if batchRunNumber != 0 {
+			fmt.Fprintf(os.Stderr, "batch run #%d was already started with idempotency key '%s'\n", batchRunNumber, idempotencyKey)
+			return attachBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
+		}
+	}
+	if c.Bool("attach_if_running") {
+		// the batch runs are listed with the name of their test setting, not with its number
+		testSettingName := c.String("test_setting_name")
+		if testSettingName == "" {
+			return nil, cli.NewExitError("--attach_if_running requires --test_setting_name", 1)
+		}
+		running, exitErr := common.FindRunningBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, testSettingName, branchName)
+		if exitErr != nil {
+			return nil, exitErr
+		}
+		if running != nil {
+			fmt.Fprintf(os.Stderr, "batch run #%d of '%s' is running\n", running.BatchRunNumber, testSettingName)
+			return attachBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, running.BatchRunNumber)
+		}
+	}
+
+	batchRun, exitErr := common.StartBatchRunWaitingForSlot(urlBase, apiToken, organization, project, httpHeadersMap,
+		testSettingsNumber, branchName, setting, waitForSlot)
+	if exitErr != nil {
+		return nil, exitErr
+	}
+	recordAppFileReferences(organization, project, batchRun, setting)
+	if idempotencyKey != "" {
+		if err := common.RecordIdempotencyKey(organization, project, idempotencyKey, testSettingsNumber, branchName, setting, batchRun.BatchRunNumber); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to record the idempotency key: %s\n", err)
+		}
+	}
+	fmt.Printf("test result page:\n")
+	fmt.Printf("%s\n", batchRun.Url)
+	return batchRun, nil
+}
+
+func attachBatchRun(urlBase string, apiToken string, organization string, project string, httpHeadersMap map[string]string,
+	batchRunNumber int) (*common.BatchRun, *cli.ExitError) {
+	batchRun, exitErr := common.GetBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRunNumber)
+	if exitErr != nil {
+		return nil, exitErr
+	}
+	fmt.Printf("attached to the existing batch run. test result page:\n")
+	fmt.Printf("%s\n", batchRun.Url)
+	return batchRun, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+// cleanup policies of run-app
+const (
+	cleanupAlways    = "always"
+	cleanupOnSuccess = "on_success"
+	cleanupNever     = "never"
+)
+
+func runAppFlags() []cli.Flag {
+	return append(append(commonFlags(), []cli.Flag{
+		cli.StringFlag{
+			Name:  "app_path, a",
+			Usage: "Path to the app/ipa/apk file to upload",
+		},
+		cli.IntFlag{
+			Name:  "test_settings_number, S",
+			Usage: "Test settings number defined in the project batch run page",
+		},
+		cli.StringFlag{
+			Name:  "branch_name, B",
+			Usage: "Branch name of the test cases to run",
+		},
+		cli.StringFlag{
+			Name:  "setting, s",
+			Usage: "Test setting in JSON format. app_file_number is set to the uploaded app, in every entry of test_settings if any",
+		},
+		cli.StringFlag{
+			Name:  "setting_file, f",
+			Usage: "Test setting in a YAML or JSON file. Cannot be used with --setting",
+		},
+		cli.StringSliceFlag{
+			Name:  "var",
+			Usage: "Variable for --setting_file in name=value format. Can be specified multiple times",
+		},
+		cli.StringFlag{
+			Name:  "wait_limit, w",
+			Usage: "Wait limit in seconds. If 0 is specified, the value is test count x 10 minutes. If 'auto' is specified, the value is derived from the durations of the previous batch runs of the same test setting",
+		},
+		cli.StringFlag{
+			Name:  "cleanup",
+			Usage: "When to delete the uploaded app: 'always', 'on_success' (only when the batch run succeeded without unresolved tests) or 'never'. Timeouts and interrupts are not a success",
+			Value: cleanupOnSuccess,
+		},
+	}...), append(append(append(slotFlags(), concurrencyFlags()...), timeoutFlags()...), exitPolicyFlags()...)...)
+}
+
+// runAppAction uploads the app, runs the batch run for it, waits for the result and deletes the app according to --cleanup
+func runAppAction(c *cli.Context) (err error) {
+	// handle command line arguments
+	urlBase, apiToken, organization, project, httpHeadersMap, err := parseCommonFlags(c)
+	if err != nil {
+		return err
+	}
+	appPath := c.String("app_path")
+	if appPath == "" {
+		return cli.NewExitError("--app_path option is required", 1)
+	}
+	cleanup := c.String("cleanup")
+	if cleanup != cleanupAlways && cleanup != cleanupOnSuccess && cleanup != cleanupNever {
+		return cli.NewExitError("--cleanup option must be 'always', 'on_success' or 'never'", 1)
+	}
+	testSettingsNumber := c.Int("test_settings_number")
+	branchName := c.String("branch_name")
+	setting, err := parseSettingFlags(c)
+	if err != nil {
+		return err
+	}
+	waitLimit, err := parseWaitLimit(c)
+	if err != nil {
+		return err
+	}
+	policy, err := parseExitPolicy(c)
+	if err != nil {
+		return err
+	}
+	waitForSlot, err := parseWaitForSlot(c)
+	if err != nil {
+		return err
+	}
+	onTimeout, err := parseTimeoutFlags(c)
+	if err != nil {
+		return err
+	}
+	defer recoverAsErrorExit(policy, &err)
+	if testSettingsNumber == 0 && setting == "" {
+		return cli.NewExitError("Either of --test_settings_number, --setting or --setting_file option is required", 1)
+	}
+	// check the setting before uploading so that an invalid setting does not leave the app behind
+	if _, exitErr := common.InjectAppFileNumber(setting, 0); exitErr != nil {
+		return exitErr
+	}
+
+	releaseSlot, err := acquireConcurrencySlot(c, urlBase, apiToken, organization, project, httpHeadersMap)
+	if err != nil {
+		return err
+	}
+	var result *common.RunResult
+	var started atomic.Pointer[common.BatchRun] // read by the signal handler
+	var releaseOnce sync.Once
+	freeSlot := func(result *common.RunResult) {
+		releaseOnce.Do(func() { releaseSlot(result) })
+	}
+	defer func() {
+		freeSlot(result)
+	}()
+
+	fileNo, exitErr := common.UploadApp(urlBase, apiToken, organization, project, httpHeadersMap, appPath)
+	if exitErr != nil {
+		return exitErr
+	}
+	fmt.Printf("uploaded app file number: %d\n", fileNo)
+
+	var cleanupOnce sync.Once
+	cleanupApp := func(succeeded bool) {
+		cleanupOnce.Do(func() {
+			if !shouldDeleteApp(cleanup, succeeded) {
+				fmt.Printf("app file %d is kept\n", fileNo)
+				return
+			}
+			if exitErr := common.DeleteApp(urlBase, apiToken, organization, project, httpHeadersMap, fileNo); exitErr != nil {
+				fmt.Fprintf(os.Stderr, "failed to delete app file %d: %s\n", fileNo, exitErr)
+				return
+			}
+			forgetDeletedApp(organization, project, fileNo)
+			fmt.Printf("app file %d is deleted\n", fileNo)
+		})
+	}
+	// the deferred cleanup and the release of the slot do not run when the process is killed by a signal, so handle them here
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+	go func() {
+		if _, ok := <-signals; !ok {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "interrupted")
+		cleanupApp(false)
+		// the batch run goes on without this process, so its slot is kept until it finishes
+		freeSlot(&common.RunResult{BatchRun: started.Load()})
+		shutdownGlobalOptions()
+		os.Exit(130)
+	}()
+	succeeded := false
+	defer func() {
+		// also runs on panic, e.g. on a network error
+		cleanupApp(succeeded)
+	}()
+
+	setting, _ = common.InjectAppFileNumber(setting, fileNo)
+	batchRun, batchRunError := common.StartBatchRunWaitingForSlot(urlBase, apiToken, organization, project, httpHeadersMap,
+		testSettingsNumber, branchName, setting, waitForSlot)
+	if batchRunError == nil {
+		started.Store(batchRun)
+		recordAppFileReferences(organization, project, batchRun, setting)
+		fmt.Printf("test result page:\n")
+		fmt.Printf("%s\n", batchRun.Url)
+		result, batchRunError = common.WaitForBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun, waitLimit, true)
+	}
+	succeeded = runSucceeded(result, batchRunError)
+	handleTimeout(c, onTimeout, urlBase, apiToken, organization, project, httpHeadersMap, result)
+	return exitByPolicy(policy, result, batchRunError)
+}
+
+// runSucceeded tells whether the batch run really succeeded. The app is kept for investigation otherwise,
+// even if the exit policy allows the failures
+func runSucceeded(result *common.RunResult, batchRunError *cli.ExitError) bool {
+	return batchRunError == nil && result != nil && result.BatchRun.Status == common.BatchRunStatusSucceeded && !result.HasUnresolved
+}
+
+// shouldDeleteApp applies --cleanup to the outcome of the run. An interrupted run is not a success
+func shouldDeleteApp(cleanup string, succeeded bool) bool {
+	switch cleanup {
+	case cleanupAlways:
+		return true
+	case cleanupOnSuccess:
+		return succeeded
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+func TestRunAppCleanupPolicy(t *testing.T) {
+	outcomes := []struct {
+		name          string
+		result        *common.RunResult
+		batchRunError *cli.ExitError
+		succeeded     bool
+	}{
+		{"succeeded", &common.RunResult{BatchRun: &common.BatchRun{Status: common.BatchRunStatusSucceeded}}, nil, true},
+		{"failed", &common.RunResult{BatchRun: &common.BatchRun{Status: common.BatchRunStatusFailed}, HasFailures: true}, nil, false},
+		{"unresolved", &common.RunResult{BatchRun: &common.BatchRun{Status: common.BatchRunStatusSucceeded}, HasUnresolved: true}, nil, false},
+		{"timed out", &common.RunResult{BatchRun: &common.BatchRun{Status: common.BatchRunStatusRunning}, TimedOut: true},
+			cli.NewExitError("batch run never finished", 1), false},
+		{"not started", nil, cli.NewExitError("400 Bad Request", 1), false},
+	}
+	wantDeleted := map[string]map[string]bool{
+		cleanupAlways:    {"succeeded": true, "failed": true, "unresolved": true, "timed out": true, "not started": true, "interrupted": true},
+		cleanupOnSuccess: {"succeeded": true},
+		cleanupNever:     {},
+	}
+	for cleanup, want := range wantDeleted {
+		for _, outcome := range outcomes {
+			succeeded := runSucceeded(outcome.result, outcome.batchRunError)
+			if succeeded != outcome.succeeded {
+				t.Errorf("%s: runSucceeded() = %v, want %v", outcome.name, succeeded, outcome.succeeded)
+			}
+			if got := shouldDeleteApp(cleanup, succeeded); got != want[outcome.name] {
+				t.Errorf("--cleanup %s, %s: shouldDeleteApp() = %v, want %v", cleanup, outcome.name, got, want[outcome.name])
+			}
+		}
+		// the signal handler cleans up as a failure
+		if got := shouldDeleteApp(cleanup, false); got != want["interrupted"] {
+			t.Errorf("--cleanup %s, interrupted: shouldDeleteApp() = %v, want %v", cleanup, got, want["interrupted"])
+		}
+	}
+}
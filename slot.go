@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func slotFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.IntFlag{
+			Name:  "wait_for_slot",
+			Usage: "Seconds to keep retrying with backoff while the server refuses to start the batch run with 429, 503 or Retry-After because too many are running or requested. Other errors are not retried. 0 means no retry",
+		},
+	}
+}
+
+func parseWaitForSlot(c *cli.Context) (time.Duration, error) {
+	seconds := c.Int("wait_for_slot")
+	if seconds < 0 {
+		return 0, cli.NewExitError("--wait_for_slot option must be 0 or more", 1)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
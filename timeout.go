@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Magic-Pod/magicpod-api-client/common"
+	"github.com/urfave/cli"
+)
+
+// actions of --on_timeout
+const (
+	onTimeoutAbort  = "abort"
+	onTimeoutLeave  = "leave"
+	onTimeoutReport = "report"
+)
+
+func timeoutFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "on_timeout",
+			Usage: "What to do with the batch run when the wait limit passes: 'leave' it running, 'report' the partial results to --timeout_report and leave it, or 'abort' it. The unfinished test cases are shown in any case",
+			Value: onTimeoutLeave,
+		},
+		cli.StringFlag{
+			Name:  "timeout_report",
+			Usage: "File to write the partial results to when the wait limit passes. JUnit XML if it ends with .xml, JSON otherwise",
+		},
+	}
+}
+
+func parseTimeoutFlags(c *cli.Context) (string, error) {
+	onTimeout := c.String("on_timeout")
+	switch onTimeout {
+	case onTimeoutAbort, onTimeoutLeave:
+	case onTimeoutReport:
+		if c.String("timeout_report") == "" {
+			return "", cli.NewExitError("--timeout_report option is required for --on_timeout report", 1)
+		}
+	default:
+		return "", cli.NewExitError("--on_timeout option must be 'abort', 'leave' or 'report'", 1)
+	}
+	return onTimeout, nil
+}
+
+// handleTimeout shows what had not finished when the wait timed out, writes the partial report and aborts the batch run as requested.
+// A failure to abort is only reported, so that the exit code is still decided by the policy
+func handleTimeout(c *cli.Context, onTimeout string, urlBase string, apiToken string, organization string, project string,
+	httpHeadersMap map[string]string, result *common.RunResult) {
+	if result == nil || !result.TimedOut {
+		return
+	}
+	batchRun := result.BatchRun
+	fmt.Fprint(os.Stderr, common.TimeoutDiagnostic(batchRun))
+	if reportPath := c.String("timeout_report"); reportPath != "" {
+		if err := writePartialReport(reportPath, batchRun); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write the partial report: %s\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "partial results are written to %s\n", reportPath)
+		}
+	}
+	if onTimeout != onTimeoutAbort {
+		return
+	}
+	if exitErr := common.AbortBatchRun(urlBase, apiToken, organization, project, httpHeadersMap, batchRun.BatchRunNumber); exitErr != nil {
+		fmt.Fprintf(os.Stderr, "failed to abort batch run #%d: %s\n", batchRun.BatchRunNumber, exitErr)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "batch run #%d is aborted\n", batchRun.BatchRunNumber)
+}
+
+func writePartialReport(path string, batchRun *common.BatchRun) error {
+	format := "json"
+	if strings.EqualFold(filepath.Ext(path), ".xml") {
+		format = "junit"
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := common.WritePartialReport(f, batchRun, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}